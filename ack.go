@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+	"github.com/mattn/go-isatty"
+)
+
+// ackPrompter asks, for each changed block, whether to ack it.
+type ackPrompter struct {
+	opts    codemap.Options
+	answers *bufio.Reader
+	// quit is set once the user has answered "q", which declines every remaining block.
+	quit bool
+}
+
+// newAckPrompter reads answers from stdin when it's a terminal, otherwise from the
+// controlling terminal, since stdin may be the list of filenames.
+func newAckPrompter(opts codemap.Options) (*ackPrompter, func(), error) {
+	if isatty.IsTerminal(os.Stdin.Fd()) {
+		return &ackPrompter{opts: opts, answers: bufio.NewReader(os.Stdin)}, func() {}, nil
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, nil, fmt.Errorf("ack -i needs a terminal to ask questions: %w", err)
+	}
+
+	return &ackPrompter{opts: opts, answers: bufio.NewReader(tty)}, func() { tty.Close() }, nil
+}
+
+// confirm shows how the changed block differs from another block of its group, and asks whether to ack it.
+func (p *ackPrompter) confirm(groupInfo codemap.TokenGroupInfo, group []codemap.TokenGroupInfo) (bool, error) {
+	if p.quit {
+		return false, nil
+	}
+
+	fmt.Printf("group \"%s\" block %s:%d (lines %d-%d) has changes\n",
+		groupInfo.Token,
+		groupInfo.FileSource.Filename,
+		groupInfo.StartLineNumber,
+		groupInfo.StartLineNumber+1,
+		groupInfo.EndLineNumber-1,
+	)
+
+	err := p.printDiff(groupInfo, group)
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		fmt.Print("ack this block? [y/n/q] ")
+
+		answer, err := p.answers.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && answer != "") {
+			fmt.Println()
+			return false, fmt.Errorf("failed to read answer: %w", err)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		case "q", "quit":
+			p.quit = true
+			return false, nil
+		}
+	}
+}
+
+// printDiff prints the differences from the first unchanged block of the group (or else the first
+// other block) to the changed block.
+func (p *ackPrompter) printDiff(groupInfo codemap.TokenGroupInfo, group []codemap.TokenGroupInfo) error {
+	var other *codemap.TokenGroupInfo
+	for i := range group {
+		if group[i].FileSource.Filename == groupInfo.FileSource.Filename && group[i].StartLineNumber == groupInfo.StartLineNumber {
+			continue
+		}
+		if other == nil || other.Changed() && !group[i].Changed() {
+			other = &group[i]
+		}
+	}
+
+	if other == nil {
+		fmt.Println("  (the group has no other block to compare with)")
+		return nil
+	}
+
+	content, err := codemap.ReadBlock(p.opts, groupInfo)
+	if err != nil {
+		return err
+	}
+
+	otherContent, err := codemap.ReadBlock(p.opts, *other)
+	if err != nil {
+		return err
+	}
+
+	diff := codemap.UnifiedDiff(
+		fmt.Sprintf("%s:%d", other.FileSource.Filename, other.StartLineNumber),
+		fmt.Sprintf("%s:%d", groupInfo.FileSource.Filename, groupInfo.StartLineNumber),
+		otherContent,
+		content,
+	)
+	if diff == "" {
+		diff = fmt.Sprintf("  (same content as %s:%d)\n", other.FileSource.Filename, other.StartLineNumber)
+	}
+	fmt.Print(diff)
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package codemap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// inventoryCacheVersion is written at the start of the cache file. Increment it whenever the cached
+// data, or what is found in files, changes, so that older caches are ignored.
+const inventoryCacheVersion = 1
+
+// CacheFilename is the name of the inventory cache file in the Git directory.
+const CacheFilename = "codemap-cache"
+
+// InventoryCache remembers what was found in each file, so that unchanged files aren't read again.
+// Files are identified by their Git object ID, or by their size and modification time if they have
+// changes that aren't in the Git index or aren't tracked. See Options.Cache.
+type InventoryCache struct {
+	filename string
+
+	// entries were loaded from the file, by filename.
+	entries map[string]cacheEntry
+	// used are the entries found or added by this run, which are saved.
+	used map[string]cacheEntry
+	hits int
+	mu   sync.Mutex
+
+	// options identifies the options the entries were found with.
+	options string
+
+	// objectIDs are the Git object IDs of the files in the index, by filename, and modified lists the
+	// files whose content in the working directory may differ.
+	objectIDs map[string]string
+	modified  map[string]struct{}
+	prepared  bool
+}
+
+type cacheFile struct {
+	// Options identifies the options that affect what's found in files.
+	Options string
+	Entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	// Key identifies the content of the file; see InventoryCache.key.
+	Key string
+	// Skipped is set for files that were too large to inventory.
+	Skipped  bool
+	Markdown bool
+	// NeedsTokens is set for files with tags that don't have tokens yet. They're inventoried again
+	// unless the mode is ModeCheck, so that the tokens are generated.
+	NeedsTokens bool
+	Singles     []cachedSingle
+	Groups      []cachedGroup
+}
+
+type cachedSingle struct {
+	Token string
+	TokenLocation
+}
+
+// cachedGroup keeps the unexported fields of TokenGroupInfo, which gob doesn't encode.
+type cachedGroup struct {
+	TokenGroupInfo
+	PrimaryAttribute bool
+}
+
+// DefaultCacheFilename returns the path of CacheFilename in the Git directory.
+func DefaultCacheFilename() (string, error) {
+	return gitOutput("rev-parse", "--git-path", CacheFilename)
+}
+
+// OpenInventoryCache loads the cache in filename. A cache that doesn't exist, or was written in another
+// format version, is empty.
+func OpenInventoryCache(filename string) (*InventoryCache, error) {
+	c := &InventoryCache{
+		filename: filename,
+		entries:  map[string]cacheEntry{},
+		used:     map[string]cacheEntry{},
+	}
+
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+
+	var version int
+	if dec.Decode(&version) != nil || version != inventoryCacheVersion {
+		return c, nil
+	}
+
+	var file cacheFile
+	if dec.Decode(&file) != nil {
+		return c, nil
+	}
+
+	c.entries = file.Entries
+	c.options = file.Options
+
+	return c, nil
+}
+
+// ClearInventoryCache deletes the cache file. It isn't an error if there isn't one.
+func ClearInventoryCache(filename string) error {
+	err := os.Remove(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Save writes the entries of the files that were inventoried since the cache was opened,
+// so that files that no longer exist are forgotten.
+func (c *InventoryCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+
+	err := enc.Encode(inventoryCacheVersion)
+	if err != nil {
+		return err
+	}
+
+	err = enc.Encode(cacheFile{Options: c.options, Entries: c.used})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that a concurrent run never reads half a cache.
+	tmp, err := os.CreateTemp(filepath.Dir(c.filename), CacheFilename+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.filename)
+}
+
+// Hits returns the number of files that were found in the cache.
+func (c *InventoryCache) Hits() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits
+}
+
+// prepare discards the entries if they were found with different options, and lists the Git object IDs
+// of the files. Without Git, files are identified by their size and modification time.
+func (c *InventoryCache) prepare(opts Options) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.prepared {
+		return
+	}
+	c.prepared = true
+
+	options := cacheOptions(opts)
+	if c.options != options {
+		c.entries = map[string]cacheEntry{}
+		c.options = options
+	}
+
+	c.objectIDs = map[string]string{}
+	c.modified = map[string]struct{}{}
+
+	output, err := exec.Command("git", "ls-files", "--stage", "-z").Output()
+	if err != nil {
+		return
+	}
+
+	for _, lineBytes := range bytes.Split(output, []byte{0}) {
+		// 100644 b438169c25a6cf5649e09d8d51092998fa4e904e 0	Dockerfile
+		parts := spacesRegexp.Split(string(lineBytes), 4)
+		if len(parts) == 4 && parts[2] == "0" {
+			c.objectIDs[parts[3]] = parts[1]
+		}
+	}
+
+	// Like ls-files, diff-files --relative lists the files relative to the working directory.
+	output, err = exec.Command("git", "diff-files", "--relative", "--name-only", "-z").Output()
+	if err != nil {
+		// Every file might have been modified.
+		c.objectIDs = map[string]string{}
+		return
+	}
+
+	for _, filename := range splitNulDelimited(output) {
+		c.modified[filename] = struct{}{}
+	}
+}
+
+// cacheOptions identifies the options that affect what's found in files.
+func cacheOptions(opts Options) string {
+	data, err := json.Marshal([]interface{}{
+		opts.tagBase(),
+		opts.maxFileSize(),
+		opts.MarkdownExtensions,
+		docFormatsOption(opts),
+		opts.CommentSyntaxes,
+		opts.GroupNormalize,
+		opts.groupHash(),
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to encode options: %w", err))
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// key identifies the content of fileSource, or returns "" if it can't be identified.
+func (c *InventoryCache) key(fileSource FileSource) string {
+	objectID, inIndex := c.objectIDs[fileSource.Filename]
+	_, isModified := c.modified[fileSource.Filename]
+
+	if inIndex && (fileSource.FromGitIndex || !isModified) {
+		return objectID
+	}
+	if fileSource.FromGitIndex {
+		return ""
+	}
+
+	info, err := os.Stat(fileSource.Filename)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%d@%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// lookup returns the entry for filename if its content hasn't changed since it was cached, and
+// it doesn't need tokens when generatingTokens.
+func (c *InventoryCache) lookup(filename string, key string, generatingTokens bool) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[filename]
+	if !ok || key == "" || entry.Key != key || generatingTokens && entry.NeedsTokens {
+		return cacheEntry{}, false
+	}
+
+	c.used[filename] = entry
+	c.hits++
+
+	return entry, true
+}
+
+func (c *InventoryCache) store(filename string, entry cacheEntry) {
+	if entry.Key == "" {
+		return
+	}
+
+	c.mu.Lock()
+	c.used[filename] = entry
+	c.mu.Unlock()
+}
+
+// newCacheEntry records what was found in a file.
+func newCacheEntry(key string, fileInventory *Inventory, found fileFindings) cacheEntry {
+	entry := cacheEntry{
+		Key:         key,
+		Skipped:     found.Skipped,
+		Markdown:    len(fileInventory.MarkdownFileSources) > 0,
+		NeedsTokens: found.NeedsTokens,
+	}
+
+	for token, locs := range fileInventory.SinglesByToken {
+		for _, loc := range locs {
+			entry.Singles = append(entry.Singles, cachedSingle{Token: token, TokenLocation: loc})
+		}
+	}
+
+	for _, groupInfos := range fileInventory.GroupsByToken {
+		for _, groupInfo := range groupInfos {
+			entry.Groups = append(entry.Groups, cachedGroup{
+				TokenGroupInfo:   groupInfo,
+				PrimaryAttribute: groupInfo.primaryAttribute,
+			})
+		}
+	}
+
+	return entry
+}
+
+// addCacheEntry adds what was found in fileSource, as recorded by entry, to the inventory.
+func (inv *Inventory) addCacheEntry(fileSource FileSource, entry cacheEntry) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if entry.Markdown {
+		inv.MarkdownFileSources = append(inv.MarkdownFileSources, fileSource)
+	}
+
+	for _, single := range entry.Singles {
+		inv.SinglesByToken[single.Token] = append(inv.SinglesByToken[single.Token], single.TokenLocation)
+	}
+
+	for _, group := range entry.Groups {
+		groupInfo := group.TokenGroupInfo
+		groupInfo.FileSource = fileSource
+		groupInfo.primaryAttribute = group.PrimaryAttribute
+		inv.GroupsByToken[groupInfo.Token] = append(inv.GroupsByToken[groupInfo.Token], groupInfo)
+	}
+}
+
+// isOSFileSystem reports whether files are read from the working directory and Git index, where the
+// cache can tell whether they've changed.
+func (o Options) isOSFileSystem() bool {
+	_, ok := o.fileSystem().(OSFileSystem)
+	return ok
+}
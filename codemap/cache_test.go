@@ -0,0 +1,150 @@
+package codemap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkWithCache checks fileSources with the cache in cacheFilename, saves it, and returns the number
+// of files found in the cache and the problems.
+func checkWithCache(t *testing.T, opts Options, cacheFilename string, fileSources []FileSource) (int, []Problem) {
+	t.Helper()
+
+	cache, err := OpenInventoryCache(cacheFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Cache = cache
+	result, err := Check(opts, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cache.Hits(), result.Problems
+}
+
+func hasProblem(problems []Problem, message string) bool {
+	for _, problem := range problems {
+		if strings.Contains(problem.Message, message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestInventoryCache(t *testing.T) {
+	for _, dir := range []string{".", "sub"} {
+		t.Run(dir, func(t *testing.T) {
+			root := inGitRepo(t, map[string]string{
+				"sub/a.go":   "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+				"sub/doc.md": "See [a<!--" + tagBase + ":tokA-->](a.go#L4).\n",
+			})
+			git(t, "add", "-A")
+			git(t, "commit", "-q", "-m", "files")
+
+			cacheFilename := filepath.Join(root, ".git", CacheFilename)
+
+			err := os.Chdir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefix, err := filepath.Rel(dir, "sub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fileSources := fileSourcesOf(filepath.Join(prefix, "a.go"), filepath.Join(prefix, "doc.md"))
+
+			hits, problems := checkWithCache(t, Options{}, cacheFilename, fileSources)
+			if hits != 0 || len(problems) != 0 {
+				t.Fatalf("first run: got %d hits and problems %+v, want none", hits, problems)
+			}
+
+			hits, _ = checkWithCache(t, Options{}, cacheFilename, fileSources)
+			if hits != 2 {
+				t.Errorf("unchanged files: got %d hits, want 2", hits)
+			}
+
+			// Moving the tag makes the link incorrect, though the file is unchanged in the Git index.
+			replaceInFile(t, filepath.Join(root, "sub", "a.go"), "package a\n", "package a\n\nconst b = 2\n")
+
+			hits, problems = checkWithCache(t, Options{}, cacheFilename, fileSources)
+			if hits != 1 {
+				t.Errorf("modified file: got %d hits, want 1", hits)
+			}
+			if !hasProblem(problems, "incorrect link") {
+				t.Errorf("modified file: got problems %+v, want an incorrect link", problems)
+			}
+
+			// The cache is ignored when it was written with other options.
+			hits, _ = checkWithCache(t, Options{GroupHash: HashSHA256}, cacheFilename, fileSources)
+			if hits != 0 {
+				t.Errorf("other options: got %d hits, want 0", hits)
+			}
+		})
+	}
+}
+
+func TestOpenInventoryCacheInvalid(t *testing.T) {
+	inTempDir(t, map[string]string{"cache": "not a cache"})
+
+	for _, filename := range []string{"cache", "missing"} {
+		cache, err := OpenInventoryCache(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cache.entries) != 0 {
+			t.Errorf("%s: got entries %+v, want none", filename, cache.entries)
+		}
+	}
+}
+
+func TestInventoryCacheGroups(t *testing.T) {
+	root := inGitRepo(t, map[string]string{
+		"a.go": "// [" + tagBase + "-group:grpA:primary]\nconst A = 1\n// [end-" + tagBase + "-group:grpA]\n",
+		"b.go": "// [" + tagBase + "-group:grpA]\nconst B = 1\n// [end-" + tagBase + "-group:grpA]\n",
+	})
+	fileSources := fileSourcesOf("a.go", "b.go")
+
+	_, err := Ack(Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "acked")
+
+	cacheFilename := filepath.Join(root, ".git", CacheFilename)
+	checkWithCache(t, Options{}, cacheFilename, fileSources)
+
+	// The primary attribute is kept in the cache, so changing the primary still changes the group.
+	replaceInFile(t, "a.go", "A = 1", "A = 2")
+	git(t, "commit", "-q", "-a", "-m", "changed")
+
+	cache, err := OpenInventoryCache(cacheFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Check(Options{Cache: cache}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Hits() != 1 {
+		t.Errorf("got %d hits, want 1", cache.Hits())
+	}
+	if len(result.ChangedGroups) != 1 || len(result.ChangedGroups[0].Blocks) != 2 {
+		t.Fatalf("got changed groups %+v, want grpA", result.ChangedGroups)
+	}
+	for _, groupInfo := range result.ChangedGroups[0].Blocks {
+		if !groupInfo.Changed() {
+			t.Errorf("%s: block isn't changed", groupInfo.FileSource.Filename)
+		}
+	}
+}
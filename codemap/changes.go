@@ -0,0 +1,207 @@
+package codemap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChangeSet describes the files changed in a Git diff, to limit a run to them; see Options.Changed.
+type ChangeSet struct {
+	// Filenames are the files that were added or modified. Renamed files are listed by their new names.
+	Filenames []string
+	// RemovedTokens are the tokens of the tags and references on removed lines, including the lines
+	// of deleted files and the old names of renamed files.
+	RemovedTokens []string
+}
+
+// ChangeSetSince returns the changes since rev in the working directory, including untracked files,
+// or in the Git index if fromGitIndex is set.
+func ChangeSetSince(opts Options, rev string, fromGitIndex bool) (*ChangeSet, error) {
+	if fromGitIndex {
+		return gitChangeSet(opts, "--cached", rev)
+	}
+
+	changes, err := gitChangeSet(opts, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("git", "ls-files", "--others", "--exclude-standard", "-z")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git ls-files: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	changes.Filenames = append(changes.Filenames, splitNulDelimited(output)...)
+
+	return changes, nil
+}
+
+// ChangeSetOfDiff returns the changes in a range of commits, such as "main...HEAD" (the changes on HEAD
+// since it branched from main) or "A..B".
+func ChangeSetOfDiff(opts Options, revRange string) (*ChangeSet, error) {
+	if !strings.Contains(revRange, "..") {
+		return nil, fmt.Errorf(`invalid diff range "%s": expected BASE...HEAD or BASE..HEAD`, revRange)
+	}
+
+	return gitChangeSet(opts, revRange)
+}
+
+// gitChangeSet runs git diff with diffArgs to list the changed files and find the tokens on removed lines.
+// Renames are treated as a deletion and an addition, so that the tokens of the old file count as removed.
+func gitChangeSet(opts Options, diffArgs ...string) (*ChangeSet, error) {
+	args := append([]string{"diff", "--relative", "--no-renames", "--name-only", "--diff-filter=d", "-z"}, diffArgs...)
+	cmd := exec.Command("git", append(args, "--")...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git diff: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	changes := &ChangeSet{Filenames: splitNulDelimited(output)}
+
+	args = append([]string{"diff", "--relative", "--no-renames", "--no-color", "--no-ext-diff", "--unified=0"}, diffArgs...)
+	cmd = exec.Command("git", append(args, "--")...)
+	output, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git diff: %w", err)
+	}
+
+	changes.RemovedTokens, err = removedTokens(output, newPatterns(opts.tagBase()).anyTag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read git diff: %w", err)
+	}
+
+	return changes, nil
+}
+
+var hunkHeaderRegexp = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// removedTokens finds the tokens matched by tagRegexp on the removed lines of a patch.
+func removedTokens(patch []byte, tagRegexp *regexp.Regexp) ([]string, error) {
+	var tokens []string
+	seen := map[string]bool{}
+
+	// The lines of the current hunk that are still to come. Outside hunks, lines are headers.
+	removedLeft, addedLeft := 0, 0
+
+	scn := bufio.NewScanner(bytes.NewReader(patch))
+	scn.Buffer(nil, 1024*1024*1024)
+	for scn.Scan() {
+		line := scn.Bytes()
+
+		if removedLeft == 0 && addedLeft == 0 {
+			if m := hunkHeaderRegexp.FindSubmatch(line); m != nil {
+				removedLeft, addedLeft = hunkLineCount(m[1]), hunkLineCount(m[2])
+			}
+			continue
+		}
+
+		switch {
+		case bytes.HasPrefix(line, []byte("-")):
+			removedLeft--
+			for _, m := range tagRegexp.FindAllSubmatch(line, -1) {
+				token := string(m[2])
+				if !seen[token] {
+					seen[token] = true
+					tokens = append(tokens, token)
+				}
+			}
+		case bytes.HasPrefix(line, []byte("+")):
+			addedLeft--
+		}
+	}
+
+	return tokens, scn.Err()
+}
+
+// hunkLineCount parses a line count from a hunk header, which is omitted when it's 1.
+func hunkLineCount(count []byte) int {
+	if count == nil {
+		return 1
+	}
+
+	n, _ := strconv.Atoi(string(count))
+	return n
+}
+
+func splitNulDelimited(output []byte) []string {
+	var filenames []string
+	for _, filenameBytes := range bytes.Split(output, []byte{0}) {
+		if len(filenameBytes) > 0 {
+			filenames = append(filenames, string(filenameBytes))
+		}
+	}
+
+	return filenames
+}
+
+// scope returns the changed files, and the tokens whose references and groups are affected by the
+// changes: those in the changed files, and those on removed lines.
+func (c *ChangeSet) scope(inventory *Inventory) (map[string]struct{}, map[string]struct{}) {
+	changedFiles := make(map[string]struct{})
+	affectedTokens := make(map[string]struct{})
+
+	for _, filename := range c.Filenames {
+		changedFiles[filename] = struct{}{}
+	}
+
+	for _, token := range c.RemovedTokens {
+		affectedTokens[token] = struct{}{}
+	}
+
+	for token, locs := range inventory.SinglesByToken {
+		for _, loc := range locs {
+			if _, ok := changedFiles[loc.Filename]; ok {
+				affectedTokens[token] = struct{}{}
+			}
+		}
+	}
+
+	for token, groupInfos := range inventory.GroupsByToken {
+		for _, groupInfo := range groupInfos {
+			if _, ok := changedFiles[groupInfo.FileSource.Filename]; ok {
+				affectedTokens[token] = struct{}{}
+			}
+		}
+	}
+
+	return changedFiles, affectedTokens
+}
+
+// limitToTokens drops the unused tokens, changed groups and group policy problems that don't
+// involve any of tokens from the result.
+func (r *runner) limitToTokens(tokens map[string]struct{}) {
+	isAffected := func(token string) bool {
+		_, ok := tokens[token]
+		return ok
+	}
+
+	var unusedTokens []UnusedToken
+	for _, unused := range r.result.UnusedTokens {
+		if isAffected(unused.Token) {
+			unusedTokens = append(unusedTokens, unused)
+		}
+	}
+	r.result.UnusedTokens = unusedTokens
+
+	var changedGroups []GroupStatus
+	for _, group := range r.result.ChangedGroups {
+		if isAffected(group.Token) {
+			changedGroups = append(changedGroups, group)
+		}
+	}
+	r.result.ChangedGroups = changedGroups
+
+	var problems []Problem
+	for _, problem := range r.result.Problems {
+		if problem.Kind != ProblemGroupPolicy || isAffected(problem.Token) {
+			problems = append(problems, problem)
+		}
+	}
+	r.result.Problems = problems
+}
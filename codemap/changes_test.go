@@ -0,0 +1,148 @@
+package codemap
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRemovedTokens(t *testing.T) {
+	patch := strings.Join([]string{
+		"diff --git a/a.go b/a.go",
+		"index 1111111..2222222 100644",
+		"--- a/a.go",
+		"+++ b/a.go",
+		"@@ -3 +3 @@ func a() {",
+		"-// [" + tagBase + ":tokA]",
+		"+// [" + tagBase + ":tokAdded]",
+		"@@ -10,3 +10,0 @@",
+		"--- [" + tagBase + "-group:tokSql]",
+		"-// [end-" + tagBase + "-group:tokSql:0123456789ab]",
+		"-// [" + tagBase + ":tokA]",
+		"diff --git a/--- [" + tagBase + ":tokHeader].md b/--- [" + tagBase + ":tokHeader].md",
+		"deleted file mode 100644",
+		"index 3333333..0000000",
+		"--- a/--- [" + tagBase + ":tokHeader].md",
+		"+++ /dev/null",
+		"@@ -1,2 +0,0 @@",
+		"-See [the code<!--" + tagBase + ":repo/tokRef-->](a.go#L3).",
+		"-link:a.go#L3[the code, " + tagBase + "=tokAdoc]",
+		"\\ No newline at end of file",
+		"diff --git a/b.go b/b.go",
+		"index 4444444..5555555 100644",
+		"--- a/b.go",
+		"+++ b/b.go",
+		"@@ -1,0 +2,2 @@",
+		"+++ [" + tagBase + ":tokPlus]",
+		"+// [" + tagBase + ":tokNew]",
+		"@@ -7 +8 @@",
+		"-x := 1",
+		"+x := 2",
+	}, "\n") + "\n"
+
+	tokens, err := removedTokens([]byte(patch), newPatterns(tagBase).anyTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"tokA", "tokSql", "repo/tokRef", "tokAdoc"}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("got %q, want %q", tokens, want)
+	}
+}
+
+// problemsIn returns "kind filename" for each problem, sorted.
+func problemsIn(problems []Problem) []string {
+	var found []string
+	for _, problem := range problems {
+		found = append(found, string(problem.Kind)+" "+problem.Filename)
+	}
+	sort.Strings(found)
+
+	return found
+}
+
+func TestChangeSetSince(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"a.go":    "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+		"b.go":    "package b\n\n// [" + tagBase + ":tokB]\nvar b = 1\n\n// [" + tagBase + ":tokD]\nvar d = 1\n",
+		"docA.md": "See [a<!--" + tagBase + ":tokA-->](a.go#L4).\n",
+		"docB.md": "See [b<!--" + tagBase + ":tokB-->]().\n",
+	})
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "base")
+
+	replaceInFile(t, "a.go", "package a\n", "package a\n\nconst a0 = 0\n")
+	writeFiles(t, map[string]string{"c.go": "package c\n\n// [" + tagBase + ":tokC]\nvar c = 1\n"})
+
+	changes, err := ChangeSetSince(Options{}, "HEAD", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.go", "c.go"}; !reflect.DeepEqual(changes.Filenames, want) {
+		t.Errorf("got files %v, want %v", changes.Filenames, want)
+	}
+
+	// The problems in docB.md and the unused token in b.go have nothing to do with the changes.
+	result, err := Check(Options{Changed: changes}, fileSourcesOf("a.go", "b.go", "c.go", "docA.md", "docB.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := problemsIn(result.Problems), []string{"incorrect-link docA.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems %v, want %v", got, want)
+	}
+	if len(result.UnusedTokens) != 1 || result.UnusedTokens[0].Token != "tokC" {
+		t.Errorf("got unused tokens %+v, want tokC", result.UnusedTokens)
+	}
+
+	// Only what's in the Git index.
+	git(t, "add", "c.go")
+	changes, err = ChangeSetSince(Options{}, "HEAD", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c.go"}; !reflect.DeepEqual(changes.Filenames, want) {
+		t.Errorf("index: got files %v, want %v", changes.Filenames, want)
+	}
+}
+
+func TestChangeSetOfDiff(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"a.go":    "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+		"e.go":    "package e\n\n// [" + tagBase + ":tokE]\nvar e = 1\n",
+		"docA.md": "See [a<!--" + tagBase + ":tokA-->]().\n",
+		"docE.md": "See [e<!--" + tagBase + ":tokE-->](e.go#L4).\n",
+	})
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "base")
+	git(t, "rm", "-q", "e.go")
+	git(t, "commit", "-q", "-m", "remove e.go")
+
+	changes, err := ChangeSetOfDiff(Options{}, "HEAD~1..HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Filenames) != 0 || !reflect.DeepEqual(changes.RemovedTokens, []string{"tokE"}) {
+		t.Errorf("got %+v, want tokE removed", changes)
+	}
+
+	// The references to removed tokens are checked, though their files didn't change.
+	result, err := Check(Options{Changed: changes}, fileSourcesOf("a.go", "docA.md", "docE.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := problemsIn(result.Problems), []string{"token-not-found docE.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems %v, want %v", got, want)
+	}
+
+	_, err = ChangeSetOfDiff(Options{}, "HEAD")
+	if err == nil || !strings.Contains(err.Error(), "invalid diff range") {
+		t.Errorf("got %v, want an invalid diff range", err)
+	}
+
+	_, err = NewSession(Options{Changed: changes}, ModeAck)
+	if err == nil {
+		t.Error("ack limited to changes: got no error")
+	}
+}
@@ -0,0 +1,291 @@
+// Package codemap maintains links from Markdown files to tagged lines of code,
+// and keeps tagged groups of code blocks in sync with each other.
+//
+// The eyecue-codemap command is a thin CLI over this package.
+package codemap
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const DefaultTagBase = "eyecue-codemap"
+
+type Mode int
+
+func (m Mode) String() string {
+	switch m {
+	case ModeCheck:
+		return "check"
+	case ModeUpdate:
+		return "update"
+	case ModeAck:
+		return "ack"
+	case ModeMigrateHashes:
+		return "migrate-hashes"
+	}
+
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+const (
+	// ModeCheck reports problems without modifying any files.
+	ModeCheck Mode = iota
+	// ModeUpdate assigns tokens to new tags and rewrites Markdown links and group templates.
+	ModeUpdate
+	// ModeAck does everything ModeUpdate does, and also acknowledges changed group blocks.
+	ModeAck
+	// ModeMigrateHashes does everything ModeUpdate does, and also rewrites the hashes of unchanged
+	// group blocks in the Options.GroupHash format. Changed blocks are left alone, because their
+	// hashes can't be verified.
+	ModeMigrateHashes
+)
+
+type Options struct {
+	// FileSystem is used to read and write files. Defaults to OSFileSystem.
+	FileSystem FileSystem
+	// TagBase is the tag name used in code and Markdown. Defaults to DefaultTagBase.
+	TagBase string
+	// LinkStyle decides how links to code are written. Defaults to relative links.
+	LinkStyle LinkStyle
+	// Include limits the files inventoried to those matching these .gitignore-style patterns
+	// (see PatternList). Empty means all files.
+	Include []string
+	// Exclude skips files matching these .gitignore-style patterns, in addition to DefaultExclude.
+	Exclude []string
+	// MaxFileSize skips files of this many bytes or more. Defaults to DefaultMaxFileSize.
+	MaxFileSize int64
+	// MarkdownExtensions are the extensions of the Markdown files whose links are checked and updated. Defaults to ".md".
+	MarkdownExtensions []string
+	// DocFormats overrides or extends the built-in DocFormats, keyed by lowercase extension. A nil format
+	// means files with the extension aren't documentation.
+	DocFormats map[string]DocFormat
+	// CommentSyntaxes overrides or extends the built-in CommentSyntaxes, keyed by extension or file name.
+	CommentSyntaxes map[string]CommentSyntax
+	// GroupNormalize are the normalizations of group blocks whose end tags don't specify any.
+	// Blocks acked without normalizations are checked without them until they change.
+	GroupNormalize []Normalization
+	// GroupHash is the hash format for blocks that haven't been acked yet, and the target of
+	// ModeMigrateHashes. Acked blocks keep their format. Defaults to DefaultHashFormat.
+	GroupHash HashFormat
+	// GroupPolicies are the policies of groups, by token, in addition to the attributes on their start tags.
+	GroupPolicies map[string]GroupPolicy
+	// Repositories are the submodules and external repositories whose files are linked to. The files of
+	// submodules must be among the file sources (see Repository.ReadFilenames). The files of external
+	// repositories are listed and inventoried by the run, and only their single tags can be referenced.
+	Repositories []Repository
+	// AckOnly limits ModeAck to the blocks of the groups with these tokens, and the innermost block containing
+	// each of these "FILE:LINE" locations. Empty means every block. A selector that matches no block, or a
+	// location in overlapping blocks that has no innermost one, is an error.
+	AckOnly []string
+	// Cache, if set, is used to skip the files that haven't changed since they were last inventoried.
+	// It's only used with the OSFileSystem, and not by Session.Refresh.
+	Cache *InventoryCache
+	// Changed, if set, limits ModeCheck and ModeUpdate to some changes: only the Markdown files that
+	// changed or refer to tokens in the changes are processed, and only the groups with those tokens
+	// are checked. Tokens are still found in every file, so that references to them can be resolved.
+	Changed *ChangeSet
+	// ConfirmAck, if set, is asked before each changed block is acknowledged by ModeAck. It's given
+	// the block and every block of its group.
+	ConfirmAck func(groupInfo TokenGroupInfo, group []TokenGroupInfo) (bool, error)
+	// Logf receives verbose progress messages. May be nil.
+	Logf func(format string, args ...interface{})
+}
+
+func (o Options) fileSystem() FileSystem {
+	if o.FileSystem == nil {
+		return OSFileSystem{}
+	}
+
+	return o.FileSystem
+}
+
+func (o Options) tagBase() string {
+	if o.TagBase == "" {
+		return DefaultTagBase
+	}
+
+	return o.TagBase
+}
+
+func (o Options) maxFileSize() int64 {
+	if o.MaxFileSize == 0 {
+		return DefaultMaxFileSize
+	}
+
+	return o.MaxFileSize
+}
+
+func (o Options) isMarkdownFile(filename string) bool {
+	if len(o.MarkdownExtensions) == 0 {
+		return strings.EqualFold(filepath.Ext(filename), ".md")
+	}
+
+	for _, ext := range o.MarkdownExtensions {
+		if strings.EqualFold(filepath.Ext(filename), ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o Options) logf(format string, args ...interface{}) {
+	if o.Logf != nil {
+		o.Logf(format, args...)
+	}
+}
+
+// Check reports problems with links, tokens and groups without writing any files.
+func Check(opts Options, fileSources []FileSource) (*Result, error) {
+	return Run(opts, ModeCheck, fileSources)
+}
+
+// Update assigns tokens to new tags and brings Markdown links and group templates up-to-date.
+func Update(opts Options, fileSources []FileSource) (*Result, error) {
+	return Run(opts, ModeUpdate, fileSources)
+}
+
+// Ack performs an Update, and records the current hash of every changed group block.
+func Ack(opts Options, fileSources []FileSource) (*Result, error) {
+	return Run(opts, ModeAck, fileSources)
+}
+
+// MigrateHashes performs an Update, and rewrites the hash of every unchanged group block in the Options.GroupHash format.
+func MigrateHashes(opts Options, fileSources []FileSource) (*Result, error) {
+	return Run(opts, ModeMigrateHashes, fileSources)
+}
+
+// Run inventories fileSources and then checks or updates them according to mode.
+// The returned error is only for failures that prevented the run from completing;
+// problems found in the files are reported in the Result.
+func Run(opts Options, mode Mode, fileSources []FileSource) (*Result, error) {
+	session, err := NewSession(opts, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return session.Load(fileSources)
+}
+
+type runner struct {
+	opts     Options
+	mode     Mode
+	fs       FileSystem
+	patterns *patterns
+	linker   *linker
+	result   *Result
+	mu       sync.Mutex
+	// prefix is the path of the working directory from the project root; see ProjectPrefix.
+	prefix string
+	// newGroupTokens are the group tokens generated by this run.
+	newGroupTokens map[string]struct{}
+}
+
+// checkTokens reports duplicate tokens. Links can't be resolved while a token is ambiguous,
+// so Markdown files must not be processed unless it returns true.
+func (r *runner) checkTokens(inventory *Inventory) (bool, error) {
+	// Prohibit tokens from being used in both groups and single-line locations.
+	for token := range inventory.SinglesByToken {
+		if _, ok := inventory.GroupsByToken[token]; ok {
+			return false, fmt.Errorf("cannot use same token for group and single-line: %s", token)
+		}
+	}
+
+	ok := true
+
+	for _, token := range inventory.sortedSingleTokens() {
+		tokenLocs := inventory.SinglesByToken[token]
+		if len(tokenLocs) > 1 {
+			msg := fmt.Sprintf("duplicate token \"%s\" at:", token)
+			var related []Location
+			for _, tokenLoc := range tokenLocs {
+				msg = fmt.Sprintf("%s\n   %s:%d", msg, tokenLoc.Filename, tokenLoc.LineNum)
+				related = append(related, Location{
+					Filename: tokenLoc.Filename,
+					Line:     tokenLoc.LineNum,
+					Column:   tokenLoc.Column,
+				})
+			}
+			r.addProblem(Problem{
+				Kind:     ProblemDuplicateToken,
+				Filename: tokenLocs[0].Filename,
+				Line:     tokenLocs[0].LineNum,
+				Column:   tokenLocs[0].Column,
+				Token:    token,
+				Message:  msg,
+				Related:  related,
+			})
+			ok = false
+		}
+	}
+
+	return ok, nil
+}
+
+// findUnusedTokens reports the single-line tokens that none of references refer to.
+func (r *runner) findUnusedTokens(inventory *Inventory, references []Reference) {
+	usedTokens := make(map[string]struct{})
+	for _, reference := range references {
+		usedTokens[reference.Token] = struct{}{}
+	}
+
+	for _, token := range inventory.sortedSingleTokens() {
+		if _, ok := usedTokens[token]; !ok {
+			r.result.UnusedTokens = append(r.result.UnusedTokens, UnusedToken{
+				Token:         token,
+				TokenLocation: inventory.SinglesByToken[token][0],
+			})
+		}
+	}
+}
+
+func (r *runner) processTokenGroups(inventory *Inventory) error {
+	r.applyGroupPolicies(inventory)
+
+	err := r.ackNewGroups(inventory)
+	if err != nil {
+		return err
+	}
+
+	switch r.mode {
+	case ModeAck:
+		err = r.ackTokenGroups(inventory)
+	case ModeMigrateHashes:
+		err = r.migrateGroupHashes(inventory)
+	default:
+		r.checkTokenGroups(inventory)
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.checkIdenticalBlocks(inventory)
+}
+
+func (r *runner) writeFile(filename string, data []byte) error {
+	err := r.fs.WriteFile(filename, data)
+	if err != nil {
+		return fmt.Errorf(`failed to write "%s": %w`, filename, err)
+	}
+
+	r.mu.Lock()
+	r.result.FilesWritten = append(r.result.FilesWritten, filename)
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *runner) readFile(fileSource FileSource) ([]byte, error) {
+	if revisionFS, ok := r.fs.(*GitRevisionFileSystem); ok {
+		r.opts.logf("git %s: reading \"%s\"\n", revisionFS.Revision, fileSource.Filename)
+	} else if fileSource.FromGitIndex {
+		r.opts.logf("git index: reading \"%s\"\n", fileSource.Filename)
+	} else {
+		r.opts.logf("working dir: reading \"%s\"\n", fileSource.Filename)
+	}
+
+	return r.fs.ReadFile(fileSource)
+}
@@ -0,0 +1,229 @@
+package codemap
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+// BlockComment is a pair of block comment delimiters, e.g. "/*" and "*/".
+type BlockComment struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+// CommentSyntax describes how comments are written in a language. It decides
+// whether a tag is alone on its line (and so refers to the next line), and
+// which lines may precede a tag that links to the whole file. The markers of
+// DefaultCommentSyntax are accepted in every language too (see universalComments).
+type CommentSyntax struct {
+	// Line comment markers, e.g. "//"
+	Line []string `yaml:"line"`
+	// Block comment delimiters, e.g. "/*" and "*/"
+	Block []BlockComment `yaml:"block"`
+	// Preamble lists prefixes of lines that may come before a tag at the top of the file,
+	// in addition to blank lines, e.g. "#!" for a shebang.
+	Preamble []string `yaml:"preamble"`
+}
+
+// DefaultCommentSyntax is used for files whose language isn't in CommentSyntaxes: the universal comments.
+var DefaultCommentSyntax = universalComments
+
+// universalComments are accepted in every file, besides its language's comments, because every file
+// accepted them before comment syntax depended on the language. Without them, a tag alone on a line
+// in one of these comments would start linking to its own line instead of the next one.
+var universalComments = CommentSyntax{
+	Line:     []string{"//", "#"},
+	Block:    []BlockComment{{"<!--", "-->"}},
+	Preamble: []string{"#!"},
+}
+
+var (
+	slashComments = CommentSyntax{
+		Line:  []string{"//"},
+		Block: []BlockComment{{"/*", "*/"}},
+	}
+	hashComments = CommentSyntax{
+		Line:     []string{"#"},
+		Preamble: []string{"#!"},
+	}
+	htmlComments = CommentSyntax{
+		Block:    []BlockComment{{"<!--", "-->"}},
+		Preamble: []string{"<?xml", "<!DOCTYPE", "<!doctype"},
+	}
+)
+
+// CommentSyntaxes maps file extensions (with the leading ".") and file names to their comment syntax.
+var CommentSyntaxes = map[string]CommentSyntax{
+	// C-like
+	".c":     slashComments,
+	".cc":    slashComments,
+	".cpp":   slashComments,
+	".cs":    slashComments,
+	".dart":  slashComments,
+	".go":    {Line: []string{"//"}, Block: []BlockComment{{"/*", "*/"}}, Preamble: []string{"//go:build", "// +build"}},
+	".h":     slashComments,
+	".hpp":   slashComments,
+	".java":  slashComments,
+	".js":    {Line: []string{"//"}, Block: []BlockComment{{"/*", "*/"}}, Preamble: []string{"#!"}},
+	".jsx":   slashComments,
+	".kt":    slashComments,
+	".kts":   slashComments,
+	".less":  slashComments,
+	".m":     slashComments,
+	".mjs":   {Line: []string{"//"}, Block: []BlockComment{{"/*", "*/"}}, Preamble: []string{"#!"}},
+	".proto": slashComments,
+	".rs":    slashComments,
+	".scala": slashComments,
+	".scss":  slashComments,
+	".swift": slashComments,
+	".ts":    {Line: []string{"//"}, Block: []BlockComment{{"/*", "*/"}}, Preamble: []string{"#!"}},
+	".tsx":   slashComments,
+	".css":   {Block: []BlockComment{{"/*", "*/"}}},
+	".php":   {Line: []string{"//", "#"}, Block: []BlockComment{{"/*", "*/"}}, Preamble: []string{"#!", "<?php"}},
+
+	// Hash
+	".bash":      hashComments,
+	".conf":      hashComments,
+	".mk":        hashComments,
+	".pl":        hashComments,
+	".ps1":       hashComments,
+	".py":        {Line: []string{"#"}, Preamble: []string{"#!", "# -*-"}},
+	".r":         hashComments,
+	".rb":        {Line: []string{"#"}, Preamble: []string{"#!", "# frozen_string_literal:"}},
+	".sh":        hashComments,
+	".tf":        {Line: []string{"#", "//"}, Block: []BlockComment{{"/*", "*/"}}},
+	".toml":      hashComments,
+	".yaml":      {Line: []string{"#"}, Preamble: []string{"---"}},
+	".yml":       {Line: []string{"#"}, Preamble: []string{"---"}},
+	".zsh":       hashComments,
+	"Dockerfile": {Line: []string{"#"}, Preamble: []string{"# syntax="}},
+	"Makefile":   hashComments,
+
+	// Double dash
+	".elm": {Line: []string{"--"}, Block: []BlockComment{{"{-", "-}"}}},
+	".hs":  {Line: []string{"--"}, Block: []BlockComment{{"{-", "-}"}}},
+	".lua": {Line: []string{"--"}, Preamble: []string{"#!"}},
+	".sql": {Line: []string{"--"}, Block: []BlockComment{{"/*", "*/"}}},
+
+	// Semicolon
+	".asm":  {Line: []string{";"}},
+	".clj":  {Line: []string{";", ";;"}},
+	".el":   {Line: []string{";", ";;", ";;;"}},
+	".ini":  {Line: []string{";", "#"}},
+	".lisp": {Line: []string{";", ";;", ";;;"}},
+	".scm":  {Line: []string{";", ";;"}},
+
+	// Percent
+	".erl": {Line: []string{"%", "%%"}},
+	".sty": {Line: []string{"%"}},
+	".tex": {Line: []string{"%"}},
+
+	// Markup
+	".htm":      htmlComments,
+	".html":     htmlComments,
+	".markdown": htmlComments,
+	".md":       htmlComments,
+	".mdx":      {Block: []BlockComment{{"<!--", "-->"}, {"{/*", "*/}"}}},
+	".svg":      htmlComments,
+	".vue":      {Line: []string{"//"}, Block: []BlockComment{{"<!--", "-->"}, {"/*", "*/"}}},
+	".xml":      htmlComments,
+
+	// Go templates
+	".gotmpl": {Block: []BlockComment{{"{{/*", "*/}}"}, {"{{- /*", "*/ -}}"}, {"{{- /*", "*/}}"}, {"{{/*", "*/ -}}"}}},
+	".tmpl":   {Block: []BlockComment{{"{{/*", "*/}}"}, {"{{- /*", "*/ -}}"}, {"{{- /*", "*/}}"}, {"{{/*", "*/ -}}"}}},
+}
+
+// commentSyntaxKeys returns the keys filename may be registered under, most specific first.
+func commentSyntaxKeys(filename string) []string {
+	base := filepath.Base(filename)
+	return []string{base, strings.ToLower(filepath.Ext(base))}
+}
+
+// commentSyntax returns the comment syntax for filename, preferring Options.CommentSyntaxes.
+func (o Options) commentSyntax(filename string) CommentSyntax {
+	for _, key := range commentSyntaxKeys(filename) {
+		if syntax, ok := o.CommentSyntaxes[key]; ok {
+			return syntax
+		}
+	}
+
+	for _, key := range commentSyntaxKeys(filename) {
+		if syntax, ok := CommentSyntaxes[key]; ok {
+			return syntax
+		}
+	}
+
+	return DefaultCommentSyntax
+}
+
+// isCommentOnly reports whether a tag is the only thing on its line, other than the comment
+// markers in before and after (which have been trimmed).
+func (c CommentSyntax) isCommentOnly(before string, after string) bool {
+	return c.hasCommentOnly(before, after) || universalComments.hasCommentOnly(before, after)
+}
+
+func (c CommentSyntax) hasCommentOnly(before string, after string) bool {
+	if after == "" {
+		for _, marker := range c.Line {
+			if before == marker {
+				return true
+			}
+		}
+	}
+
+	for _, block := range c.Block {
+		if before == block.Start && after == block.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPreamble reports whether line may come before a tag that links to the whole file.
+func (c CommentSyntax) isPreamble(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		return true
+	}
+
+	for _, preamble := range [][]string{c.Preamble, universalComments.Preamble} {
+		for _, prefix := range preamble {
+			if strings.HasPrefix(line, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c CommentSyntax) validate() error {
+	for _, marker := range c.Line {
+		if strings.TrimSpace(marker) == "" {
+			return errors.New("line comment markers must not be blank")
+		}
+	}
+
+	for _, block := range c.Block {
+		if strings.TrimSpace(block.Start) == "" || strings.TrimSpace(block.End) == "" {
+			return errors.New("block comments must have a start and an end")
+		}
+	}
+
+	for _, prefix := range c.Preamble {
+		if prefix == "" {
+			return errors.New("preamble prefixes must not be empty")
+		}
+	}
+
+	return nil
+}
+
+func validateCommentSyntaxKey(key string) error {
+	if key == "" || strings.ContainsAny(key, `/\`) {
+		return errors.New(`must be an extension (like ".sql") or a file name (like "Dockerfile")`)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package codemap
+
+import "testing"
+
+func TestIsCommentOnly(t *testing.T) {
+	tests := []struct {
+		filename string
+		before   string
+		after    string
+		want     bool
+	}{
+		{"a.go", "//", "", true},
+		{"a.go", "/*", "*/", true},
+		{"a.go", "x := 1 //", "", false},
+		// Every file accepts the markers that were accepted before comment syntax depended on the language.
+		{"a.go", "#", "", true},
+		{"a.js", "<!--", "-->", true},
+		{"a.py", "//", "", true},
+		{"a.sql", "--", "", true},
+		{"a.sql", "#", "", true},
+		{"a.sql", "--", "-->", false},
+		{"unknown.xyz", "#", "", true},
+		{"unknown.xyz", "--", "", false},
+	}
+
+	for _, tt := range tests {
+		got := Options{}.commentSyntax(tt.filename).isCommentOnly(tt.before, tt.after)
+		if got != tt.want {
+			t.Errorf("%s: isCommentOnly(%q, %q) = %v, want %v", tt.filename, tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestTagLineInAnotherLanguagesComment(t *testing.T) {
+	inTempDir(t, map[string]string{
+		"a.go": "package a\n\n# [" + tagBase + ":tokHash]\nvar x = 1\n\n<!-- [" + tagBase + ":tokHtml] -->\nvar y = 2\n",
+	})
+
+	inventory, err := BuildInventory(Options{}, fileSourcesOf("a.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, want := range map[string]int{"tokHash": 4, "tokHtml": 7} {
+		locs := inventory.SinglesByToken[token]
+		if len(locs) != 1 || locs[0].LineNum != want {
+			t.Errorf("%s: got %+v, want line %d", token, locs, want)
+		}
+	}
+}
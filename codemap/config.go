@@ -0,0 +1,325 @@
+package codemap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFilenames are the names of the project configuration file, in order of preference.
+var ConfigFilenames = []string{".codemap.yaml", ".codemap.yml"}
+
+// ProjectConfig is the contents of a project configuration file.
+type ProjectConfig struct {
+	TagBase            string    `yaml:"tag-base"`
+	Include            []string  `yaml:"include"`
+	Exclude            []string  `yaml:"exclude"`
+	MaxFileSize        ByteSize  `yaml:"max-file-size"`
+	MarkdownExtensions []string  `yaml:"markdown-extensions"`
+	LinkStyle          LinkStyle `yaml:"link-style"`
+	// DocFormats sets the format of documentation files by extension (".txt": asciidoc), or turns it off ("none").
+	DocFormats map[string]string `yaml:"doc-formats"`
+	// Comments overrides the comment syntax of languages, keyed by extension (".sql") or file name ("Dockerfile").
+	Comments map[string]CommentSyntax `yaml:"comments"`
+	// GroupNormalize are the normalizations of group blocks whose end tags don't specify any.
+	GroupNormalize []string `yaml:"group-normalize"`
+	// GroupHash is the hash format for new group blocks, and the target of migrate-hashes.
+	GroupHash HashFormat `yaml:"group-hash"`
+	// GroupPolicies are the policies of groups, by token.
+	GroupPolicies map[string]GroupPolicy `yaml:"group-policies"`
+	// NoUnused makes unused tokens an error.
+	NoUnused bool `yaml:"no-unused"`
+	// Submodules lists the files of checked-out submodules with the project's.
+	Submodules bool `yaml:"submodules"`
+	// Repositories are external repositories whose tokens can be referenced with their name as a namespace.
+	Repositories map[string]RepositoryConfig `yaml:"repositories"`
+}
+
+// ByteSize is a number of bytes. In YAML it may be written as a plain number, or with a unit such as 512KiB or 10MB.
+type ByteSize int64
+
+var byteSizeRegexp = regexp.MustCompile(`^(\d+)\s*([KMG]i?B|B)?$`)
+
+var byteSizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"KiB": 1024,
+	"MiB": 1024 * 1024,
+	"GiB": 1024 * 1024 * 1024,
+}
+
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	m := byteSizeRegexp.FindStringSubmatch(strings.TrimSpace(node.Value))
+	if m == nil {
+		return fmt.Errorf("line %d: invalid size %q (expected a number of bytes, e.g. 1048576 or 1MiB)", node.Line, node.Value)
+	}
+
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid size %q: %w", node.Line, node.Value, err)
+	}
+
+	unit := byteSizeUnits[m[2]]
+	if n > math.MaxInt64/unit {
+		return fmt.Errorf("line %d: invalid size %q: too large", node.Line, node.Value)
+	}
+
+	*b = ByteSize(n * unit)
+	return nil
+}
+
+// ProjectRoot returns the root of the Git repository containing the working
+// directory, or the working directory itself outside of a repository.
+func ProjectRoot() string {
+	dir, err := gitOutput("rev-parse", "--show-toplevel")
+	if err != nil {
+		return "."
+	}
+
+	return dir
+}
+
+// ProjectPrefix returns the path of the working directory from ProjectRoot, with a trailing "/",
+// or "" at the root or outside of a Git repository.
+func ProjectPrefix() string {
+	prefix, err := gitOutput("rev-parse", "--show-prefix")
+	if err != nil {
+		return ""
+	}
+
+	return prefix
+}
+
+// workingDirPath converts a slash-separated path from the project root to a filename relative to the
+// working directory, whose path from the root is prefix (see ProjectPrefix).
+func workingDirPath(prefix string, rootPath string) string {
+	if strings.HasPrefix(rootPath, prefix) {
+		return filepath.FromSlash(rootPath[len(prefix):])
+	}
+
+	return filepath.Join(strings.Repeat("../", strings.Count(prefix, "/")), filepath.FromSlash(rootPath))
+}
+
+// FindProjectConfig returns the path of the configuration file in ProjectRoot.
+// It returns "" if there is no configuration file.
+func FindProjectConfig() (string, error) {
+	dir := ProjectRoot()
+
+	for _, name := range ConfigFilenames {
+		filename := filepath.Join(dir, name)
+		_, err := os.Stat(filename)
+		if err == nil {
+			return filename, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// LoadProjectConfig reads and validates a configuration file.
+func LoadProjectConfig(filename string) (*ProjectConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseProjectConfig(filename, data)
+}
+
+// ParseProjectConfig validates the contents of a configuration file that was read from filename,
+// e.g. from a Git revision.
+func ParseProjectConfig(filename string, data []byte) (*ProjectConfig, error) {
+	var config ProjectConfig
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	return &config, nil
+}
+
+var tagBaseRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+func (c *ProjectConfig) validate() error {
+	if c.TagBase != "" && !tagBaseRegexp.MatchString(c.TagBase) {
+		return fmt.Errorf("tag-base: %q must contain only letters, digits, '-' and '_'", c.TagBase)
+	}
+
+	_, err := NewPatternList(c.Include)
+	if err != nil {
+		return fmt.Errorf("include: %w", err)
+	}
+
+	_, err = NewPatternList(c.Exclude)
+	if err != nil {
+		return fmt.Errorf("exclude: %w", err)
+	}
+
+	if c.MaxFileSize < 0 {
+		return errors.New("max-file-size: must not be negative")
+	}
+
+	for _, ext := range c.MarkdownExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("markdown-extensions: %q must start with '.'", ext)
+		}
+	}
+
+	_, err = docFormatsFromConfig(c.DocFormats)
+	if err != nil {
+		return fmt.Errorf("doc-formats: %w", err)
+	}
+
+	err = c.LinkStyle.validate()
+	if err != nil {
+		return fmt.Errorf("link-style: %w", err)
+	}
+
+	_, err = validNormalizations(c.GroupNormalize)
+	if err != nil {
+		return fmt.Errorf("group-normalize: %w", err)
+	}
+
+	if c.GroupHash != "" && !c.GroupHash.valid() {
+		return fmt.Errorf("group-hash: %q must be one of %s", c.GroupHash, hashFormatNames())
+	}
+
+	for token, policy := range c.GroupPolicies {
+		err = policy.validate()
+		if err != nil {
+			return fmt.Errorf("group-policies: %q: %w", token, err)
+		}
+	}
+
+	for name, repoConfig := range c.Repositories {
+		if !repositoryNameRegexp.MatchString(name) {
+			return fmt.Errorf("repositories: %q must contain only letters, digits, '-', '_' and '.'", name)
+		}
+
+		err = repoConfig.validate()
+		if err != nil {
+			return fmt.Errorf("repositories: %q: %w", name, err)
+		}
+	}
+
+	for key, syntax := range c.Comments {
+		err = validateCommentSyntaxKey(key)
+		if err == nil {
+			err = syntax.validate()
+		}
+		if err != nil {
+			return fmt.Errorf("comments: %q: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// ApplyTo copies the settings from the configuration file into opts, except where opts already has a value.
+func (c *ProjectConfig) ApplyTo(opts *Options) {
+	if opts.TagBase == "" {
+		opts.TagBase = c.TagBase
+	}
+
+	if len(opts.Include) == 0 {
+		opts.Include = c.Include
+	}
+
+	if len(opts.Exclude) == 0 {
+		opts.Exclude = c.Exclude
+	}
+
+	if opts.MaxFileSize == 0 {
+		opts.MaxFileSize = int64(c.MaxFileSize)
+	}
+
+	if len(opts.MarkdownExtensions) == 0 {
+		opts.MarkdownExtensions = c.MarkdownExtensions
+	}
+
+	// Already validated
+	docFormats, _ := docFormatsFromConfig(c.DocFormats)
+	for ext, format := range docFormats {
+		if _, ok := opts.DocFormats[ext]; ok {
+			continue
+		}
+		if opts.DocFormats == nil {
+			opts.DocFormats = make(map[string]DocFormat)
+		}
+		opts.DocFormats[ext] = format
+	}
+
+	if opts.GroupHash == "" {
+		opts.GroupHash = c.GroupHash
+	}
+
+	if len(opts.GroupNormalize) == 0 {
+		// Already validated
+		opts.GroupNormalize, _ = validNormalizations(c.GroupNormalize)
+	}
+
+	for token, policy := range c.GroupPolicies {
+		if _, ok := opts.GroupPolicies[token]; ok {
+			continue
+		}
+		if opts.GroupPolicies == nil {
+			opts.GroupPolicies = make(map[string]GroupPolicy)
+		}
+		opts.GroupPolicies[token] = policy
+	}
+
+	for key, syntax := range c.Comments {
+		if _, ok := opts.CommentSyntaxes[key]; ok {
+			continue
+		}
+		if opts.CommentSyntaxes == nil {
+			opts.CommentSyntaxes = make(map[string]CommentSyntax)
+		}
+		opts.CommentSyntaxes[key] = syntax
+	}
+
+	for _, repo := range c.repositories() {
+		if !hasRepository(opts.Repositories, repo.Name) {
+			opts.Repositories = append(opts.Repositories, repo)
+		}
+	}
+
+	if opts.LinkStyle.Kind == "" {
+		opts.LinkStyle.Kind = c.LinkStyle.Kind
+	}
+	if opts.LinkStyle.RepoURL == "" {
+		opts.LinkStyle.RepoURL = c.LinkStyle.RepoURL
+	}
+	if opts.LinkStyle.Ref == "" {
+		opts.LinkStyle.Ref = c.LinkStyle.Ref
+	}
+	if !opts.LinkStyle.Pin {
+		opts.LinkStyle.Pin = c.LinkStyle.Pin
+	}
+	if opts.LinkStyle.Template == "" {
+		opts.LinkStyle.Template = c.LinkStyle.Template
+	}
+}
@@ -0,0 +1,138 @@
+package codemap
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestByteSizeUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want ByteSize
+	}{
+		{"0", 0},
+		{"1048576", 1048576},
+		{"100B", 100},
+		{"512KiB", 512 * 1024},
+		{"512KB", 512 * 1000},
+		{"10 MB", 10 * 1000 * 1000},
+		{"10MiB", 10 * 1024 * 1024},
+		{"2GiB", 2 * 1024 * 1024 * 1024},
+		{`"1GB"`, 1000 * 1000 * 1000},
+	}
+
+	for _, tt := range tests {
+		var size ByteSize
+		err := yaml.Unmarshal([]byte(tt.yaml), &size)
+		if err != nil {
+			t.Errorf("%s: %v", tt.yaml, err)
+			continue
+		}
+		if size != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.yaml, size, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"-1", "1.5MB", "10mb", "10 KiBs", "MB", "ten", "99999999999999999999", "9999999999GiB"} {
+		var size ByteSize
+		err := yaml.Unmarshal([]byte(invalid), &size)
+		if err == nil {
+			t.Errorf("%s: expected an error, got %d", invalid, size)
+		}
+	}
+}
+
+func TestParseProjectConfig(t *testing.T) {
+	config, err := ParseProjectConfig(".codemap.yaml", []byte(`
+tag-base: my-map
+exclude: ["vendor/"]
+max-file-size: 1MiB
+markdown-extensions: [".md", ".markdown"]
+group-hash: sha256
+group-policies:
+  grpA:
+    primary: src/a.go
+no-unused: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.TagBase != "my-map" || config.MaxFileSize != 1024*1024 || config.GroupHash != HashSHA256 || !config.NoUnused ||
+		len(config.Exclude) != 1 || len(config.MarkdownExtensions) != 2 || config.GroupPolicies["grpA"].Primary != "src/a.go" {
+		t.Errorf("got %+v", config)
+	}
+
+	// An empty file is an empty configuration.
+	_, err = ParseProjectConfig(".codemap.yaml", nil)
+	if err != nil {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+func TestParseProjectConfigInvalid(t *testing.T) {
+	tests := map[string]string{
+		"tag-bsae: x\n":                               "field tag-bsae not found",
+		"tag-base: \"my map\"\n":                      "tag-base:",
+		"markdown-extensions: [md]\n":                 "markdown-extensions:",
+		"group-hash: md5\n":                           "group-hash:",
+		"group-normalize: [tabs]\n":                   "group-normalize:",
+		"max-file-size: 1TB\n":                        `invalid size "1TB"`,
+		"doc-formats: {\".txt\": word}\n":             "doc-formats:",
+		"exclude: [\"a[\"]\n":                         "exclude:",
+		"group-policies: {g: {substitute: {a: b}}}\n": "substitute requires identical",
+	}
+
+	for data, want := range tests {
+		_, err := ParseProjectConfig(".codemap.yaml", []byte(data))
+		if err == nil || !strings.Contains(err.Error(), ".codemap.yaml") || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", data, err, want)
+		}
+	}
+}
+
+func TestProjectConfigApplyTo(t *testing.T) {
+	config := &ProjectConfig{
+		TagBase:       "from-config",
+		Exclude:       []string{"vendor/"},
+		GroupHash:     HashSHA256,
+		GroupPolicies: map[string]GroupPolicy{"grpA": {Identical: true}, "grpB": {Identical: true}},
+	}
+
+	// Options that are already set take precedence.
+	opts := Options{
+		TagBase:       "from-flag",
+		GroupPolicies: map[string]GroupPolicy{"grpA": {Primary: "a.go"}},
+	}
+	config.ApplyTo(&opts)
+
+	if opts.TagBase != "from-flag" || len(opts.Exclude) != 1 || opts.GroupHash != HashSHA256 {
+		t.Errorf("got %+v", opts)
+	}
+	if opts.GroupPolicies["grpA"].Identical || !opts.GroupPolicies["grpB"].Identical {
+		t.Errorf("got policies %+v", opts.GroupPolicies)
+	}
+}
+
+func TestFindProjectConfig(t *testing.T) {
+	root := inGitRepo(t, map[string]string{
+		".codemap.yml": "",
+		"sub/a.go":     "package a\n",
+	})
+	inSubdirectory(t, "sub")
+
+	// The configuration is at the root of the repo.
+	filename, err := FindProjectConfig()
+	if err != nil || filename != filepath.Join(root, ".codemap.yml") {
+		t.Errorf("got %q, %v, want .codemap.yml", filename, err)
+	}
+
+	writeFiles(t, map[string]string{filepath.Join(root, ".codemap.yaml"): ""})
+	filename, err = FindProjectConfig()
+	if err != nil || filename != filepath.Join(root, ".codemap.yaml") {
+		t.Errorf("got %q, %v, want .codemap.yaml first", filename, err)
+	}
+}
@@ -0,0 +1,300 @@
+package codemap
+
+import (
+	"fmt"
+	"html"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DocFormat is the syntax of a kind of documentation file: how its references to code are written, and
+// which comments hold group templates. Files are given a format by their extension; see DocFormats.
+type DocFormat interface {
+	// Name identifies the format, e.g. in the configuration file.
+	Name() string
+	// ReferencePattern returns a regular expression that matches a reference to code, for tags written with
+	// quotedTagBase (which is quoted for use in the expression). The named group "token" is the token,
+	// which should be matched with TokenPattern, and "target" is the link target, which is replaced by
+	// the link to the token. Alternatives may each have their own "token" and "target" groups.
+	ReferencePattern(quotedTagBase string) string
+	// MarkerPattern returns a regular expression that matches the part of a reference that names its token,
+	// in the group "token", whether or not the rest of the reference is well-formed. Markers outside of
+	// references are reported as malformed.
+	MarkerPattern(quotedTagBase string) string
+	// Comment returns the delimiters of the comments that hold group templates. An empty end means
+	// the comment ends at the end of its line.
+	Comment() (start string, end string)
+	// Target returns href as it's written in a reference's link target, e.g. escaped.
+	Target(href string) string
+}
+
+// TokenPattern matches the token of a reference, which may be namespaced by an external repository.
+const TokenPattern = `(?:[A-Za-z0-9][A-Za-z0-9_.-]*/)?[A-Za-z0-9]+`
+
+// builtinDocFormat is a DocFormat whose reference and marker patterns are format strings, with %[1]s
+// for the quoted tag base and %[2]s for TokenPattern.
+type builtinDocFormat struct {
+	name         string
+	reference    string
+	marker       string
+	commentStart string
+	commentEnd   string
+	escape       func(string) string
+	// markdownCode is set for formats with Markdown's code spans and fenced code blocks, whose markers are
+	// examples rather than malformed references.
+	markdownCode bool
+}
+
+func (f builtinDocFormat) Name() string {
+	return f.name
+}
+
+func (f builtinDocFormat) ReferencePattern(quotedTagBase string) string {
+	return fmt.Sprintf(f.reference, quotedTagBase, TokenPattern)
+}
+
+func (f builtinDocFormat) MarkerPattern(quotedTagBase string) string {
+	return fmt.Sprintf(f.marker, quotedTagBase, TokenPattern)
+}
+
+func (f builtinDocFormat) Comment() (string, string) {
+	return f.commentStart, f.commentEnd
+}
+
+func (f builtinDocFormat) Target(href string) string {
+	if f.escape == nil {
+		return href
+	}
+
+	return f.escape(href)
+}
+
+var (
+	// Markdown references are inline links, written [text<!--eyecue-codemap:TOKEN-->](TARGET), or link
+	// reference definitions, written [label]: <!--eyecue-codemap:TOKEN--> TARGET (optionally in <>).
+	Markdown DocFormat = builtinDocFormat{
+		name: "markdown",
+		reference: `<!--%[1]s:(?P<token>%[2]s)-->]\((?P<target>.*?)\)|` +
+			`(?m:^ {0,3}\[[^\]\n]+]:[ \t]*<!--%[1]s:(?P<token>%[2]s)-->[ \t]*(?:<(?P<target>[^>\n]*)>|(?P<target>[^\s<>]+)))`,
+		marker:       `<!--%[1]s:(?P<token>%[2]s)-->`,
+		commentStart: "<!--",
+		commentEnd:   "-->",
+		markdownCode: true,
+	}
+	// MDX references are written [text{/*eyecue-codemap:TOKEN*/}](TARGET), since MDX doesn't allow HTML comments.
+	MDX DocFormat = builtinDocFormat{
+		name:         "mdx",
+		reference:    `\{/\*%[1]s:(?P<token>%[2]s)\*/}]\((?P<target>.*?)\)`,
+		marker:       `\{/\*%[1]s:(?P<token>%[2]s)\*/}`,
+		commentStart: "{/*",
+		commentEnd:   "*/}",
+		markdownCode: true,
+	}
+	// AsciiDoc references are link macros with an attribute naming the token, written
+	// link:TARGET[text,eyecue-codemap=TOKEN]. Group templates are in line comments.
+	AsciiDoc DocFormat = builtinDocFormat{
+		name:         "asciidoc",
+		reference:    `link:(?P<target>[^\s\[]*)\[[^\]\n]*?,\s*%[1]s=(?P<token>%[2]s)\s*]`,
+		marker:       `\b%[1]s=(?P<token>%[2]s)`,
+		commentStart: "// ",
+	}
+	// ReStructuredText references are hyperlink targets preceded by a comment naming the token:
+	//
+	//	.. eyecue-codemap:TOKEN
+	//	.. _text: TARGET
+	//
+	// Group templates are in comments too.
+	ReStructuredText DocFormat = builtinDocFormat{
+		name:         "rst",
+		reference:    `(?m)^\.\. %[1]s:(?P<token>%[2]s)[ \t]*\r?\n\.\. (?:_[^:\n]*|__):[ \t]*(?P<target>\S*)`,
+		marker:       `(?m)^\.\. %[1]s:(?P<token>%[2]s)`,
+		commentStart: ".. ",
+	}
+	// HTML references are anchors that start with a comment naming the token, written
+	// <a href="TARGET"><!--eyecue-codemap:TOKEN-->text</a>.
+	HTML DocFormat = builtinDocFormat{
+		name:         "html",
+		reference:    `<a\s[^>]*?\bhref="(?P<target>[^"]*)"[^>]*>\s*<!--%[1]s:(?P<token>%[2]s)-->`,
+		marker:       `<!--%[1]s:(?P<token>%[2]s)-->`,
+		commentStart: "<!--",
+		commentEnd:   "-->",
+		escape:       html.EscapeString,
+	}
+)
+
+// DocFormats maps file extensions (with the leading ".") to the formats of documentation files, besides
+// Markdown, which is chosen by Options.MarkdownExtensions.
+var DocFormats = map[string]DocFormat{
+	".adoc":     AsciiDoc,
+	".asciidoc": AsciiDoc,
+	".htm":      HTML,
+	".html":     HTML,
+	".mdx":      MDX,
+	".rst":      ReStructuredText,
+}
+
+// docFormatsByName are the built-in formats, by name.
+var docFormatsByName = map[string]DocFormat{}
+
+func init() {
+	for _, format := range []DocFormat{Markdown, MDX, AsciiDoc, ReStructuredText, HTML} {
+		docFormatsByName[format.Name()] = format
+	}
+}
+
+// DocFormatNone is the name that turns off an extension's format in the configuration file.
+const DocFormatNone = "none"
+
+// docFormatNames is the list of valid format names for error messages.
+func docFormatNames() string {
+	var names []string
+	for name := range docFormatsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(append(names, DocFormatNone), ", ")
+}
+
+// docFormat returns the format of filename, or nil if it isn't a documentation file.
+func (o Options) docFormat(filename string) DocFormat {
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	if format, ok := o.DocFormats[ext]; ok {
+		return format
+	}
+
+	if o.isMarkdownFile(filename) {
+		return Markdown
+	}
+
+	return DocFormats[ext]
+}
+
+// docPatterns are the regular expressions of a DocFormat, for a tag base.
+type docPatterns struct {
+	reference *regexp.Regexp
+	// tokenIndexes and targetIndexes are the groups of reference's alternatives, of which one matches.
+	tokenIndexes  []int
+	targetIndexes []int
+	marker        *regexp.Regexp
+	markerIndex   int
+	// groupTemplate matches a group template: the start tag (1), token (2), template (3), content (4) and end tag (5).
+	groupTemplate *regexp.Regexp
+}
+
+// doc returns the patterns of format, compiling them the first time.
+func (p *patterns) doc(format DocFormat) (*docPatterns, error) {
+	p.docMu.Lock()
+	defer p.docMu.Unlock()
+
+	if dp, ok := p.docs[format.Name()]; ok {
+		return dp, nil
+	}
+
+	quoted := regexp.QuoteMeta(p.tagBase)
+
+	reference, err := regexp.Compile(format.ReferencePattern(quoted))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s reference pattern: %w", format.Name(), err)
+	}
+
+	marker, err := regexp.Compile(format.MarkerPattern(quoted))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s marker pattern: %w", format.Name(), err)
+	}
+
+	dp := &docPatterns{
+		reference:     reference,
+		tokenIndexes:  subexpIndexes(reference, "token"),
+		targetIndexes: subexpIndexes(reference, "target"),
+		marker:        marker,
+		markerIndex:   marker.SubexpIndex("token"),
+	}
+	if len(dp.tokenIndexes) == 0 || len(dp.targetIndexes) == 0 {
+		return nil, fmt.Errorf(`invalid %s reference pattern: it must have the groups "token" and "target"`, format.Name())
+	}
+	if dp.markerIndex == -1 {
+		return nil, fmt.Errorf(`invalid %s marker pattern: it must have the group "token"`, format.Name())
+	}
+
+	start, end := format.Comment()
+	template := `(.+?)`
+	if end == "" {
+		template = `([^\n]+)`
+	}
+
+	dp.groupTemplate, err = regexp.Compile(fmt.Sprintf(`(?s)(%[1]s%[3]s-group:([A-Za-z0-9]+):%[4]s%[2]s)\n(.*?)(%[1]send-%[3]s-group%[2]s)`,
+		regexp.QuoteMeta(start), regexp.QuoteMeta(end), quoted, template))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s comment: %w", format.Name(), err)
+	}
+
+	p.docs[format.Name()] = dp
+
+	return dp, nil
+}
+
+// subexpIndexes returns the indexes of every group of re with the given name.
+func subexpIndexes(re *regexp.Regexp, name string) []int {
+	var indexes []int
+	for i, subexpName := range re.SubexpNames() {
+		if subexpName == name {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// submatch returns the offsets of the first of the groups with the given indexes that took part in match.
+func submatch(match []int, indexes []int) (int, int) {
+	for _, i := range indexes {
+		if match[2*i] != -1 {
+			return match[2*i], match[2*i+1]
+		}
+	}
+
+	return -1, -1
+}
+
+// docFormatsOption identifies the formats in opts.DocFormats, for the cache.
+func docFormatsOption(opts Options) []string {
+	var formats []string
+	for ext, format := range opts.DocFormats {
+		name := DocFormatNone
+		if format != nil {
+			name = format.Name()
+		}
+		formats = append(formats, ext+"="+name)
+	}
+	sort.Strings(formats)
+
+	return formats
+}
+
+// docFormatsFromConfig converts the doc-formats setting, which maps extensions to format names.
+func docFormatsFromConfig(names map[string]string) (map[string]DocFormat, error) {
+	formats := make(map[string]DocFormat)
+
+	for ext, name := range names {
+		if !strings.HasPrefix(ext, ".") {
+			return nil, fmt.Errorf("%q must start with '.'", ext)
+		}
+
+		if name == DocFormatNone {
+			formats[strings.ToLower(ext)] = nil
+			continue
+		}
+
+		format, ok := docFormatsByName[name]
+		if !ok {
+			return nil, fmt.Errorf("%q: unknown format %q (expected one of %s)", ext, name, docFormatNames())
+		}
+		formats[strings.ToLower(ext)] = format
+	}
+
+	return formats, nil
+}
@@ -0,0 +1,126 @@
+package codemap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDocFormatPatterns(t *testing.T) {
+	tests := []struct {
+		format DocFormat
+		text   string
+		// references are the tokens and targets of the references, and markers the tokens of all markers.
+		references [][2]string
+		markers    []string
+	}{
+		{
+			format:     Markdown,
+			text:       "See [the code<!--" + tagBase + ":tokA-->](src/a.go#L3) and [the API<!--" + tagBase + ":api/tokB-->]().\n",
+			references: [][2]string{{"tokA", "src/a.go#L3"}, {"api/tokB", ""}},
+			markers:    []string{"tokA", "api/tokB"},
+		},
+		{
+			format: Markdown,
+			text: "[code]: <!--" + tagBase + ":tokA--> src/a.go#L3\n" +
+				"   [spaced code]:<!--" + tagBase + ":tokB--> <src/b c.go#L1>\n" +
+				"[empty]: <!--" + tagBase + ":tokC--> <>\n",
+			references: [][2]string{{"tokA", "src/a.go#L3"}, {"tokB", "src/b c.go#L1"}, {"tokC", ""}},
+			markers:    []string{"tokA", "tokB", "tokC"},
+		},
+		{
+			// A definition without a target, and an indented code block, aren't references.
+			format:  Markdown,
+			text:    "[code]: <!--" + tagBase + ":tokA-->\n    [code]: <!--" + tagBase + ":tokB--> src/b.go\n",
+			markers: []string{"tokA", "tokB"},
+		},
+		{
+			format:     MDX,
+			text:       "See [the code{/*" + tagBase + ":tokA*/}](src/a.go#L3), not [this<!--" + tagBase + ":tokB-->](b.go).\n",
+			references: [][2]string{{"tokA", "src/a.go#L3"}},
+			markers:    []string{"tokA"},
+		},
+		{
+			format:     AsciiDoc,
+			text:       "See link:src/a.go#L3[the code, " + tagBase + "=tokA] and link:b.go[code," + tagBase + "=api/tokB ].\n",
+			references: [][2]string{{"tokA", "src/a.go#L3"}, {"api/tokB", "b.go"}},
+			markers:    []string{"tokA", "api/tokB"},
+		},
+		{
+			format:  AsciiDoc,
+			text:    "See link:src/a.go#L3[the code] and [the code, " + tagBase + "=tokA].\n",
+			markers: []string{"tokA"},
+		},
+		{
+			format: ReStructuredText,
+			text: ".. " + tagBase + ":tokA\n.. _the code: src/a.go#L3\n\n" +
+				".. " + tagBase + ":tokB\r\n.. __: b.go\n\n" +
+				".. " + tagBase + ":tokC\n\nSee `the code`_.\n",
+			references: [][2]string{{"tokA", "src/a.go#L3"}, {"tokB", "b.go"}},
+			markers:    []string{"tokA", "tokB", "tokC"},
+		},
+		{
+			format: HTML,
+			text: `<p>See <a class="code" href="src/a.go#L3"><!--` + tagBase + `:tokA-->the code</a>` +
+				` and <a href="b.go">the <!--` + tagBase + `:tokB-->code</a>.</p>`,
+			references: [][2]string{{"tokA", "src/a.go#L3"}},
+			markers:    []string{"tokA", "tokB"},
+		},
+	}
+
+	p := newPatterns(tagBase)
+
+	for _, tt := range tests {
+		dp, err := p.doc(tt.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var references [][2]string
+		for _, match := range dp.reference.FindAllStringSubmatchIndex(tt.text, -1) {
+			tokenStart, tokenEnd := submatch(match, dp.tokenIndexes)
+			targetStart, targetEnd := submatch(match, dp.targetIndexes)
+			references = append(references, [2]string{tt.text[tokenStart:tokenEnd], tt.text[targetStart:targetEnd]})
+		}
+		if !reflect.DeepEqual(references, tt.references) {
+			t.Errorf("%s: %q: got references %q, want %q", tt.format.Name(), tt.text, references, tt.references)
+		}
+
+		var markers []string
+		for _, match := range dp.marker.FindAllStringSubmatch(tt.text, -1) {
+			markers = append(markers, match[dp.markerIndex])
+		}
+		if !reflect.DeepEqual(markers, tt.markers) {
+			t.Errorf("%s: %q: got markers %q, want %q", tt.format.Name(), tt.text, markers, tt.markers)
+		}
+
+		// Every reference's token is found among the tokens of the file.
+		found := map[string]bool{}
+		for _, match := range p.anyTag.FindAllStringSubmatch(tt.text, -1) {
+			found[match[2]] = true
+		}
+		for _, reference := range tt.references {
+			if !found[reference[0]] {
+				t.Errorf("%s: %q: anyTag doesn't find %q", tt.format.Name(), tt.text, reference[0])
+			}
+		}
+	}
+}
+
+func TestDocFormatsFromConfig(t *testing.T) {
+	formats, err := docFormatsFromConfig(map[string]string{".TXT": "asciidoc", ".md": "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]DocFormat{".txt": AsciiDoc, ".md": nil}
+	if !reflect.DeepEqual(formats, want) {
+		t.Errorf("got %v, want %v", formats, want)
+	}
+
+	for _, names := range []map[string]string{{"txt": "asciidoc"}, {".txt": "textile"}} {
+		_, err := docFormatsFromConfig(names)
+		if err == nil {
+			t.Errorf("%v: expected an error", names)
+		}
+	}
+}
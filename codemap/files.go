@@ -0,0 +1,268 @@
+package codemap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type FileSource struct {
+	Filename     string
+	FromGitIndex bool
+}
+
+// FileSystem abstracts the reading and writing of files, so that callers can
+// check content that isn't in the working directory.
+type FileSystem interface {
+	ReadFile(fileSource FileSource) ([]byte, error)
+	WriteFile(filename string, data []byte) error
+}
+
+// FileSizer is implemented by FileSystems that can tell a file's size without reading it, so that
+// files larger than Options.MaxFileSize are skipped before they're read.
+type FileSizer interface {
+	FileSize(fileSource FileSource) (int64, error)
+}
+
+// OSFileSystem reads from the working directory, or from the Git index
+// for file sources with FromGitIndex set.
+type OSFileSystem struct{}
+
+func (OSFileSystem) ReadFile(fileSource FileSource) ([]byte, error) {
+	if fileSource.FromGitIndex {
+		return readFileFromGitIndex(fileSource.Filename)
+	}
+
+	return os.ReadFile(fileSource.Filename)
+}
+
+func (OSFileSystem) FileSize(fileSource FileSource) (int64, error) {
+	if fileSource.FromGitIndex {
+		return gitObjectSizes.size(":" + fileSource.Filename)
+	}
+
+	stat, err := os.Lstat(fileSource.Filename)
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Size(), nil
+}
+
+func (OSFileSystem) WriteFile(filename string, data []byte) error {
+	return os.WriteFile(filename, data, 0)
+}
+
+func readFileFromGitIndex(filename string) ([]byte, error) {
+	return gitObjects.read(":" + filename)
+}
+
+// GitRevisionFileSystem reads files from a Git commit, tag or tree, so that it can be checked without
+// being checked out. It can't write files.
+type GitRevisionFileSystem struct {
+	// Revision is the revision as given, e.g. a tag name.
+	Revision string
+	// tree is the object ID of the revision's tree, so that every file is read from the same tree.
+	tree string
+	// prefix is the path of the working directory in the repository. Filenames are relative to it.
+	prefix string
+}
+
+// NewGitRevisionFileSystem resolves revision, which can be anything Git accepts as a tree-ish.
+func NewGitRevisionFileSystem(revision string) (*GitRevisionFileSystem, error) {
+	if revision == "" || strings.HasPrefix(revision, "-") {
+		return nil, fmt.Errorf(`invalid revision "%s"`, revision)
+	}
+
+	tree, err := gitOutput("rev-parse", "--verify", revision+"^{tree}")
+	if err != nil {
+		return nil, fmt.Errorf(`"%s" isn't a commit, tag or tree: %w`, revision, err)
+	}
+
+	prefix, err := gitOutput("rev-parse", "--show-prefix")
+	if err != nil {
+		return nil, err
+	}
+
+	return &GitRevisionFileSystem{Revision: revision, tree: tree, prefix: prefix}, nil
+}
+
+func (fs *GitRevisionFileSystem) ReadFile(fileSource FileSource) ([]byte, error) {
+	return fs.ReadRootFile(fs.rootPath(fileSource.Filename))
+}
+
+// rootPath converts a filename relative to the working directory, which may be outside it, to a path
+// from the root of the repository.
+func (fs *GitRevisionFileSystem) rootPath(filename string) string {
+	return path.Join(fs.prefix, filepath.ToSlash(filename))
+}
+
+// ReadRootFile reads a file by its path from the root of the repository. The error wraps
+// os.ErrNotExist if the revision doesn't have the file.
+func (fs *GitRevisionFileSystem) ReadRootFile(path string) ([]byte, error) {
+	return gitObjects.read(fs.tree + ":" + path)
+}
+
+func (fs *GitRevisionFileSystem) FileSize(fileSource FileSource) (int64, error) {
+	return gitObjectSizes.size(fs.tree + ":" + fs.rootPath(fileSource.Filename))
+}
+
+func (fs *GitRevisionFileSystem) WriteFile(filename string, data []byte) error {
+	return fmt.Errorf("cannot write to Git revision %s", fs.Revision)
+}
+
+// ReadFilenames lists the files in the revision that are in the working directory's path.
+func (fs *GitRevisionFileSystem) ReadFilenames() ([]FileSource, error) {
+	cmd := exec.Command("git", "ls-tree", "-r", "-z", fs.tree)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git ls-tree: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	var fileSources []FileSource
+
+	for _, line := range splitNulDelimited(output) {
+		// Output looks like:
+		// 100644 blob b438169c25a6cf5649e09d8d51092998fa4e904e	Dockerfile
+		// Symbolic links (120000) and submodules (160000) aren't files.
+		if !strings.HasPrefix(line, "100") {
+			continue
+		}
+
+		i := strings.Index(line, "\t")
+		if i == -1 {
+			continue
+		}
+
+		fileSources = append(fileSources, FileSource{Filename: line[i+1:]})
+	}
+
+	return fileSources, nil
+}
+
+func shouldIncludeFile(filename string) (bool, error) {
+	stat, err := os.Lstat(filename)
+	if err != nil {
+		return false, fmt.Errorf(`failed to stat "%s": %w`, filename, err)
+	}
+
+	return stat.Mode().IsRegular(), nil
+}
+
+// ReadFilenames reads a list of filenames from r, one per line (or NUL delimited).
+func ReadFilenames(r io.Reader, nulDelimiter bool) ([]FileSource, error) {
+	var fileSources []FileSource
+
+	scn := bufio.NewScanner(r)
+	if nulDelimiter {
+		scn.Split(scanNullDelimited)
+	}
+	for scn.Scan() {
+		filename := strings.TrimPrefix(scn.Text(), "./")
+
+		shouldInclude, err := shouldIncludeFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if shouldInclude {
+			fileSources = append(fileSources, FileSource{
+				Filename:     filename,
+				FromGitIndex: false,
+			})
+		}
+	}
+	if scn.Err() != nil {
+		return nil, fmt.Errorf("failed to read list of filenames: %w", scn.Err())
+	}
+
+	return fileSources, nil
+}
+
+// ReadFilenamesFromGit lists the tracked and untracked (but not ignored) files in the working directory.
+func ReadFilenamesFromGit() ([]FileSource, error) {
+	cmd := exec.Command("git", "ls-files", "--cached", "--others", "--exclude-standard", "-z")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git ls-files: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	var fileSources []FileSource
+
+	for _, filename := range splitNulDelimited(output) {
+		shouldInclude, err := shouldIncludeFile(filename)
+		// Tracked files that have been deleted from the working directory are still listed.
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if shouldInclude {
+			fileSources = append(fileSources, FileSource{
+				Filename:     filename,
+				FromGitIndex: false,
+			})
+		}
+	}
+
+	return fileSources, nil
+}
+
+var spacesRegexp = regexp.MustCompile(`\s+`)
+
+// ReadFilenamesFromGitIndex lists the files in the Git index. Files with staged
+// changes are marked to be read from the index instead of the working directory.
+func ReadFilenamesFromGitIndex() ([]FileSource, error) {
+	// Determine which files are modified+staged and must be read from the Git index vs. the working dir
+	cmd := exec.Command("git", "diff-index", "--name-only", "-z", "HEAD")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git diff-index: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	stagedFilenames := make(map[string]struct{})
+
+	for _, filenameBytes := range bytes.Split(output, []byte{0}) {
+		stagedFilenames[string(filenameBytes)] = struct{}{}
+	}
+
+	// Get a list of all filenames in the Git index
+	cmd = exec.Command("git", "ls-files", "--stage", "-z")
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git ls-files: %s: %w", strings.TrimSpace(string(output)), err)
+	}
+
+	var fileSources []FileSource
+
+	for _, lineBytes := range bytes.Split(output, []byte{0}) {
+		line := string(lineBytes)
+
+		// filter out non-files
+		if !strings.HasPrefix(line, "100") {
+			continue
+		}
+
+		// Output looks like:
+		// 100644 b438169c25a6cf5649e09d8d51092998fa4e904e 0	Dockerfile
+		parts := spacesRegexp.Split(line, 4)
+		filename := parts[3]
+		_, isStaged := stagedFilenames[filename]
+		fileSources = append(fileSources, FileSource{
+			Filename:     filename,
+			FromGitIndex: isStaged,
+		})
+	}
+
+	return fileSources, nil
+}
@@ -0,0 +1,132 @@
+package codemap
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// inGitRepoWithTag commits files with the tag "v1", then changes a.go in the working tree.
+func inGitRepoWithTag(t *testing.T) {
+	t.Helper()
+
+	inGitRepo(t, map[string]string{
+		"a.go":       "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+		"sub/b.go":   "package b\n",
+		"sub/doc.md": "See [a<!--" + tagBase + ":tokA-->](../a.go#L4).\n",
+	})
+	err := os.Symlink("a.go", "link.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "v1")
+	git(t, "tag", "v1")
+
+	replaceInFile(t, "a.go", "package a\n", "package a\n\nconst b = 2\n")
+}
+
+func TestGitRevisionFileSystem(t *testing.T) {
+	inGitRepoWithTag(t)
+
+	fs, err := NewGitRevisionFileSystem("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileSources, err := fs.ReadFilenames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Symbolic links aren't files.
+	if want := fileSourcesOf("a.go", "sub/b.go", "sub/doc.md"); !reflect.DeepEqual(fileSources, want) {
+		t.Errorf("got files %+v, want %+v", fileSources, want)
+	}
+
+	// Files are read from the revision, not the working tree.
+	content, err := fs.ReadFile(FileSource{Filename: "a.go"})
+	if err != nil || strings.Contains(string(content), "const b") {
+		t.Errorf("got %q, %v, want a.go at v1", content, err)
+	}
+	size, err := fs.FileSize(FileSource{Filename: "a.go"})
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("got size %d, %v, want %d", size, err, len(content))
+	}
+
+	_, err = fs.ReadRootFile("missing.go")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want not exist", err)
+	}
+
+	err = fs.WriteFile("a.go", []byte("package a\n"))
+	if err == nil || !strings.Contains(err.Error(), "cannot write to Git revision v1") {
+		t.Errorf("got %v, want cannot write", err)
+	}
+}
+
+func TestGitRevisionFileSystemFromSubdirectory(t *testing.T) {
+	inGitRepoWithTag(t)
+	inSubdirectory(t, "sub")
+
+	fs, err := NewGitRevisionFileSystem("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the files in the working directory are listed, relative to it.
+	fileSources, err := fs.ReadFilenames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fileSourcesOf("b.go", "doc.md"); !reflect.DeepEqual(fileSources, want) {
+		t.Errorf("got files %+v, want %+v", fileSources, want)
+	}
+
+	content, err := fs.ReadFile(FileSource{Filename: "b.go"})
+	if err != nil || string(content) != "package b\n" {
+		t.Errorf("got %q, %v, want sub/b.go", content, err)
+	}
+	content, err = fs.ReadFile(FileSource{Filename: "../a.go"})
+	if err != nil || !strings.HasPrefix(string(content), "package a\n\n//") {
+		t.Errorf("got %q, %v, want a.go at v1", content, err)
+	}
+}
+
+func TestCheckGitRevision(t *testing.T) {
+	inGitRepoWithTag(t)
+	fileSources := fileSourcesOf("a.go", "sub/doc.md")
+
+	// The link is correct at v1, but not in the working tree.
+	result, err := Check(Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasProblem(result.Problems, "incorrect link") {
+		t.Errorf("working tree: got problems %+v, want an incorrect link", result.Problems)
+	}
+
+	fs, err := NewGitRevisionFileSystem("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = Check(Options{FileSystem: fs}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Problems) != 0 {
+		t.Errorf("v1: got problems %+v, want none", result.Problems)
+	}
+}
+
+func TestNewGitRevisionFileSystemInvalid(t *testing.T) {
+	inGitRepoWithTag(t)
+
+	for _, revision := range []string{"", "--all", "v2"} {
+		_, err := NewGitRevisionFileSystem(revision)
+		if err == nil {
+			t.Errorf("%q: got no error", revision)
+		}
+	}
+}
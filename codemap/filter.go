@@ -0,0 +1,252 @@
+package codemap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultExclude is always excluded, before Options.Exclude (so it can be negated there).
+var DefaultExclude = []string{
+	"*.csv",
+	"*.jpeg",
+	"*.jpg",
+	"*.otf",
+	"*.png",
+	"*.ttf",
+	"*.webp",
+	"*.woff",
+	"*.woff2",
+}
+
+// DefaultMaxFileSize is the size at which files are skipped, unless Options.MaxFileSize says otherwise.
+const DefaultMaxFileSize = 10 * 1024 * 1024
+
+// IgnoreFilename is the name of the file, at the root of the project, containing additional exclude patterns.
+const IgnoreFilename = ".codemapignore"
+
+// patternRule is a single line of a .gitignore-style pattern list.
+type patternRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// anchored patterns are matched against the whole path, others against the last path segment.
+	anchored bool
+}
+
+func parsePatternRule(pattern string) (patternRule, error) {
+	var rule patternRule
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	if pattern == "" {
+		return rule, fmt.Errorf("empty pattern")
+	}
+
+	rule.anchored = strings.Contains(pattern, "/")
+	rule.segments = strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+
+	for _, segment := range rule.segments {
+		if segment == "**" {
+			continue
+		}
+
+		_, err := path.Match(segment, "")
+		if err != nil {
+			return rule, err
+		}
+	}
+
+	return rule, nil
+}
+
+func (rule patternRule) matches(pathSegments []string) bool {
+	if !rule.anchored {
+		matched, _ := path.Match(rule.segments[0], pathSegments[len(pathSegments)-1])
+		return matched
+	}
+
+	return matchSegments(rule.segments, pathSegments)
+}
+
+func matchSegments(patternSegments []string, pathSegments []string) bool {
+	for len(patternSegments) > 0 {
+		if patternSegments[0] == "**" {
+			for i := 0; i <= len(pathSegments); i++ {
+				if matchSegments(patternSegments[1:], pathSegments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(pathSegments) == 0 {
+			return false
+		}
+
+		matched, _ := path.Match(patternSegments[0], pathSegments[0])
+		if !matched {
+			return false
+		}
+
+		patternSegments = patternSegments[1:]
+		pathSegments = pathSegments[1:]
+	}
+
+	return len(pathSegments) == 0
+}
+
+// PatternList matches paths using .gitignore syntax: "*" and "?" match within a path segment,
+// "**" matches any number of segments, a pattern without a "/" (other than a trailing one)
+// matches in any directory, a trailing "/" only matches directories, and a leading "!"
+// negates an earlier match. The last matching pattern wins, and nothing inside a matched
+// directory can be negated.
+type PatternList struct {
+	rules []patternRule
+}
+
+// NewPatternList parses patterns. Blank lines and lines starting with "#" are ignored.
+func NewPatternList(patterns []string) (*PatternList, error) {
+	list := &PatternList{}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimRight(pattern, " \t\r")
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		rule, err := parsePatternRule(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		list.rules = append(list.rules, rule)
+	}
+
+	return list, nil
+}
+
+// Empty reports whether the list has no patterns.
+func (l *PatternList) Empty() bool {
+	return len(l.rules) == 0
+}
+
+// Match reports whether filename, a slash-separated path relative to the project root, matches the list.
+func (l *PatternList) Match(filename string) bool {
+	pathSegments := strings.Split(path.Clean(filename), "/")
+
+	// A matched directory matches everything inside it.
+	for i := 1; i < len(pathSegments); i++ {
+		if l.match(pathSegments[:i], true) {
+			return true
+		}
+	}
+
+	return l.match(pathSegments, false)
+}
+
+func (l *PatternList) match(pathSegments []string, isDir bool) bool {
+	matched := false
+
+	for _, rule := range l.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.matches(pathSegments) {
+			matched = !rule.negate
+		}
+	}
+
+	return matched
+}
+
+// ReadPatternFile reads a .gitignore-style file, such as IgnoreFilename, returning its lines.
+// A missing file has no patterns.
+func ReadPatternFile(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePatterns(filename, data)
+}
+
+// ParsePatterns returns the lines of a .gitignore-style file that was read from filename.
+func ParsePatterns(filename string, data []byte) ([]string, error) {
+	var patterns []string
+
+	scn := bufio.NewScanner(bytes.NewReader(data))
+	for scn.Scan() {
+		patterns = append(patterns, scn.Text())
+	}
+	if scn.Err() != nil {
+		return nil, fmt.Errorf(`failed to read "%s": %w`, filename, scn.Err())
+	}
+
+	return patterns, nil
+}
+
+// fileFilter decides which files are inventoried, from Options.Include and Options.Exclude.
+type fileFilter struct {
+	include *PatternList
+	exclude *PatternList
+	// prefix is the path of the working directory from the project root, such as "docs/", since
+	// filenames are relative to the working directory but patterns are relative to the project root.
+	prefix string
+}
+
+// newFileFilter returns the filter of opts, for filenames relative to prefix (see ProjectPrefix).
+func newFileFilter(opts Options, prefix string) (*fileFilter, error) {
+	include, err := NewPatternList(opts.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include: %w", err)
+	}
+
+	exclude, err := NewPatternList(append(append([]string{}, DefaultExclude...), opts.Exclude...))
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %w", err)
+	}
+
+	return &fileFilter{
+		include: include,
+		exclude: exclude,
+		prefix:  prefix,
+	}, nil
+}
+
+// filter removes the file sources that aren't included, or are excluded.
+func (f *fileFilter) filter(fileSources []FileSource) []FileSource {
+	var filtered []FileSource
+
+	for _, fileSource := range fileSources {
+		filename := path.Join(f.prefix, strings.ReplaceAll(fileSource.Filename, "\\", "/"))
+
+		if !f.include.Empty() && !f.include.Match(filename) {
+			continue
+		}
+
+		if f.exclude.Match(filename) {
+			continue
+		}
+
+		filtered = append(filtered, fileSource)
+	}
+
+	return filtered
+}
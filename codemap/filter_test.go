@@ -0,0 +1,81 @@
+package codemap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatternListMatch(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		filename string
+		want     bool
+	}{
+		{[]string{"*.js"}, "a.js", true},
+		{[]string{"*.js"}, "src/a.js", true},
+		{[]string{"*.js"}, "a.jsx", false},
+		{[]string{"/a.js"}, "a.js", true},
+		{[]string{"/a.js"}, "src/a.js", false},
+		{[]string{"src/*.js"}, "src/a.js", true},
+		{[]string{"src/*.js"}, "src/lib/a.js", false},
+		{[]string{"src/**/*.js"}, "src/a.js", true},
+		{[]string{"src/**/*.js"}, "src/lib/deep/a.js", true},
+		{[]string{"**/fixtures/*.csv"}, "a/b/fixtures/x.csv", true},
+		{[]string{"vendor/"}, "vendor/a.go", true},
+		{[]string{"vendor/"}, "src/vendor/a.go", true},
+		{[]string{"vendor/"}, "vendor", false},
+		{[]string{"/vendor/"}, "src/vendor/a.go", false},
+		{[]string{"*.min.js", "!keep.min.js"}, "keep.min.js", false},
+		{[]string{"*.min.js", "!keep.min.js"}, "other.min.js", true},
+		// Nothing inside an excluded directory can be negated.
+		{[]string{"vendor/", "!vendor/keep.go"}, "vendor/keep.go", true},
+		{[]string{"# comment", "", `\#hash`}, "#hash", true},
+		{[]string{`\!bang`}, "!bang", true},
+	}
+
+	for _, tt := range tests {
+		list, err := NewPatternList(tt.patterns)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.patterns, err)
+		}
+
+		got := list.Match(tt.filename)
+		if got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.patterns, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestNewPatternListInvalid(t *testing.T) {
+	for _, patterns := range [][]string{{"/"}, {"!"}, {"a/[b"}} {
+		_, err := NewPatternList(patterns)
+		if err == nil {
+			t.Errorf("%q: expected an error", patterns)
+		}
+	}
+}
+
+func TestFileFilterPrefix(t *testing.T) {
+	fileSources := fileSourcesOf("a.go", "vendor/b.go", "../vendor/c.go", "../d.js")
+
+	tests := []struct {
+		prefix string
+		want   []FileSource
+	}{
+		{"", fileSourcesOf("a.go", "../vendor/c.go")},
+		// In the "docs" directory, "vendor/b.go" is "docs/vendor/b.go" from the project root.
+		{"docs/", fileSourcesOf("a.go", "vendor/b.go")},
+	}
+
+	for _, tt := range tests {
+		filter, err := newFileFilter(Options{Include: []string{"*.go"}, Exclude: []string{"/vendor/"}}, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := filter.filter(fileSources)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("prefix %q: got %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
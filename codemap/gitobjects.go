@@ -0,0 +1,232 @@
+package codemap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitObjects is shared by every reader of Git objects, so that reading many files from the
+// index or history doesn't start a process for each.
+var gitObjects = &gitObjectReader{}
+
+// gitObjectSizes is shared by everything that needs the size of a Git object without its content.
+var gitObjectSizes = &gitObjectReader{batchCheck: true}
+
+// gitObjectReader reads objects through a single long-lived `git cat-file --batch` process, or
+// `git cat-file --batch-check` for their sizes alone. Requests are made one at a time.
+type gitObjectReader struct {
+	// batchCheck is set for a reader of sizes.
+	batchCheck bool
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	// dir is the working directory the process started in. Names are resolved in its repository.
+	dir string
+	// indexFilename is the path of the Git index, and index is its state when the process started.
+	// The process reads the index once, so it's restarted when the index changes.
+	indexFilename string
+	index         fileState
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// read returns the content of the blob with the given name, e.g. ":file" for the file in the
+// index or "COMMIT:file" for the file in a commit.
+func (g *gitObjectReader) read(name string) ([]byte, error) {
+	// Names are sent a line at a time.
+	if strings.Contains(name, "\n") {
+		return gitShow(name)
+	}
+
+	content, _, err := g.query(name)
+
+	return content, err
+}
+
+// size returns the size of the blob with the given name, which is like read's.
+func (g *gitObjectReader) size(name string) (int64, error) {
+	if strings.Contains(name, "\n") {
+		return gitObjectSize(name)
+	}
+
+	_, size, err := g.query(name)
+
+	return size, err
+}
+
+// query requests the blob with the given name. The content is nil for a reader of sizes.
+func (g *gitObjectReader) query(name string) ([]byte, int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cmd != nil && (strings.HasPrefix(name, ":") && g.indexState() != g.index || workingDir() != g.dir) {
+		g.stop()
+	}
+
+	if g.cmd == nil {
+		err := g.start()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	content, size, err := g.request(name)
+	if errors.Is(err, errGitObjectReader) {
+		// The process can't be trusted with another request.
+		g.stop()
+	}
+
+	return content, size, err
+}
+
+var errGitObjectReader = errors.New("git cat-file failed")
+
+func (g *gitObjectReader) request(name string) ([]byte, int64, error) {
+	_, err := io.WriteString(g.stdin, name+"\n")
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errGitObjectReader, err)
+	}
+
+	// The header is "<object ID> <type> <size>", or "<name> missing".
+	header, err := g.stdout.ReadString('\n')
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errGitObjectReader, err)
+	}
+	header = strings.TrimSuffix(header, "\n")
+
+	switch strings.TrimPrefix(header, name+" ") {
+	case "missing":
+		return nil, 0, fmt.Errorf("failed to read %s from Git: %w", name, os.ErrNotExist)
+	case "ambiguous":
+		return nil, 0, fmt.Errorf("failed to read %s from Git: the name is ambiguous", name)
+	}
+
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return nil, 0, fmt.Errorf("%w: unexpected header %q", errGitObjectReader, header)
+	}
+
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: unexpected header %q", errGitObjectReader, header)
+	}
+
+	// --batch-check only writes the header.
+	var content []byte
+	if !g.batchCheck {
+		// The content is followed by a newline.
+		content = make([]byte, size+1)
+		_, err = io.ReadFull(g.stdout, content)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", errGitObjectReader, err)
+		}
+		content = content[:size]
+	}
+
+	if fields[1] != "blob" {
+		return nil, 0, fmt.Errorf("failed to read %s from Git: it's a %s, not a file", name, fields[1])
+	}
+
+	return content, size, nil
+}
+
+func (g *gitObjectReader) start() error {
+	dir := workingDir()
+	if g.indexFilename == "" || dir != g.dir {
+		indexFilename, err := gitOutput("rev-parse", "--git-path", "index")
+		if err != nil {
+			return err
+		}
+		g.indexFilename = indexFilename
+	}
+
+	batch := "--batch"
+	if g.batchCheck {
+		batch = "--batch-check"
+	}
+
+	cmd := exec.Command("git", "cat-file", batch)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	// Take the state of the index before the process can read it.
+	g.index = g.indexState()
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to run git cat-file: %w", err)
+	}
+
+	g.cmd = cmd
+	g.dir = dir
+	g.stdin = stdin
+	g.stdout = bufio.NewReader(stdout)
+
+	return nil
+}
+
+func (g *gitObjectReader) stop() {
+	g.stdin.Close()
+	_ = g.cmd.Wait()
+
+	g.cmd = nil
+	g.stdin = nil
+	g.stdout = nil
+}
+
+func (g *gitObjectReader) indexState() fileState {
+	info, err := os.Stat(g.indexFilename)
+	if err != nil {
+		return fileState{}
+	}
+
+	return fileState{size: info.Size(), modTime: info.ModTime()}
+}
+
+func workingDir() string {
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// gitShow reads an object with a name that can't be sent to git cat-file --batch.
+func gitShow(name string) ([]byte, error) {
+	cmd := exec.Command("git", "show", name)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("git show %s failed: %w", name, err)
+	}
+
+	return output, nil
+}
+
+// gitObjectSize returns the size of an object with a name that can't be sent to git cat-file --batch-check.
+func gitObjectSize(name string) (int64, error) {
+	output, err := gitOutput("cat-file", "-s", name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(output, 10, 64)
+}
@@ -0,0 +1,116 @@
+package codemap
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestGitObjectReader returns a reader that isn't shared with other tests.
+func newTestGitObjectReader(t *testing.T, batchCheck bool) *gitObjectReader {
+	g := &gitObjectReader{batchCheck: batchCheck}
+	t.Cleanup(func() {
+		if g.cmd != nil {
+			g.stop()
+		}
+	})
+
+	return g
+}
+
+func TestGitObjectReader(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"a.go":          "package a\n",
+		"sub/b.txt":     "no newline at the end",
+		"new\nline.txt": "a name with a newline\n",
+	})
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "files")
+	writeFiles(t, map[string]string{"a.go": "package a\n\nvar a = 1\n"})
+	git(t, "add", "a.go")
+
+	g := newTestGitObjectReader(t, false)
+	sizes := newTestGitObjectReader(t, true)
+
+	tests := map[string]string{
+		":a.go":           "package a\n\nvar a = 1\n",
+		"HEAD:a.go":       "package a\n",
+		":sub/b.txt":      "no newline at the end",
+		":new\nline.txt":  "a name with a newline\n",
+		"HEAD:sub/b.txt":  "no newline at the end",
+		"HEAD~0:a.go":     "package a\n",
+		"HEAD:missing.go": "",
+	}
+
+	// Twice, to read from the same process.
+	for i := 0; i < 2; i++ {
+		for name, want := range tests {
+			content, err := g.read(name)
+			size, sizeErr := sizes.size(name)
+
+			if want == "" {
+				if !errors.Is(err, os.ErrNotExist) || !errors.Is(sizeErr, os.ErrNotExist) {
+					t.Errorf("%q: got %v and %v, want not exist", name, err, sizeErr)
+				}
+				continue
+			}
+
+			if err != nil || sizeErr != nil {
+				t.Errorf("%q: got %v and %v", name, err, sizeErr)
+				continue
+			}
+			if string(content) != want || size != int64(len(want)) {
+				t.Errorf("%q: got %q and size %d, want %q", name, content, size, want)
+			}
+		}
+	}
+
+	// A tree isn't a file, and the process can still be used after it.
+	_, err := g.read("HEAD:sub")
+	if err == nil || !strings.Contains(err.Error(), "not a file") {
+		t.Errorf("got %v, want not a file", err)
+	}
+	if content, err := g.read(":a.go"); err != nil || string(content) != tests[":a.go"] {
+		t.Errorf("after a tree: got %q, %v", content, err)
+	}
+}
+
+func TestGitObjectReaderIndexChange(t *testing.T) {
+	inGitRepo(t, map[string]string{"a.go": "package a\n"})
+	git(t, "add", "-A")
+
+	g := newTestGitObjectReader(t, false)
+
+	if _, err := g.read(":a.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The process is restarted to read the new index.
+	writeFiles(t, map[string]string{"b.go": "package b\n"})
+	git(t, "add", "b.go")
+
+	content, err := g.read(":b.go")
+	if err != nil || string(content) != "package b\n" {
+		t.Errorf("got %q, %v, want b.go", content, err)
+	}
+}
+
+func TestGitObjectReaderWorkingDir(t *testing.T) {
+	inGitRepo(t, map[string]string{"a.go": "package first\n"})
+	git(t, "add", "-A")
+
+	g := newTestGitObjectReader(t, false)
+
+	if content, err := g.read(":a.go"); err != nil || string(content) != "package first\n" {
+		t.Fatalf("got %q, %v", content, err)
+	}
+
+	// Names are resolved in the repository of the current working directory.
+	inGitRepo(t, map[string]string{"a.go": "package second\n"})
+	git(t, "add", "-A")
+
+	if content, err := g.read(":a.go"); err != nil || string(content) != "package second\n" {
+		t.Errorf("got %q, %v, want the second repository's", content, err)
+	}
+}
@@ -0,0 +1,375 @@
+package codemap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func (r *runner) ackTokenGroups(inventory *Inventory) error {
+	selected, err := r.ackSelection(inventory)
+	if err != nil {
+		return err
+	}
+
+	groupInfosByFile := map[string][]TokenGroupInfo{}
+
+	for _, token := range inventory.sortedGroupTokens() {
+		groupInfos := inventory.GroupsByToken[token]
+
+		for i, groupInfo := range groupInfos {
+			if !groupInfo.Changed() || !selected(groupInfo) {
+				continue
+			}
+
+			if r.opts.ConfirmAck != nil {
+				confirmed, err := r.opts.ConfirmAck(groupInfo, groupInfos)
+				if err != nil {
+					return err
+				}
+				if !confirmed {
+					continue
+				}
+			}
+
+			groupInfosByFile[groupInfo.FileSource.Filename] = append(groupInfosByFile[groupInfo.FileSource.Filename], groupInfo)
+			groupInfos[i].ExpectedHash = groupInfo.ActualHash
+		}
+	}
+
+	err = r.rewriteGroupEndsByFile(groupInfosByFile, ChangeGroupAcked, `acked group "%s" at "%s:%d"`)
+	if err != nil {
+		return err
+	}
+
+	// Report the groups that still have changes, because they weren't selected or confirmed.
+	r.checkTokenGroups(inventory)
+
+	return nil
+}
+
+// ackNewGroups records the hashes of the blocks of groups created by this run.
+func (r *runner) ackNewGroups(inventory *Inventory) error {
+	groupInfosByFile := map[string][]TokenGroupInfo{}
+
+	for _, token := range inventory.sortedGroupTokens() {
+		if _, ok := r.newGroupTokens[token]; !ok {
+			continue
+		}
+
+		groupInfos := inventory.GroupsByToken[token]
+		for i, groupInfo := range groupInfos {
+			if groupInfo.ExpectedHash == "" {
+				groupInfosByFile[groupInfo.FileSource.Filename] = append(groupInfosByFile[groupInfo.FileSource.Filename], groupInfo)
+				groupInfos[i].ExpectedHash = groupInfo.ActualHash
+			}
+		}
+	}
+
+	return r.rewriteGroupEndsByFile(groupInfosByFile, ChangeGroupAcked, `recorded the hash of new group "%s" at "%s:%d"`)
+}
+
+// ackSelection returns whether a block was selected by Options.AckOnly. It's an error
+// for a selector to match no block at all, or a location to be in more than one innermost block.
+func (r *runner) ackSelection(inventory *Inventory) (func(TokenGroupInfo) bool, error) {
+	if len(r.opts.AckOnly) == 0 {
+		return func(TokenGroupInfo) bool { return true }, nil
+	}
+
+	type blockLine struct {
+		Filename string
+		Line     int
+	}
+
+	tokens := map[string]struct{}{}
+	var lines []blockLine
+
+	for _, selector := range r.opts.AckOnly {
+		if i := strings.LastIndex(selector, ":"); i != -1 {
+			line, err := strconv.Atoi(selector[i+1:])
+			if err != nil || line < 1 {
+				return nil, fmt.Errorf(`invalid ack selector "%s": expected a group token or FILE:LINE`, selector)
+			}
+
+			lines = append(lines, blockLine{
+				Filename: filepath.ToSlash(filepath.Clean(selector[:i])),
+				Line:     line,
+			})
+			continue
+		}
+
+		tokens[selector] = struct{}{}
+	}
+
+	for token := range tokens {
+		if _, ok := inventory.GroupsByToken[token]; !ok {
+			return nil, fmt.Errorf(`cannot ack "%s": there is no %s-group with that token`, token, r.patterns.tagBase)
+		}
+	}
+
+	type blockKey struct {
+		Token    string
+		Filename string
+		Line     int
+	}
+
+	blocks := map[blockKey]struct{}{}
+	for _, bl := range lines {
+		groupInfo, err := r.innermostBlock(inventory, bl.Filename, bl.Line)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks[blockKey{groupInfo.Token, groupInfo.FileSource.Filename, groupInfo.StartLineNumber}] = struct{}{}
+	}
+
+	return func(groupInfo TokenGroupInfo) bool {
+		if _, ok := tokens[groupInfo.Token]; ok {
+			return true
+		}
+
+		_, ok := blocks[blockKey{groupInfo.Token, groupInfo.FileSource.Filename, groupInfo.StartLineNumber}]
+		return ok
+	}, nil
+}
+
+// innermostBlock returns the block that contains line of filename (a slash-separated path) and is inside
+// every other block that does, so that selecting a line of a nested block doesn't select the blocks around it.
+// It's an error if no block contains the line, or if overlapping blocks do and none is innermost.
+func (r *runner) innermostBlock(inventory *Inventory, filename string, line int) (TokenGroupInfo, error) {
+	var containing []TokenGroupInfo
+	for _, token := range inventory.sortedGroupTokens() {
+		for _, groupInfo := range inventory.GroupsByToken[token] {
+			if filepath.ToSlash(groupInfo.FileSource.Filename) == filename &&
+				groupInfo.StartLineNumber <= line && line <= groupInfo.EndLineNumber {
+				containing = append(containing, groupInfo)
+			}
+		}
+	}
+
+	if len(containing) == 0 {
+		return TokenGroupInfo{}, fmt.Errorf(`cannot ack "%s:%d": it isn't in a %s-group block`, filename, line, r.patterns.tagBase)
+	}
+
+	var innermost []TokenGroupInfo
+	for i, candidate := range containing {
+		inside := true
+		for j, other := range containing {
+			if i != j && (candidate.StartLineNumber < other.StartLineNumber || candidate.EndLineNumber > other.EndLineNumber) {
+				inside = false
+				break
+			}
+		}
+
+		if inside {
+			innermost = append(innermost, candidate)
+		}
+	}
+
+	if len(innermost) == 1 {
+		return innermost[0], nil
+	}
+
+	msg := fmt.Sprintf(`cannot ack "%s:%d": it's in overlapping blocks of more than one group, so ack one by token instead:`, filename, line)
+	for _, groupInfo := range containing {
+		msg = fmt.Sprintf("%s\n   %s at %s:%d", msg, groupInfo.Token, groupInfo.FileSource.Filename, groupInfo.StartLineNumber)
+	}
+
+	return TokenGroupInfo{}, errors.New(msg)
+}
+
+// ReadBlock returns the content of a group block: the lines between its start and end tags.
+func ReadBlock(opts Options, groupInfo TokenGroupInfo) (string, error) {
+	fileBytes, err := opts.fileSystem().ReadFile(groupInfo.FileSource)
+	if err != nil {
+		return "", fmt.Errorf(`failed to read "%s": %w`, groupInfo.FileSource.Filename, err)
+	}
+
+	return blockContent(fileBytes, groupInfo.StartLineNumber, groupInfo.EndLineNumber), nil
+}
+
+// blockContent returns the lines of fileBytes after startLine and before endLine, with their newlines.
+func blockContent(fileBytes []byte, startLine int, endLine int) string {
+	return string(bytes.Join(blockLines(fileBytes, startLine, endLine), nil))
+}
+
+// blockLines returns the lines of fileBytes after startLine and before endLine, with their newlines.
+func blockLines(fileBytes []byte, startLine int, endLine int) [][]byte {
+	var lines [][]byte
+
+	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
+	scn.Split(scanLinesWithNewlines)
+	for currentLine := 1; scn.Scan() && currentLine < endLine; currentLine++ {
+		if currentLine > startLine {
+			lines = append(lines, append([]byte(nil), scn.Bytes()...))
+		}
+	}
+
+	return lines
+}
+
+// migrateGroupHashes rewrites the end tags of unchanged blocks whose hashes aren't in the Options.GroupHash format.
+func (r *runner) migrateGroupHashes(inventory *Inventory) error {
+	format := r.opts.groupHash()
+
+	groupInfosByFile := map[string][]TokenGroupInfo{}
+
+	for _, token := range inventory.sortedGroupTokens() {
+		var migrated []TokenGroupInfo
+		primary := -1
+
+		for i, groupInfo := range inventory.GroupsByToken[token] {
+			if groupInfo.Primary {
+				primary = i
+			}
+
+			// Every block is hashed again, since the other blocks' hashes may include the primary block's.
+			contentHash, err := r.hashBlockAgain(groupInfo, format)
+			if err != nil {
+				return err
+			}
+			groupInfo.ContentHash = contentHash
+			migrated = append(migrated, groupInfo)
+		}
+
+		setGroupHashes(migrated, primary)
+
+		for i, groupInfo := range inventory.GroupsByToken[token] {
+			// A changed block's hash no longer describes its content, so it can't be converted.
+			// A block already in the format may still need rewriting, if its group's primary block isn't.
+			if groupInfo.Changed() || migrated[i].ActualHash == groupInfo.ExpectedHash {
+				continue
+			}
+
+			groupInfosByFile[groupInfo.FileSource.Filename] = append(groupInfosByFile[groupInfo.FileSource.Filename], migrated[i])
+		}
+	}
+
+	err := r.rewriteGroupEndsByFile(groupInfosByFile, ChangeGroupHashMigrated, `migrated hash of group "%s" at "%s:%d"`)
+	if err != nil {
+		return err
+	}
+
+	// Report the changed groups, which must be acked and then migrated.
+	r.checkTokenGroups(inventory)
+
+	return nil
+}
+
+// hashBlockAgain returns the hash of a block's lines in another format.
+func (r *runner) hashBlockAgain(groupInfo TokenGroupInfo, format HashFormat) (string, error) {
+	fileBytes, err := r.readFile(groupInfo.FileSource)
+	if err != nil {
+		return "", fmt.Errorf(`failed to read "%s": %w`, groupInfo.FileSource.Filename, err)
+	}
+
+	lines := blockLines(fileBytes, groupInfo.StartLineNumber, groupInfo.EndLineNumber)
+
+	return hashBlockLines(lines, groupInfo.Normalizations, r.opts.commentSyntax(groupInfo.FileSource.Filename), format), nil
+}
+
+// rewriteGroupEndsByFile calls rewriteGroupEnds for the blocks in each file, in order of filename.
+func (r *runner) rewriteGroupEndsByFile(groupInfosByFile map[string][]TokenGroupInfo, kind ChangeKind, messageFormat string) error {
+	filenames := make([]string, 0, len(groupInfosByFile))
+	for filename := range groupInfosByFile {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		err := r.rewriteGroupEnds(groupInfosByFile[filename], kind, messageFormat)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewriteGroupEnds writes the ActualHash of each of groupInfos, which are all in one file, into its end tag.
+// A change of kind is added for each block, with a message from messageFormat and the token, filename and line.
+func (r *runner) rewriteGroupEnds(groupInfos []TokenGroupInfo, kind ChangeKind, messageFormat string) error {
+	fileSource := groupInfos[0].FileSource
+
+	fileBytes, err := r.readFile(fileSource)
+	if err != nil {
+		return err
+	}
+
+	var resultBuf bytes.Buffer
+
+	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
+	scn.Split(scanLinesWithNewlines)
+	currentLine := 0
+	for scn.Scan() {
+		currentLine++
+		lineBytes := scn.Bytes()
+		for _, groupInfo := range groupInfos {
+			if groupInfo.EndLineNumber == currentLine {
+				lineBytes = r.patterns.ackGroupEnd(lineBytes, groupInfo)
+
+				r.addChange(Change{
+					Kind:     kind,
+					Filename: fileSource.Filename,
+					Line:     groupInfo.StartLineNumber,
+					Column:   groupInfo.StartColumn,
+					Token:    groupInfo.Token,
+					Message:  fmt.Sprintf(messageFormat, groupInfo.Token, fileSource.Filename, groupInfo.StartLineNumber),
+				})
+			}
+		}
+
+		_, err := resultBuf.Write(lineBytes)
+		if err != nil {
+			return err
+		}
+	}
+	if scn.Err() != nil {
+		return fmt.Errorf(`failed to scan "%s": %w`, fileSource.Filename, scn.Err())
+	}
+
+	return r.writeFile(fileSource.Filename, resultBuf.Bytes())
+}
+
+// ackGroupEnd rewrites the end tag of groupInfo in lineBytes to acknowledge the block's current content.
+// The end tags of other groups on the line are left alone.
+func (p *patterns) ackGroupEnd(lineBytes []byte, groupInfo TokenGroupInfo) []byte {
+	var norm string
+	if len(groupInfo.Normalizations) > 0 {
+		norm = ":norm=" + formatNormalizations(groupInfo.Normalizations)
+	}
+
+	return p.groupEnd.ReplaceAllFunc(lineBytes, func(tag []byte) []byte {
+		if string(p.groupEnd.FindSubmatch(tag)[1]) != groupInfo.Token {
+			return tag
+		}
+
+		return []byte(fmt.Sprintf(
+			"[end-%s-group:%s%s:%s]", p.tagBase,
+			groupInfo.Token,
+			norm,
+			groupInfo.ActualHash,
+		))
+	})
+}
+
+func (r *runner) checkTokenGroups(inventory *Inventory) {
+	for _, token := range inventory.sortedGroupTokens() {
+		groupInfos := inventory.GroupsByToken[token]
+
+		for _, groupInfo := range groupInfos {
+			if groupInfo.Changed() {
+				r.result.ChangedGroups = append(r.result.ChangedGroups, GroupStatus{
+					Token:  token,
+					Blocks: groupInfos,
+				})
+				break
+			}
+		}
+	}
+}
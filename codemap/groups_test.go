@@ -0,0 +1,279 @@
+package codemap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// nestedGroups has the group "outer" around "inner", and "left" overlapping "right".
+const nestedGroups = `// [` + tagBase + `-group:outer]
+a := 1
+// [` + tagBase + `-group:inner]
+b := 2
+// [end-` + tagBase + `-group:inner]
+c := 3
+// [end-` + tagBase + `-group:outer]
+// [` + tagBase + `-group:left]
+d := 4
+// [` + tagBase + `-group:right]
+e := 5
+// [end-` + tagBase + `-group:left]
+f := 6
+// [end-` + tagBase + `-group:right]
+`
+
+func TestNestedGroupsInventory(t *testing.T) {
+	inTempDir(t, map[string]string{"a.go": nestedGroups})
+
+	inventory, err := BuildInventory(Options{}, fileSourcesOf("a.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][2]int{
+		"outer": {1, 7},
+		"inner": {3, 5},
+		"left":  {8, 12},
+		"right": {10, 14},
+	}
+	for token, lines := range want {
+		groupInfos := inventory.GroupsByToken[token]
+		if len(groupInfos) != 1 {
+			t.Errorf("%s: got blocks %+v, want one", token, groupInfos)
+			continue
+		}
+		if got := [2]int{groupInfos[0].StartLineNumber, groupInfos[0].EndLineNumber}; got != lines {
+			t.Errorf("%s: got lines %v, want %v", token, got, lines)
+		}
+	}
+}
+
+func TestNestedGroupsAck(t *testing.T) {
+	inTempDir(t, map[string]string{"a.go": nestedGroups})
+	fileSources := fileSourcesOf("a.go")
+
+	_, err := Run(Options{}, ModeAck, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A change inside the inner group changes both groups.
+	replaceInFile(t, "a.go", "b := 2", "b := 20")
+	if changed := changedTokens(t, fileSources); strings.Join(changed, " ") != "inner outer" {
+		t.Fatalf("changed groups are %v, want inner and outer", changed)
+	}
+
+	// Acking the inner group after the outer one rewrites its end tag inside the outer block,
+	// which doesn't change the outer group again.
+	for _, token := range []string{"outer", "inner"} {
+		_, err = Run(Options{AckOnly: []string{token}}, ModeAck, fileSources)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if changed := changedTokens(t, fileSources); len(changed) != 0 {
+		t.Errorf("changed groups are %v, want none", changed)
+	}
+}
+
+func TestNestedGroupsInvalid(t *testing.T) {
+	start := func(token string) string { return "// [" + tagBase + "-group:" + token + "]\n" }
+	end := func(token string) string { return "// [end-" + tagBase + "-group:" + token + "]\n" }
+
+	tests := map[string]string{
+		start("a") + start("b") + start("a") + end("a") + end("b") + end("a"): `group "a" starts again before its end (a.go:1 and a.go:3)`,
+		start("a") + end("b") + end("a"):                                      `end-` + tagBase + `-group for unknown group "b" (a.go:2)`,
+		start("a") + start("b") + end("b"):                                    `unclosed ` + tagBase + `-group "a" (a.go:1)`,
+	}
+
+	for content, want := range tests {
+		inTempDir(t, map[string]string{"a.go": content})
+
+		_, err := BuildInventory(Options{}, fileSourcesOf("a.go"))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", content, err, want)
+		}
+	}
+}
+
+// changedTokens returns the tokens of the changed groups, in order.
+func changedTokens(t *testing.T, fileSources []FileSource) []string {
+	t.Helper()
+
+	result, err := Check(Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens []string
+	for _, group := range result.ChangedGroups {
+		tokens = append(tokens, group.Token)
+	}
+
+	return tokens
+}
+
+func TestAckOnlyLocation(t *testing.T) {
+	tests := []struct {
+		name    string
+		ackOnly []string
+		// changed are the groups still changed afterwards.
+		changed []string
+		err     string
+	}{
+		{
+			name:    "nested line selects the inner block",
+			ackOnly: []string{"a.go:4"},
+			changed: []string{"left", "outer", "right"},
+		},
+		{
+			name:    "outer line selects the outer block",
+			ackOnly: []string{"a.go:2"},
+			changed: []string{"inner", "left", "right"},
+		},
+		{
+			name:    "token selects the whole group",
+			ackOnly: []string{"outer"},
+			changed: []string{"inner", "left", "right"},
+		},
+		{
+			name:    "line in one of overlapping blocks",
+			ackOnly: []string{"a.go:9"},
+			changed: []string{"inner", "outer", "right"},
+		},
+		{
+			name:    "line in overlapping blocks",
+			ackOnly: []string{"a.go:11"},
+			changed: []string{"inner", "left", "outer", "right"},
+			err:     `cannot ack "a.go:11": it's in overlapping blocks`,
+		},
+		{
+			name:    "line outside every block",
+			ackOnly: []string{"a.go:15"},
+			changed: []string{"inner", "left", "outer", "right"},
+			err:     "isn't in a " + tagBase + "-group block",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t, map[string]string{"a.go": nestedGroups})
+			fileSources := fileSourcesOf("a.go")
+
+			// Record the hashes, then change every block.
+			_, err := Run(Options{}, ModeAck, fileSources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range []string{"a := 1", "b := 2", "d := 4", "e := 5", "f := 6"} {
+				replaceInFile(t, "a.go", line, line+"0")
+			}
+
+			_, err = Run(Options{AckOnly: tt.ackOnly}, ModeAck, fileSources)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+
+			changed := changedTokens(t, fileSources)
+			if strings.Join(changed, " ") != strings.Join(tt.changed, " ") {
+				t.Errorf("changed groups are %v, want %v", changed, tt.changed)
+			}
+		})
+	}
+}
+
+// withPlaceholders replaces the tokens of group tags with T1, T2, ... in order of appearance, and their hashes with H.
+func withPlaceholders(content string) string {
+	tokens := map[string]string{}
+	re := regexp.MustCompile(`(-group:)(` + TokenPattern + `)(?::(?:` + hashPattern + `))?]`)
+
+	return re.ReplaceAllStringFunc(content, func(tag string) string {
+		m := re.FindStringSubmatch(tag)
+		if _, ok := tokens[m[2]]; !ok {
+			tokens[m[2]] = fmt.Sprintf("T%d", len(tokens)+1)
+		}
+
+		hash := ""
+		if strings.Count(tag, ":") > 1 {
+			hash = ":H"
+		}
+
+		return m[1] + tokens[m[2]] + hash + "]"
+	})
+}
+
+func TestGroupShorthand(t *testing.T) {
+	start := "// [" + tagBase + "-group"
+	end := "// [end-" + tagBase + "-group"
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "end tag",
+			content: start + "]\nfoo\n" + end + "]\n",
+			want:    start + ":T1]\nfoo\n" + end + ":T1:H]\n",
+		},
+		{
+			name:    "nested end tags",
+			content: start + "]\n" + start + "]\nfoo\n" + end + "]\n" + end + "]\n",
+			want:    start + ":T1]\n" + start + ":T2]\nfoo\n" + end + ":T2:H]\n" + end + ":T1:H]\n",
+		},
+		{
+			name:    "line count",
+			content: "  " + start + " lines=2]\n  foo\n  bar\nbaz\n",
+			want:    "  " + start + ":T1]\n  foo\n  bar\n  " + end + ":T1:H]\nbaz\n",
+		},
+		{
+			name:    "line count after code",
+			content: "  var a = 1 " + start + " lines=1]\n  var b = 2",
+			want:    "  var a = 1 " + start + ":T1]\n  var b = 2\n  " + end + ":T1:H]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t, map[string]string{"a.go": tt.content})
+			fileSources := fileSourcesOf("a.go")
+
+			_, err := Update(Options{}, fileSources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := withPlaceholders(readFile(t, "a.go")); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			// The hash is recorded, so the new group doesn't need to be acked.
+			if changed := changedTokens(t, fileSources); len(changed) != 0 {
+				t.Errorf("changed groups are %v, want none", changed)
+			}
+		})
+	}
+}
+
+func TestGroupShorthandInvalid(t *testing.T) {
+	tests := map[string]string{
+		"// [end-" + tagBase + "-group]\n":          "has no " + tagBase + "-group to end (a.go:1)",
+		"// [" + tagBase + "-group lines=2]\nfoo\n": "must be followed by that many lines (a.go:1)",
+	}
+
+	for content, want := range tests {
+		inTempDir(t, map[string]string{"a.go": content})
+
+		_, err := Update(Options{}, fileSourcesOf("a.go"))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", content, err, want)
+		}
+		if got := readFile(t, "a.go"); got != content {
+			t.Errorf("%q: got %q, want the file unchanged", content, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package codemap
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"regexp"
+	"strings"
+)
+
+// HashFormat is the algorithm and notation of the hash in a group end tag.
+type HashFormat string
+
+const (
+	// HashSHA1 is the original format: 40 hex digits of SHA-1, without a prefix.
+	HashSHA1 HashFormat = "sha1"
+	// HashSHA256 is "sha256-" followed by 64 hex digits.
+	HashSHA256 HashFormat = "sha256"
+	// HashSHA256Short is "sha256-" followed by the first 16 hex digits, for shorter end tags.
+	HashSHA256Short HashFormat = "sha256-short"
+)
+
+// HashFormats are the supported hash formats.
+var HashFormats = []HashFormat{HashSHA1, HashSHA256, HashSHA256Short}
+
+// DefaultHashFormat is used for blocks that haven't been acked yet, unless Options.GroupHash is set.
+const DefaultHashFormat = HashSHA1
+
+// hashPattern matches a hash in any of the HashFormats.
+const hashPattern = `[a-f0-9]{40}|sha256-[a-f0-9]{64}|sha256-[a-f0-9]{16}`
+
+var sha256Regexp = regexp.MustCompile(`^sha256-([a-f0-9]{64}|[a-f0-9]{16})$`)
+
+func (f HashFormat) valid() bool {
+	for _, format := range HashFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashFormatNames() string {
+	names := make([]string, len(HashFormats))
+	for i, format := range HashFormats {
+		names[i] = string(format)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// hashFormatOf returns the format of a hash from an end tag, or "" if it isn't a valid hash.
+func hashFormatOf(hash string) HashFormat {
+	if m := sha256Regexp.FindStringSubmatch(hash); m != nil {
+		if len(m[1]) == 16 {
+			return HashSHA256Short
+		}
+		return HashSHA256
+	}
+
+	if len(hash) == 40 {
+		return HashSHA1
+	}
+
+	return ""
+}
+
+func (f HashFormat) newHash() hash.Hash {
+	if f == HashSHA256 || f == HashSHA256Short {
+		return sha256.New()
+	}
+
+	return sha1.New()
+}
+
+// format writes sum as it appears in an end tag.
+func (f HashFormat) format(sum []byte) string {
+	switch f {
+	case HashSHA256:
+		return fmt.Sprintf("sha256-%x", sum)
+	case HashSHA256Short:
+		return fmt.Sprintf("sha256-%x", sum[:8])
+	}
+
+	return fmt.Sprintf("%x", sum)
+}
+
+func (o Options) groupHash() HashFormat {
+	if o.GroupHash == "" {
+		return DefaultHashFormat
+	}
+
+	return o.GroupHash
+}
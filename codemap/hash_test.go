@@ -0,0 +1,134 @@
+package codemap
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestHashFormatOf(t *testing.T) {
+	tests := map[string]HashFormat{
+		strings.Repeat("a", 40):                   HashSHA1,
+		"sha256-" + strings.Repeat("b", 64):       HashSHA256,
+		"sha256-" + strings.Repeat("c", 16):       HashSHA256Short,
+		"sha256-" + strings.Repeat("c", 15):       "",
+		"sha256-" + strings.Repeat("C", 16):       "",
+		strings.Repeat("a", 39):                   "",
+		"sha1-" + strings.Repeat("a", 40):         "",
+		"":                                        "",
+		"sha256-" + strings.Repeat("b", 64) + "0": "",
+	}
+
+	for hash, want := range tests {
+		if got := hashFormatOf(hash); got != want {
+			t.Errorf("hashFormatOf(%q) = %q, want %q", hash, got, want)
+		}
+	}
+}
+
+func TestHashFormatFormat(t *testing.T) {
+	hashRegexp := regexp.MustCompile(`^(?:` + hashPattern + `)$`)
+
+	for _, format := range HashFormats {
+		hasher := format.newHash()
+		hasher.Write([]byte("a := 1\n"))
+		hash := format.format(hasher.Sum(nil))
+
+		if got := hashFormatOf(hash); got != format {
+			t.Errorf("%s: hashFormatOf(%q) = %q", format, hash, got)
+		}
+		if !hashRegexp.MatchString(hash) {
+			t.Errorf("%s: %q doesn't match hashPattern", format, hash)
+		}
+	}
+
+	// The short format is a prefix of the full one.
+	full := HashSHA256.format(HashSHA256.newHash().Sum(nil))
+	short := HashSHA256Short.format(HashSHA256Short.newHash().Sum(nil))
+	if !strings.HasPrefix(full, short) {
+		t.Errorf("%q isn't a prefix of %q", short, full)
+	}
+}
+
+var endTagHashRegexp = regexp.MustCompile(`\[end-` + tagBase + `-group:\w+:(` + hashPattern + `)]`)
+
+// endTagHashFormats returns the formats of the hashes in the end tags of filename, in order.
+func endTagHashFormats(t *testing.T, filename string) []HashFormat {
+	t.Helper()
+
+	var formats []HashFormat
+	for _, m := range endTagHashRegexp.FindAllStringSubmatch(readFile(t, filename), -1) {
+		formats = append(formats, hashFormatOf(m[1]))
+	}
+
+	return formats
+}
+
+const hashGroups = "// [" + tagBase + "-group:grpA]\na := 1\n// [end-" + tagBase + "-group:grpA]\n" +
+	"// [" + tagBase + "-group:grpB]\nb := 1\n// [end-" + tagBase + "-group:grpB]\n"
+
+func TestAckHashFormats(t *testing.T) {
+	for _, format := range HashFormats {
+		t.Run(string(format), func(t *testing.T) {
+			inTempDir(t, map[string]string{"a.go": hashGroups})
+			fileSources := fileSourcesOf("a.go")
+
+			_, err := Ack(Options{GroupHash: format}, fileSources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := endTagHashFormats(t, "a.go"); len(got) != 2 || got[0] != format || got[1] != format {
+				t.Fatalf("got formats %v, want %s", got, format)
+			}
+
+			// Acked blocks are checked in their own format, whatever the option.
+			for _, other := range HashFormats {
+				result, err := Check(Options{GroupHash: other}, fileSources)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.ChangedGroups) != 0 {
+					t.Errorf("checked with %s: got changed groups %+v, want none", other, result.ChangedGroups)
+				}
+			}
+
+			// And they keep it when they're acked again.
+			replaceInFile(t, "a.go", "a := 1", "a := 2")
+			_, err = Ack(Options{GroupHash: HashSHA256}, fileSources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := endTagHashFormats(t, "a.go"); len(got) != 2 || got[0] != format {
+				t.Errorf("acked again: got formats %v, want %s", got, format)
+			}
+		})
+	}
+}
+
+func TestMigrateHashes(t *testing.T) {
+	inTempDir(t, map[string]string{"a.go": hashGroups})
+	fileSources := fileSourcesOf("a.go")
+
+	_, err := Ack(Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaceInFile(t, "a.go", "b := 1", "b := 2")
+
+	result, err := MigrateHashes(Options{GroupHash: HashSHA256Short}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Kind != ChangeGroupHashMigrated {
+		t.Errorf("got changes %+v, want grpA migrated", result.Changes)
+	}
+
+	// The changed block's hash no longer describes its content, so it isn't migrated.
+	want := []HashFormat{HashSHA256Short, HashSHA1}
+	if got := endTagHashFormats(t, "a.go"); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got formats %v, want %v", got, want)
+	}
+	if tokens := changedTokens(t, fileSources); len(tokens) != 1 || tokens[0] != "grpB" {
+		t.Errorf("got changed groups %v, want grpB", tokens)
+	}
+}
@@ -0,0 +1,125 @@
+package codemap
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tagBase is the tag base of test fixtures. Fixtures build their tags by concatenation, so that running
+// the tool on this repo doesn't take them for real tags.
+const tagBase = DefaultTagBase
+
+// inGitRepo runs the test in a new Git repository with files, and returns the repository's directory.
+func inGitRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := inTempDir(t, nil)
+
+	git(t, "init", "-q")
+	git(t, "config", "user.name", "test")
+	git(t, "config", "user.email", "test@example.com")
+	git(t, "config", "commit.gpgsign", "false")
+
+	writeFiles(t, files)
+
+	return dir
+}
+
+// inTempDir runs the test in a new directory with files, and returns the directory.
+func inTempDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	writeFiles(t, files)
+
+	return dir
+}
+
+// inSubdirectory runs the rest of the test in dir.
+func inSubdirectory(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+}
+
+func writeFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+
+	for filename, content := range files {
+		err := os.MkdirAll(filepath.Dir(filename), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(filename, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func git(t *testing.T, args ...string) string {
+	t.Helper()
+
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, output)
+	}
+
+	return string(output)
+}
+
+func readFile(t *testing.T, filename string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func replaceInFile(t *testing.T, filename string, old string, new string) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, map[string]string{filename: strings.Replace(string(data), old, new, 1)})
+}
+
+func fileSourcesOf(filenames ...string) []FileSource {
+	return namesToFileSources(filenames)
+}
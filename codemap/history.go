@@ -0,0 +1,196 @@
+package codemap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ackedBlockSearchDepth is the number of commits searched for the acknowledged content of a block.
+const ackedBlockSearchDepth = 500
+
+// AckedBlock is the content of a group block as it was when last acknowledged.
+type AckedBlock struct {
+	// Revision is the commit the content was found in, or "" for the Git index.
+	Revision string
+	// Filename is the name of the file at that revision, which differs if it has since been renamed.
+	Filename string
+	// LineNumber is the line of the block's start tag at that revision.
+	LineNumber int
+	Content    string
+}
+
+// FindAckedBlock searches the Git index and then the history of the block's file, newest first,
+// for a block of the same group whose content hashed to the block's ExpectedHash. If the group has
+// a primary block and it isn't groupInfo, primary is it: the hashes of the blocks found are combined
+// with the primary's as it was at the same revision.
+// It returns nil if the block was never acknowledged, or the content wasn't found.
+func FindAckedBlock(opts Options, groupInfo TokenGroupInfo, primary *TokenGroupInfo) (*AckedBlock, error) {
+	if groupInfo.ExpectedHash == "" {
+		return nil, nil
+	}
+
+	r := &runner{
+		opts:     opts,
+		mode:     ModeCheck,
+		patterns: newPatterns(opts.tagBase()),
+		result:   &Result{},
+		prefix:   ProjectPrefix(),
+	}
+
+	filename := groupInfo.FileSource.Filename
+
+	// The block may have been acked without being committed. The name is relative to the working directory.
+	fileBytes, err := gitObjects.read(":./" + filename)
+	if err == nil {
+		block := r.findAckedBlock(groupInfo, primary, "", filename, fileBytes)
+		if block != nil {
+			return block, nil
+		}
+	}
+
+	revisions, err := fileHistory(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, revision := range revisions {
+		// The file doesn't exist in commits that deleted it.
+		fileBytes, err := gitObjects.read(fmt.Sprintf("%s:%s", revision.Commit, revision.Path))
+		if err != nil {
+			continue
+		}
+
+		block := r.findAckedBlock(groupInfo, primary, revision.Commit, workingDirPath(r.prefix, revision.Path), fileBytes)
+		if block != nil {
+			block.Revision = revision.Commit
+			return block, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findAckedBlock looks in fileBytes, the content of filename at revision ("" for the Git index), for a block of
+// groupInfo's group whose content hashes to its ExpectedHash.
+func (r *runner) findAckedBlock(groupInfo TokenGroupInfo, primary *TokenGroupInfo, revision string, filename string, fileBytes []byte) *AckedBlock {
+	inventory := newInventory()
+
+	// A revision that can't be inventoried (e.g. it has an unclosed group) can't have the acked content.
+	err := r.inventoryTokenGroups(FileSource{Filename: filename}, fileBytes, inventory)
+	if err != nil {
+		return nil
+	}
+
+	candidates := inventory.GroupsByToken[groupInfo.Token]
+	if primary != nil {
+		candidates = r.withAckedPrimary(candidates, *primary, revision)
+	}
+
+	for _, candidate := range candidates {
+		if candidate.ActualHash == groupInfo.ExpectedHash {
+			return &AckedBlock{
+				Filename:   filename,
+				LineNumber: candidate.StartLineNumber,
+				Content:    blockContent(fileBytes, candidate.StartLineNumber, candidate.EndLineNumber),
+			}
+		}
+	}
+
+	return nil
+}
+
+// withAckedPrimary sets the hashes of candidates as if they were inventoried with the primary block as it
+// was at revision ("" for the Git index), and returns the candidates that aren't the primary.
+func (r *runner) withAckedPrimary(candidates []TokenGroupInfo, primary TokenGroupInfo, revision string) []TokenGroupInfo {
+	// The group may not be in the file yet at revision.
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	blocks := append([]TokenGroupInfo{}, candidates...)
+
+	primaryFilename := primary.FileSource.Filename
+	if !hasBlockIn(blocks, primaryFilename) {
+		// The name is relative to the working directory.
+		fileBytes, err := gitObjects.read(fmt.Sprintf("%s:./%s", revision, primaryFilename))
+		if err != nil {
+			return nil
+		}
+
+		inventory := newInventory()
+		err = r.inventoryTokenGroups(FileSource{Filename: primaryFilename}, fileBytes, inventory)
+		if err != nil {
+			return nil
+		}
+
+		blocks = append(blocks, inventory.GroupsByToken[primary.Token]...)
+	}
+
+	primaryIndex := r.primaryBlock(primary.Token, blocks)
+	if primaryIndex == -1 {
+		return nil
+	}
+	setGroupHashes(blocks, primaryIndex)
+
+	var others []TokenGroupInfo
+	for i := range candidates {
+		if i != primaryIndex {
+			others = append(others, blocks[i])
+		}
+	}
+
+	return others
+}
+
+func hasBlockIn(groupInfos []TokenGroupInfo, filename string) bool {
+	for _, groupInfo := range groupInfos {
+		if groupInfo.FileSource.Filename == filename {
+			return true
+		}
+	}
+
+	return false
+}
+
+type fileRevision struct {
+	Commit string
+	// Path is the file's path from the project root.
+	Path string
+}
+
+// fileHistory lists the commits that changed filename, newest first, following renames. The paths are
+// from the project root, as Git prints them.
+func fileHistory(filename string) ([]fileRevision, error) {
+	cmd := exec.Command("git", "log",
+		fmt.Sprintf("--max-count=%d", ackedBlockSearchDepth),
+		"--follow", "--name-only", "--format=commit %H",
+		"--", filename)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git log %s failed: %w", filename, err)
+	}
+
+	var revisions []fileRevision
+
+	scn := bufio.NewScanner(bytes.NewReader(output))
+	for scn.Scan() {
+		line := scn.Text()
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "commit ") {
+			revisions = append(revisions, fileRevision{Commit: strings.TrimPrefix(line, "commit ")})
+			continue
+		}
+
+		if len(revisions) > 0 {
+			revisions[len(revisions)-1].Path = line
+		}
+	}
+
+	return revisions, nil
+}
@@ -0,0 +1,180 @@
+package codemap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindAckedBlockWithPrimary(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"a.go": "// [" + tagBase + "-group:grpP:primary]\nconst A = 1\n// [end-" + tagBase + "-group:grpP]\n",
+		"b.go": "// [" + tagBase + "-group:grpP]\nconst B = 1\n// [end-" + tagBase + "-group:grpP]\n",
+	})
+
+	fileSources := fileSourcesOf("a.go", "b.go")
+
+	_, err := Run(Options{}, ModeAck, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "acked")
+
+	// The acked content is only in the history once the change is committed.
+	replaceInFile(t, "b.go", "B = 1", "B = 2")
+	git(t, "commit", "-q", "-a", "-m", "changed")
+
+	result, err := Check(Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.ChangedGroups) != 1 {
+		t.Fatalf("got %d changed groups, want 1", len(result.ChangedGroups))
+	}
+
+	var block, primary *TokenGroupInfo
+	for i, groupInfo := range result.ChangedGroups[0].Blocks {
+		if groupInfo.Primary {
+			primary = &result.ChangedGroups[0].Blocks[i]
+		} else {
+			block = &result.ChangedGroups[0].Blocks[i]
+		}
+	}
+	if block == nil || primary == nil || !block.Changed() || primary.Changed() {
+		t.Fatalf("unexpected blocks %+v", result.ChangedGroups[0].Blocks)
+	}
+
+	acked, err := FindAckedBlock(Options{}, *block, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acked == nil {
+		t.Fatal("acked block not found")
+	}
+	if acked.Content != "const B = 1\n" || acked.Filename != "b.go" || acked.Revision == "" {
+		t.Errorf("got %+v, want the content of b.go in the first commit", acked)
+	}
+}
+
+func TestFindAckedBlockFromSubdirectory(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"docs/a.go": "// [" + tagBase + "-group:grpS]\nconst A = 1\n// [end-" + tagBase + "-group:grpS]\n",
+		"b.go":      "// [" + tagBase + "-group:grpS]\nconst B = 1\n// [end-" + tagBase + "-group:grpS]\n",
+	})
+
+	fileSources := fileSourcesOf("docs/a.go", "b.go")
+
+	_, err := Run(Options{}, ModeAck, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "acked")
+	replaceInFile(t, "b.go", "B = 1", "B = 2")
+	git(t, "commit", "-q", "-a", "-m", "changed")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	result, err := Check(Options{}, fileSourcesOf("a.go", filepath.Join("..", "b.go")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.ChangedGroups) != 1 {
+		t.Fatalf("got %d changed groups, want 1", len(result.ChangedGroups))
+	}
+
+	for _, groupInfo := range result.ChangedGroups[0].Blocks {
+		if !groupInfo.Changed() {
+			continue
+		}
+
+		acked, err := FindAckedBlock(Options{}, groupInfo, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acked == nil {
+			t.Fatal("acked block not found")
+		}
+		// The filename is relative to the working directory, like the rest of the result.
+		if acked.Filename != groupInfo.FileSource.Filename {
+			t.Errorf("got filename %q, want %q", acked.Filename, groupInfo.FileSource.Filename)
+		}
+	}
+}
+
+func TestWorkingDirPath(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		rootPath string
+		want     string
+	}{
+		{"", "a.go", "a.go"},
+		{"", "src/a.go", "src/a.go"},
+		{"docs/", "docs/a.go", "a.go"},
+		{"docs/", "src/a.go", "../src/a.go"},
+		{"docs/guide/", "docs/a.go", "../../docs/a.go"},
+		{"docs/", "docsx/a.go", "../docsx/a.go"},
+	}
+
+	for _, tt := range tests {
+		got := workingDirPath(tt.prefix, tt.rootPath)
+		if got != filepath.FromSlash(tt.want) {
+			t.Errorf("workingDirPath(%q, %q) = %q, want %q", tt.prefix, tt.rootPath, got, tt.want)
+		}
+	}
+}
+
+func TestFindAckedBlockBeforeGroup(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"a.go": "const A = 1\n",
+		"b.go": "const B = 1\n",
+	})
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "files")
+
+	// The acked hash isn't in the history, so the search reaches the commit before the group.
+	unknownHash := ":sha256-0123456789abcdef"
+	writeFiles(t, map[string]string{
+		"a.go": "// [" + tagBase + "-group:grpC]\nconst A = 1\n// [end-" + tagBase + "-group:grpC" + unknownHash + "]\n",
+		"b.go": "// [" + tagBase + "-group:grpC]\nconst B = 1\n// [end-" + tagBase + "-group:grpC" + unknownHash + "]\n",
+	})
+	git(t, "commit", "-q", "-a", "-m", "group")
+
+	opts := Options{GroupPolicies: map[string]GroupPolicy{"grpC": {Primary: "a.go"}}}
+	result, err := Check(opts, fileSourcesOf("a.go", "b.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.ChangedGroups) != 1 {
+		t.Fatalf("got %d changed groups, want 1", len(result.ChangedGroups))
+	}
+
+	var block, primary *TokenGroupInfo
+	for i, groupInfo := range result.ChangedGroups[0].Blocks {
+		if groupInfo.Primary {
+			primary = &result.ChangedGroups[0].Blocks[i]
+		} else {
+			block = &result.ChangedGroups[0].Blocks[i]
+		}
+	}
+	if block == nil || primary == nil {
+		t.Fatalf("unexpected blocks %+v", result.ChangedGroups[0].Blocks)
+	}
+
+	acked, err := FindAckedBlock(opts, *block, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acked != nil {
+		t.Errorf("got %+v, want no acked block", acked)
+	}
+}
@@ -0,0 +1,812 @@
+package codemap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/akamensky/base58"
+	"golang.org/x/sync/errgroup"
+)
+
+type TokenLocation struct {
+	Filename string
+	LineNum  int
+	// EndLineNum is the last line of the range marked by an end tag, or 0 when the token marks a single line.
+	EndLineNum int
+	Column     int
+	LinkToFile bool
+}
+
+type TokenGroupInfo struct {
+	Token           string
+	FileSource      FileSource
+	StartLineNumber int
+	StartColumn     int
+	EndLineNumber   int
+	// Normalizations are applied to the block's lines before they're hashed.
+	Normalizations []Normalization
+	// Identical is set by the "identical" attribute on the start tag (see GroupPolicy).
+	Identical bool
+	// Primary is set for the primary block of a group (see GroupPolicy).
+	Primary bool
+	// primaryAttribute is set by the "primary" attribute on the start tag.
+	primaryAttribute bool
+	// ContentHash is the hash of the block's lines. ActualHash is the same, except in a group with a
+	// primary block, where the other blocks' hashes also include the primary's ContentHash.
+	ContentHash  string
+	ActualHash   string
+	ExpectedHash string
+}
+
+// Changed reports whether the block's content differs from what was last acknowledged.
+func (g TokenGroupInfo) Changed() bool {
+	return g.ActualHash != g.ExpectedHash
+}
+
+func (g TokenGroupInfo) location() Location {
+	return Location{
+		Filename: g.FileSource.Filename,
+		Line:     g.StartLineNumber,
+		Column:   g.StartColumn,
+	}
+}
+
+// Inventory is every token and group block found in a set of files.
+type Inventory struct {
+	SinglesByToken      map[string][]TokenLocation
+	GroupsByToken       map[string][]TokenGroupInfo
+	MarkdownFileSources []FileSource
+	// ExternalSinglesByToken are the single tags of the external repositories in Options.Repositories,
+	// by namespaced token, e.g. "api/4vov64BcsXn". They can be referenced, but aren't checked.
+	ExternalSinglesByToken map[string][]TokenLocation
+	mu                     sync.Mutex
+}
+
+func newInventory() *Inventory {
+	return &Inventory{
+		SinglesByToken:         map[string][]TokenLocation{},
+		GroupsByToken:          map[string][]TokenGroupInfo{},
+		ExternalSinglesByToken: map[string][]TokenLocation{},
+	}
+}
+
+// Singles returns the locations of the single tags with token, which may be namespaced by an external repository.
+func (inv *Inventory) Singles(token string) []TokenLocation {
+	if strings.Contains(token, "/") {
+		return inv.ExternalSinglesByToken[token]
+	}
+
+	return inv.SinglesByToken[token]
+}
+
+func (inv *Inventory) sortedSingleTokens() []string {
+	tokens := make([]string, 0, len(inv.SinglesByToken))
+	for token := range inv.SinglesByToken {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	return tokens
+}
+
+func (inv *Inventory) sortedGroupTokens() []string {
+	tokens := make([]string, 0, len(inv.GroupsByToken))
+	for token := range inv.GroupsByToken {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	return tokens
+}
+
+// BuildInventory reads fileSources and returns the tokens and groups found in them.
+// No files are modified.
+func BuildInventory(opts Options, fileSources []FileSource) (*Inventory, error) {
+	prefix := ProjectPrefix()
+
+	filter, err := newFileFilter(opts, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &runner{
+		opts:     opts,
+		mode:     ModeCheck,
+		fs:       opts.fileSystem(),
+		patterns: newPatterns(opts.tagBase()),
+		result:   &Result{},
+		prefix:   prefix,
+	}
+
+	return r.inventoryFiles(filter.filter(fileSources))
+}
+
+func (r *runner) inventoryFiles(fileSources []FileSource) (*Inventory, error) {
+	inventory := newInventory()
+
+	var cacheHits int
+	if r.opts.Cache != nil {
+		cacheHits = r.opts.Cache.Hits()
+	}
+
+	fileSourcesCh := make(chan FileSource, len(fileSources))
+	for _, fileSource := range fileSources {
+		fileSourcesCh <- fileSource
+	}
+	close(fileSourcesCh)
+
+	wg, wgCtx := errgroup.WithContext(context.Background())
+	wg.SetLimit(runtime.GOMAXPROCS(0))
+LOOP:
+	for {
+		select {
+		case <-wgCtx.Done():
+			break LOOP
+		case fileSource, ok := <-fileSourcesCh:
+			if !ok {
+				break LOOP
+			}
+
+			wg.Go(func() error {
+				if r.opts.Cache != nil && r.opts.isOSFileSystem() {
+					return r.inventoryFileWithCache(fileSource, inventory)
+				}
+
+				return r.inventoryFileAndGenerateTokens(fileSource, inventory)
+			})
+		}
+	}
+
+	err := wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	inventory.sort()
+
+	if r.opts.Cache != nil {
+		r.opts.logf("%d of %d files were unchanged since they were cached\n", r.opts.Cache.Hits()-cacheHits, len(fileSources))
+	}
+
+	err = r.inventoryRepositories(inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	return inventory, nil
+}
+
+// inventoryFileWithCache adds what was found in fileSource to the inventory, from Options.Cache if the
+// file hasn't changed since it was cached.
+func (r *runner) inventoryFileWithCache(fileSource FileSource, inventory *Inventory) error {
+	cache := r.opts.Cache
+	cache.prepare(r.opts)
+
+	key := cache.key(fileSource)
+
+	entry, ok := cache.lookup(fileSource.Filename, key, r.mode != ModeCheck)
+	if !ok {
+		fileInventory := newInventory()
+
+		found, err := r.inventoryFile(fileSource, fileInventory)
+		if err != nil {
+			return err
+		}
+
+		entry = newCacheEntry(key, fileInventory, found)
+
+		// Once its tokens have been generated, the file isn't the same as when its key was found.
+		if !found.NeedsTokens || r.mode == ModeCheck {
+			cache.store(fileSource.Filename, entry)
+		}
+	} else if entry.Skipped {
+		r.opts.logf("skipping \"%s\": larger than %d bytes\n", fileSource.Filename, r.opts.maxFileSize())
+	}
+
+	inventory.addCacheEntry(fileSource, entry)
+
+	return nil
+}
+
+// sort puts the blocks of each group, and the Markdown files, in filename and line order.
+func (inv *Inventory) sort() {
+	for _, groupInfos := range inv.GroupsByToken {
+		sort.Slice(groupInfos, func(i, j int) bool {
+			if groupInfos[i].FileSource.Filename == groupInfos[j].FileSource.Filename {
+				return groupInfos[i].StartLineNumber < groupInfos[j].StartLineNumber
+			}
+
+			return groupInfos[i].FileSource.Filename < groupInfos[j].FileSource.Filename
+		})
+	}
+
+	sort.Slice(inv.MarkdownFileSources, func(i, j int) bool {
+		return inv.MarkdownFileSources[i].Filename < inv.MarkdownFileSources[j].Filename
+	})
+}
+
+// fileTokens adds the tokens of the singles and group blocks in filename to tokens.
+func (inv *Inventory) fileTokens(filename string, tokens map[string]struct{}) {
+	for token, locs := range inv.SinglesByToken {
+		for _, loc := range locs {
+			if loc.Filename == filename {
+				tokens[token] = struct{}{}
+			}
+		}
+	}
+
+	for token, groupInfos := range inv.GroupsByToken {
+		for _, groupInfo := range groupInfos {
+			if groupInfo.FileSource.Filename == filename {
+				tokens[token] = struct{}{}
+			}
+		}
+	}
+}
+
+// removeFile forgets everything found in filename.
+func (inv *Inventory) removeFile(filename string) {
+	for token, locs := range inv.SinglesByToken {
+		var kept []TokenLocation
+		for _, loc := range locs {
+			if loc.Filename != filename {
+				kept = append(kept, loc)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(inv.SinglesByToken, token)
+		} else {
+			inv.SinglesByToken[token] = kept
+		}
+	}
+
+	for token, groupInfos := range inv.GroupsByToken {
+		var kept []TokenGroupInfo
+		for _, groupInfo := range groupInfos {
+			if groupInfo.FileSource.Filename != filename {
+				kept = append(kept, groupInfo)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(inv.GroupsByToken, token)
+		} else {
+			inv.GroupsByToken[token] = kept
+		}
+	}
+
+	var kept []FileSource
+	for _, fileSource := range inv.MarkdownFileSources {
+		if fileSource.Filename != filename {
+			kept = append(kept, fileSource)
+		}
+	}
+	inv.MarkdownFileSources = kept
+}
+
+func (r *runner) inventoryFileAndGenerateTokens(fileSource FileSource, inventory *Inventory) error {
+	_, err := r.inventoryFile(fileSource, inventory)
+	return err
+}
+
+// fileFindings describes a file for the cache, besides its tokens and groups.
+type fileFindings struct {
+	// Skipped is set if the file was too large to inventory.
+	Skipped bool
+	// NeedsTokens is set if the file has tags without tokens.
+	NeedsTokens bool
+}
+
+// inventoryFile adds the tokens and groups in fileSource to the inventory, after generating
+// tokens unless the mode is ModeCheck.
+func (r *runner) inventoryFile(fileSource FileSource, inventory *Inventory) (fileFindings, error) {
+	var found fileFindings
+
+	if sizer, ok := r.fs.(FileSizer); ok {
+		size, err := sizer.FileSize(fileSource)
+		if err != nil {
+			return found, fmt.Errorf(`failed to stat "%s": %w`, fileSource.Filename, err)
+		}
+
+		if size >= r.opts.maxFileSize() {
+			r.opts.logf("skipping \"%s\": larger than %d bytes\n", fileSource.Filename, r.opts.maxFileSize())
+			found.Skipped = true
+			return found, nil
+		}
+	}
+
+	fileBytes, err := r.readFile(fileSource)
+	if err != nil {
+		return found, fmt.Errorf(`failed to read "%s": %w`, fileSource.Filename, err)
+	}
+
+	// Other file systems can only be checked once the file is read.
+	if int64(len(fileBytes)) >= r.opts.maxFileSize() {
+		r.opts.logf("skipping \"%s\": larger than %d bytes\n", fileSource.Filename, r.opts.maxFileSize())
+		found.Skipped = true
+		return found, nil
+	}
+
+	found.NeedsTokens = r.patterns.tokenNeeded.Match(fileBytes)
+
+	if r.opts.docFormat(fileSource.Filename) != nil {
+		inventory.mu.Lock()
+		inventory.MarkdownFileSources = append(inventory.MarkdownFileSources, fileSource)
+		inventory.mu.Unlock()
+	}
+
+	if r.mode != ModeCheck {
+		fileBytes, err = r.generateTokens(fileSource, fileBytes)
+		if err != nil {
+			return found, err
+		}
+	}
+
+	err = r.inventoryTokenGroups(fileSource, fileBytes, inventory)
+	if err != nil {
+		return found, err
+	}
+
+	syntax := r.opts.commentSyntax(fileSource.Filename)
+
+	// We'll link to the entire file (instead of a specific line) for any [eyecue-codemap] that:
+	// * Is preceded only by the language's preamble (e.g. a shebang) and/or blank lines
+	// * Is followed by a blank line or EOF
+	linkToFile := true
+
+	// Tokens are added to the inventory once their end tags (if any) have been found.
+	locsByToken := map[string][]TokenLocation{}
+
+	type EndTag struct {
+		TagLineNum int
+		EndLineNum int
+	}
+	endTags := map[string]EndTag{}
+
+	// inventory tokens
+	currentLine := 1
+	var line string
+	var peekLine bool
+	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
+	for {
+		if peekLine {
+			peekLine = false
+		} else {
+			if !scn.Scan() {
+				break
+			}
+			line = scn.Text()
+		}
+
+		doneScanning := false
+
+		m := r.patterns.token.FindAllStringSubmatch(line, -1)
+
+		// If we found a token, and we still think we want to link to the file,
+		// check the next line to make sure it's blank or EOF.
+		if linkToFile && len(m) > 0 {
+			if scn.Scan() {
+				peekLine = true
+				line = scn.Text()
+				if strings.TrimSpace(line) != "" {
+					linkToFile = false
+				}
+			} else {
+				// no more lines, we'll link to the file
+				doneScanning = true
+			}
+		}
+
+		for _, match := range m {
+			before := strings.TrimSpace(match[1])
+			token := match[2]
+			after := strings.TrimSpace(match[3])
+
+			// If the only thing on the line is the codemap comment,
+			// link to the next line.
+			lineNum := currentLine
+			if syntax.isCommentOnly(before, after) {
+				lineNum++
+			}
+
+			locsByToken[token] = append(locsByToken[token], TokenLocation{
+				Filename:   fileSource.Filename,
+				LineNum:    lineNum,
+				Column:     len(match[1]) + 1,
+				LinkToFile: linkToFile,
+			})
+		}
+
+		for _, match := range r.patterns.tokenEnd.FindAllStringSubmatch(line, -1) {
+			token := match[2]
+			if endTag, ok := endTags[token]; ok {
+				return found, fmt.Errorf(`duplicate end-%s for token "%s" (%s:%d and %s:%d)`, r.patterns.tagBase, token,
+					fileSource.Filename, endTag.TagLineNum, fileSource.Filename, currentLine)
+			}
+
+			// If the only thing on the line is the end comment, the range ends on the previous line.
+			endLineNum := currentLine
+			if syntax.isCommentOnly(strings.TrimSpace(match[1]), strings.TrimSpace(match[3])) {
+				endLineNum--
+			}
+
+			endTags[token] = EndTag{
+				TagLineNum: currentLine,
+				EndLineNum: endLineNum,
+			}
+		}
+
+		if doneScanning {
+			break
+		}
+
+		if linkToFile && !syntax.isPreamble(line) {
+			linkToFile = false
+		}
+
+		currentLine++
+	}
+	if scn.Err() != nil && !errors.Is(scn.Err(), bufio.ErrTooLong) {
+		// ErrTooLong means it's probably not a text file. This is OK.
+		return found, fmt.Errorf(`failed to scan "%s": %w`, fileSource.Filename, scn.Err())
+	}
+
+	for token, endTag := range endTags {
+		locs := locsByToken[token]
+		if len(locs) == 0 {
+			return found, fmt.Errorf(`end-%s for unknown token "%s" (%s:%d)`, r.patterns.tagBase, token, fileSource.Filename, endTag.TagLineNum)
+		}
+
+		// Duplicate tokens are reported later; there's no telling which one the end tag belongs to.
+		if len(locs) > 1 {
+			continue
+		}
+
+		if endTag.EndLineNum < locs[0].LineNum {
+			return found, fmt.Errorf(`end-%s for token "%s" must come after its start (%s:%d)`, r.patterns.tagBase, token, fileSource.Filename, endTag.TagLineNum)
+		}
+
+		locs[0].EndLineNum = endTag.EndLineNum
+		locs[0].LinkToFile = false
+	}
+
+	inventory.mu.Lock()
+	for token, locs := range locsByToken {
+		inventory.SinglesByToken[token] = append(inventory.SinglesByToken[token], locs...)
+	}
+	inventory.mu.Unlock()
+
+	return found, nil
+}
+
+// generateTokens assigns a new token to every tag that doesn't have one yet. A group start tag without
+// a token is given the same token as the next end tag without one, or with "lines=N", an end tag is
+// added after the next N lines.
+func (r *runner) generateTokens(fileSource FileSource, fileBytes []byte) ([]byte, error) {
+	if !r.patterns.tokenNeeded.Match(fileBytes) {
+		return fileBytes, nil
+	}
+
+	type pendingStart struct {
+		Token string
+		Line  int
+	}
+	// pendingStarts are the group start tags given tokens, innermost last, that may still be
+	// closed by an end tag without a token.
+	var pendingStarts []pendingStart
+	type addedEnd struct {
+		Token string
+		Line  string
+	}
+	// endsAfter are the end tags to add after each line. The inner group's tag comes first.
+	endsAfter := map[int][]addedEnd{}
+
+	var lines [][]byte
+	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
+	scn.Split(scanLinesWithNewlines)
+	for scn.Scan() {
+		lines = append(lines, append([]byte(nil), scn.Bytes()...))
+	}
+	if scn.Err() != nil {
+		return nil, fmt.Errorf(`failed to scan "%s": %w`, fileSource.Filename, scn.Err())
+	}
+
+	for i, line := range lines {
+		lineNum := i + 1
+
+		var resultBuf bytes.Buffer
+		remainingIndex := 0
+
+		for _, match := range r.patterns.tokenNeeded.FindAllSubmatchIndex(line, -1) {
+			resultBuf.Write(line[remainingIndex:match[0]])
+			remainingIndex = match[1]
+
+			isEnd := match[2] != -1
+			isGroup := match[4] != -1
+
+			if isEnd {
+				if len(pendingStarts) == 0 {
+					return nil, fmt.Errorf(`end-%s-group without a token has no %s-group to end (%s:%d)`,
+						r.patterns.tagBase, r.patterns.tagBase, fileSource.Filename, lineNum)
+				}
+
+				start := pendingStarts[len(pendingStarts)-1]
+				pendingStarts = pendingStarts[:len(pendingStarts)-1]
+
+				resultBuf.WriteString(fmt.Sprintf("[end-%s-group:%s]", r.patterns.tagBase, start.Token))
+				r.addGroupEndChange(fileSource, start.Token, lineNum, match[0]+1)
+				continue
+			}
+
+			token := generateToken()
+			r.addChange(Change{
+				Kind:     ChangeTokenAdded,
+				Filename: fileSource.Filename,
+				Line:     lineNum,
+				Column:   match[0] + 1,
+				Token:    token,
+				Message:  fmt.Sprintf("Added new token \"%s\" to \"%s\"", token, fileSource.Filename),
+			})
+
+			if !isGroup {
+				resultBuf.WriteString(fmt.Sprintf("[%s:%s]", r.patterns.tagBase, token))
+				continue
+			}
+
+			resultBuf.WriteString(fmt.Sprintf("[%s-group:%s]", r.patterns.tagBase, token))
+
+			r.mu.Lock()
+			if r.newGroupTokens == nil {
+				r.newGroupTokens = map[string]struct{}{}
+			}
+			r.newGroupTokens[token] = struct{}{}
+			r.mu.Unlock()
+
+			if match[6] == -1 {
+				pendingStarts = append(pendingStarts, pendingStart{Token: token, Line: lineNum})
+				continue
+			}
+
+			count, err := strconv.Atoi(string(line[match[6]:match[7]]))
+			if err != nil || count < 1 || i+count >= len(lines) {
+				return nil, fmt.Errorf(`%s-group with lines=%s must be followed by that many lines (%s:%d)`,
+					r.patterns.tagBase, line[match[6]:match[7]], fileSource.Filename, lineNum)
+			}
+
+			endTag := fmt.Sprintf("[end-%s-group:%s]", r.patterns.tagBase, token)
+			endLine := r.groupEndLine(fileSource.Filename, line, match[0], match[1], endTag)
+			endsAfter[i+count] = append([]addedEnd{{Token: token, Line: endLine}}, endsAfter[i+count]...)
+		}
+
+		resultBuf.Write(line[remainingIndex:])
+		lines[i] = resultBuf.Bytes()
+	}
+
+	var resultBuf bytes.Buffer
+	resultLineNum := 0
+	for i, line := range lines {
+		resultBuf.Write(line)
+		resultLineNum++
+
+		for _, end := range endsAfter[i] {
+			if !bytes.HasSuffix(resultBuf.Bytes(), []byte("\n")) {
+				resultBuf.WriteString("\n")
+			}
+			resultBuf.WriteString(end.Line)
+			resultLineNum++
+
+			r.addGroupEndChange(fileSource, end.Token, resultLineNum, 1)
+		}
+	}
+
+	err := r.writeFile(fileSource.Filename, resultBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return resultBuf.Bytes(), nil
+}
+
+// groupEndLine returns a line for endTag, for a start tag at line[start:end]. If the start tag is alone
+// in a comment, the comment is copied; otherwise a comment is made in the file's comment syntax.
+func (r *runner) groupEndLine(filename string, line []byte, start int, end int, endTag string) string {
+	content := bytes.TrimRight(line, "\r\n")
+	ending := string(line[len(content):])
+	if ending == "" {
+		ending = "\n"
+	}
+	before := string(content[:start])
+	after := ""
+	if end < len(content) {
+		after = string(content[end:])
+	}
+
+	syntax := r.opts.commentSyntax(filename)
+	if syntax.isCommentOnly(strings.TrimSpace(before), strings.TrimSpace(after)) {
+		return before + endTag + after + ending
+	}
+
+	indent := before[:len(before)-len(strings.TrimLeft(before, " \t"))]
+	switch {
+	case len(syntax.Line) > 0:
+		return indent + syntax.Line[0] + " " + endTag + ending
+	case len(syntax.Block) > 0:
+		return indent + syntax.Block[0].Start + " " + endTag + " " + syntax.Block[0].End + ending
+	}
+
+	return indent + endTag + ending
+}
+
+func (r *runner) addGroupEndChange(fileSource FileSource, token string, line int, column int) {
+	r.addChange(Change{
+		Kind:     ChangeGroupEndAdded,
+		Filename: fileSource.Filename,
+		Line:     line,
+		Column:   column,
+		Token:    token,
+		Message:  fmt.Sprintf("Added end of group \"%s\" to \"%s:%d\"", token, fileSource.Filename, line),
+	})
+}
+
+func (r *runner) inventoryTokenGroups(fileSource FileSource, fileBytes []byte, inventory *Inventory) error {
+	type OpenGroup struct {
+		Lines           [][]byte
+		Token           string
+		StartLineNumber int
+		StartColumn     int
+		Identical       bool
+		Primary         bool
+	}
+	// openGroups are the groups whose end tags haven't been found yet, innermost last.
+	// Groups may be nested or overlap, so an end tag may close any of them.
+	var openGroups []*OpenGroup
+
+	tagBase := r.patterns.tagBase
+	currentLine := 1
+
+	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
+	scn.Split(scanLinesWithNewlines)
+	for scn.Scan() {
+		line := scn.Text()
+
+		for _, groupMatch := range r.patterns.groupEnd.FindAllStringSubmatch(line, -1) {
+			token := groupMatch[1]
+			expectedHash := groupMatch[5]
+
+			i := len(openGroups) - 1
+			for i >= 0 && openGroups[i].Token != token {
+				i--
+			}
+			if i < 0 {
+				return fmt.Errorf(`end-%s-group for unknown group "%s" (%s:%d)`, tagBase, token, fileSource.Filename, currentLine)
+			}
+			openGroup := openGroups[i]
+			openGroups = append(openGroups[:i], openGroups[i+1:]...)
+
+			normalizations, actualHash, err := r.hashGroupBlock(fileSource.Filename, openGroup.Lines, groupMatch[2] != "", groupMatch[3], expectedHash)
+			if err != nil {
+				return fmt.Errorf(`end-%s-group "%s" (%s:%d): %w`, tagBase, token, fileSource.Filename, currentLine, err)
+			}
+
+			inventory.mu.Lock()
+			inventory.GroupsByToken[token] = append(inventory.GroupsByToken[token], TokenGroupInfo{
+				Token:            token,
+				FileSource:       fileSource,
+				StartLineNumber:  openGroup.StartLineNumber,
+				StartColumn:      openGroup.StartColumn,
+				EndLineNumber:    currentLine,
+				Normalizations:   normalizations,
+				Identical:        openGroup.Identical,
+				ContentHash:      actualHash,
+				primaryAttribute: openGroup.Primary,
+				ActualHash:       actualHash,
+				ExpectedHash:     expectedHash,
+			})
+			inventory.mu.Unlock()
+		}
+
+		if len(openGroups) > 0 {
+			// The end tags of nested groups are hashed without their hashes, so that acking
+			// a nested group doesn't change the groups around it.
+			hashedLine := r.patterns.groupEnd.ReplaceAll(scn.Bytes(), []byte(fmt.Sprintf("[end-%s-group:$1]", tagBase)))
+			for _, openGroup := range openGroups {
+				openGroup.Lines = append(openGroup.Lines, hashedLine)
+			}
+		}
+
+		for _, groupMatchIndex := range r.patterns.groupStart.FindAllStringSubmatchIndex(line, -1) {
+			token := line[groupMatchIndex[2]:groupMatchIndex[3]]
+			for _, openGroup := range openGroups {
+				if openGroup.Token == token {
+					return fmt.Errorf(`%s-group "%s" starts again before its end (%s:%d and %s:%d)`, tagBase, token,
+						fileSource.Filename, openGroup.StartLineNumber, fileSource.Filename, currentLine)
+				}
+			}
+
+			identical, primary, err := parseGroupAttributes(line[groupMatchIndex[4]:groupMatchIndex[5]])
+			if err != nil {
+				return fmt.Errorf(`%s-group "%s" (%s:%d): %w`, tagBase, token, fileSource.Filename, currentLine, err)
+			}
+
+			openGroups = append(openGroups, &OpenGroup{
+				Token:           token,
+				StartLineNumber: currentLine,
+				StartColumn:     groupMatchIndex[0] + 1,
+				Identical:       identical,
+				Primary:         primary,
+			})
+		}
+
+		currentLine++
+	}
+
+	if len(openGroups) > 0 {
+		return fmt.Errorf(`unclosed %s-group "%s" (%s:%d)`, tagBase, openGroups[0].Token, fileSource.Filename, openGroups[0].StartLineNumber)
+	}
+
+	return nil
+}
+
+// hashGroupBlock decides the normalizations of a block, and returns them with the block's hash.
+// The end tag's normalizations are used when it has them (hasTagNormalizations), otherwise Options.GroupNormalize.
+// The hash is in the format of expectedHash, or Options.GroupHash for a block that hasn't been acked.
+func (r *runner) hashGroupBlock(filename string, lines [][]byte, hasTagNormalizations bool, tagNormalizations string, expectedHash string) ([]Normalization, string, error) {
+	syntax := r.opts.commentSyntax(filename)
+
+	format := hashFormatOf(expectedHash)
+	if format == "" {
+		format = r.opts.groupHash()
+	}
+
+	if hasTagNormalizations {
+		normalizations, err := ParseNormalizations(tagNormalizations)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return normalizations, hashBlockLines(lines, normalizations, syntax, format), nil
+	}
+
+	rawHash := hashBlockLines(lines, nil, syntax, format)
+
+	// A block acked before it had normalizations is checked without them, until it changes.
+	if len(r.opts.GroupNormalize) == 0 || rawHash == expectedHash {
+		return nil, rawHash, nil
+	}
+
+	return r.opts.GroupNormalize, hashBlockLines(lines, r.opts.GroupNormalize, syntax, format), nil
+}
+
+func hashBlockLines(lines [][]byte, normalizations []Normalization, syntax CommentSyntax, format HashFormat) string {
+	hasher := format.newHash()
+
+	normalizer := newBlockNormalizer(normalizations, syntax)
+	for _, line := range lines {
+		if len(normalizations) > 0 {
+			line = normalizer.normalize(line)
+		}
+		hasher.Write(line)
+	}
+
+	return format.format(hasher.Sum(nil))
+}
+
+func generateToken() string {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(fmt.Errorf("failed to read random bytes: %w", err))
+	}
+
+	return base58.Encode(buf)
+}
@@ -0,0 +1,50 @@
+package codemap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineRanges(t *testing.T) {
+	tests := map[string]string{
+		// Tags alone on their lines aren't part of the range.
+		"package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\nvar b = 2\n// [end-" + tagBase + ":tokA]\n":          "a.go#L4-L5",
+		"package a\n\nvar a = 1 // [" + tagBase + ":tokA]\nvar b = 2\nvar c = 3 // [end-" + tagBase + ":tokA]\n": "a.go#L3-L5",
+		"package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n":                                                    "a.go#L4",
+	}
+
+	for content, want := range tests {
+		inTempDir(t, map[string]string{
+			"a.go":   content,
+			"doc.md": "See [a<!--" + tagBase + ":tokA-->]().\n",
+		})
+
+		result, err := Update(Options{}, fileSourcesOf("a.go", "doc.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Problems) != 0 {
+			t.Errorf("%q: got problems %+v, want none", content, result.Problems)
+		}
+
+		if got := readFile(t, "doc.md"); got != "See [a<!--"+tagBase+":tokA-->]("+want+").\n" {
+			t.Errorf("%q: got %q, want a link to %s", content, got, want)
+		}
+	}
+}
+
+func TestLineRangeErrors(t *testing.T) {
+	tests := map[string]string{
+		"// [end-" + tagBase + ":tokA]\n":                                  `end-` + tagBase + ` for unknown token "tokA" (a.go:1)`,
+		"// [end-" + tagBase + ":tokA]\nx\n// [" + tagBase + ":tokA]\ny\n": `end-` + tagBase + ` for token "tokA" must come after its start (a.go:1)`,
+	}
+
+	for content, want := range tests {
+		inTempDir(t, map[string]string{"a.go": content})
+
+		_, err := BuildInventory(Options{}, fileSourcesOf("a.go"))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", content, err, want)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package codemap
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+type LinkKind string
+
+const (
+	// LinkRelative links to files relative to the Markdown file. This is the default.
+	LinkRelative LinkKind = "relative"
+	// LinkGitHub links to https://github.com/ORG/REPO/blob/REF/PATH#L1-L2
+	LinkGitHub LinkKind = "github"
+	// LinkGitLab links to https://gitlab.com/ORG/REPO/-/blob/REF/PATH#L1-2
+	LinkGitLab LinkKind = "gitlab"
+	// LinkBitbucket links to https://bitbucket.org/ORG/REPO/src/REF/PATH#lines-1:2
+	LinkBitbucket LinkKind = "bitbucket"
+	// LinkTemplate links to the output of LinkStyle.Template.
+	LinkTemplate LinkKind = "template"
+)
+
+// LinkStyle decides how links to code are written. The zero value is LinkRelative.
+type LinkStyle struct {
+	Kind LinkKind `yaml:"kind"`
+	// RepoURL is the web URL of the repository, e.g. https://github.com/eyecuelab/eyecue-codemap
+	RepoURL string `yaml:"repo-url"`
+	// Ref is the branch, tag or commit SHA to link to.
+	Ref string `yaml:"ref"`
+	// Pin links to the current commit SHA instead of Ref, when resolved with ResolveFromGit. Since the SHA changes
+	// with every commit, checks accept links pinned to any commit, and only updates pin them to the current one.
+	Pin bool `yaml:"pin"`
+	// Template is a text/template used by LinkTemplate. It is executed with LinkTemplateData.
+	Template string `yaml:"template"`
+}
+
+// LinkTemplateData is the data available to LinkStyle.Template.
+type LinkTemplateData struct {
+	RepoURL string
+	Ref     string
+	// Path is relative to the repository root.
+	Path string
+	// Line and EndLine are 0 when linking to the whole file. EndLine equals Line when linking to a single line.
+	Line    int
+	EndLine int
+}
+
+// ResolveFromGit fills in a missing RepoURL from the "origin" remote, and a missing
+// Ref from the current branch (or the current commit SHA, if Pin is set).
+func (s *LinkStyle) ResolveFromGit() error {
+	if s.Kind == "" || s.Kind == LinkRelative {
+		return nil
+	}
+
+	return s.resolveFromGit("")
+}
+
+// resolveFromGit fills in RepoURL and Ref from the repository in dir, or the working directory if it's "".
+func (s *LinkStyle) resolveFromGit(dir string) error {
+	if s.RepoURL == "" {
+		output, err := gitOutputIn(dir, "remote", "get-url", "origin")
+		if err != nil {
+			return err
+		}
+		s.RepoURL = repoWebURL(output)
+	}
+
+	if s.Pin {
+		output, err := gitOutputIn(dir, "rev-parse", "HEAD")
+		if err != nil {
+			return err
+		}
+		s.Ref = output
+	} else if s.Ref == "" {
+		output, err := gitOutputIn(dir, "rev-parse", "--abbrev-ref", "HEAD")
+		if err != nil {
+			return err
+		}
+		s.Ref = output
+	}
+
+	return nil
+}
+
+// gitOutputIn runs git in dir, or in the working directory if it's "".
+func gitOutputIn(dir string, args ...string) (string, error) {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+
+	return gitOutput(args...)
+}
+
+func gitOutput(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run git %s: %s: %w", strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+var scpLikeURLRegexp = regexp.MustCompile(`^[^@/]+@([^:/]+):(.+)$`)
+
+// repoWebURL converts a Git remote URL such as git@github.com:org/repo.git to https://github.com/org/repo
+func repoWebURL(remoteURL string) string {
+	if m := scpLikeURLRegexp.FindStringSubmatch(remoteURL); m != nil {
+		remoteURL = "https://" + m[1] + "/" + m[2]
+	} else if strings.HasPrefix(remoteURL, "ssh://") {
+		remoteURL = "https://" + strings.TrimPrefix(remoteURL, "ssh://")
+		if at := strings.Index(remoteURL, "@"); at != -1 {
+			remoteURL = "https://" + remoteURL[at+1:]
+		}
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(remoteURL, "/"), ".git")
+}
+
+// linker writes links to code according to a LinkStyle.
+type linker struct {
+	style LinkStyle
+	tpl   *template.Template
+	// prefix is the path of the working directory in the repository (see ProjectPrefix).
+	prefix string
+	// repositories link to the files of other repositories, innermost first.
+	repositories []repositoryLinker
+}
+
+type repositoryLinker struct {
+	path   string
+	linker *linker
+}
+
+// validate checks everything except the repository URL and ref, which may be resolved later.
+func (s LinkStyle) validate() error {
+	switch s.Kind {
+	case "", LinkRelative, LinkGitHub, LinkGitLab, LinkBitbucket:
+		return nil
+	case LinkTemplate:
+		_, err := template.New("link").Parse(s.Template)
+		if err != nil {
+			return fmt.Errorf("invalid link template: %w", err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown link style: %s", s.Kind)
+}
+
+// newLinker returns a linker for style, which links to the files of repositories according to their own styles.
+// prefix is the path of the working directory in the project's repository (see ProjectPrefix).
+func newLinker(style LinkStyle, repositories []Repository, prefix string) (*linker, error) {
+	l, err := newStyleLinker(style)
+	if err != nil {
+		return nil, err
+	}
+	l.prefix = prefix
+
+	for _, repo := range repositories {
+		repoLinker, err := newStyleLinker(repo.LinkStyle)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", repo.Path, err)
+		}
+
+		l.repositories = append(l.repositories, repositoryLinker{path: repo.Path, linker: repoLinker})
+	}
+
+	// Nested submodules are longer paths within their parents.
+	sort.SliceStable(l.repositories, func(i, j int) bool {
+		return len(l.repositories[i].path) > len(l.repositories[j].path)
+	})
+
+	return l, nil
+}
+
+func newStyleLinker(style LinkStyle) (*linker, error) {
+	err := style.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linker{style: style}
+
+	switch style.Kind {
+	case LinkGitHub, LinkGitLab, LinkBitbucket:
+		if style.RepoURL == "" || style.Ref == "" {
+			return nil, fmt.Errorf("link style %s requires a repository URL and ref", style.Kind)
+		}
+	case LinkTemplate:
+		l.tpl = template.Must(template.New("link").Parse(style.Template))
+	}
+
+	return l, nil
+}
+
+// href returns a link from a Markdown file in mdDir to lines line through endLine of filename.
+// A line of 0 links to the whole file, and an endLine of 0 links to a single line.
+func (l *linker) href(mdDir string, filename string, line int, endLine int) (string, error) {
+	for _, repo := range l.repositories {
+		if path, ok := pathInRepository(repo.path, filename); ok {
+			return repo.linker.hrefTo(mdDir, filename, path, line, endLine)
+		}
+	}
+
+	return l.hrefTo(mdDir, filename, path.Join(l.prefix, filepath.ToSlash(filename)), line, endLine)
+}
+
+// hrefTo links to filename, whose path in the linker's repository is path.
+func (l *linker) hrefTo(mdDir string, filename string, path string, line int, endLine int) (string, error) {
+	repoURL := strings.TrimSuffix(l.style.RepoURL, "/")
+
+	switch l.style.Kind {
+	case LinkGitHub:
+		return fmt.Sprintf("%s/blob/%s/%s%s", repoURL, l.style.Ref, path, lineFragment("#L%d", "#L%d-L%d", line, endLine)), nil
+	case LinkGitLab:
+		return fmt.Sprintf("%s/-/blob/%s/%s%s", repoURL, l.style.Ref, path, lineFragment("#L%d", "#L%d-%d", line, endLine)), nil
+	case LinkBitbucket:
+		return fmt.Sprintf("%s/src/%s/%s%s", repoURL, l.style.Ref, path, lineFragment("#lines-%d", "#lines-%d:%d", line, endLine)), nil
+	case LinkTemplate:
+		data := LinkTemplateData{
+			RepoURL: repoURL,
+			Ref:     l.style.Ref,
+			Path:    path,
+			Line:    line,
+			EndLine: endLine,
+		}
+		if data.EndLine == 0 {
+			data.EndLine = line
+		}
+
+		var buf bytes.Buffer
+		err := l.tpl.Execute(&buf, data)
+		if err != nil {
+			return "", fmt.Errorf("failed to execute link template: %w", err)
+		}
+		return buf.String(), nil
+	}
+
+	relPath, err := filepath.Rel(mdDir, filename)
+	if err != nil {
+		return "", err
+	}
+
+	return relPath + lineFragment("#L%d", "#L%d-L%d", line, endLine), nil
+}
+
+// pinnedRefRegexp matches the commit SHAs that pinned links are written with.
+var pinnedRefRegexp = regexp.MustCompile(`\b[0-9a-f]{40}(?:[0-9a-f]{24})?\b`)
+
+// samePinnedLinks reports whether existing and want are the same, except that their links may be
+// pinned to different commits.
+func (l *linker) samePinnedLinks(existing string, want string) bool {
+	if !l.pins() {
+		return existing == want
+	}
+
+	return pinnedRefRegexp.ReplaceAllString(existing, "") == pinnedRefRegexp.ReplaceAllString(want, "")
+}
+
+// pins reports whether any of the linker's links are pinned.
+func (l *linker) pins() bool {
+	if l.style.Pin {
+		return true
+	}
+
+	for _, repo := range l.repositories {
+		if repo.linker.pins() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func lineFragment(lineFormat string, rangeFormat string, line int, endLine int) string {
+	switch {
+	case line == 0:
+		return ""
+	case endLine == 0:
+		return fmt.Sprintf(lineFormat, line)
+	default:
+		return fmt.Sprintf(rangeFormat, line, endLine)
+	}
+}
@@ -0,0 +1,166 @@
+package codemap
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinkerHref(t *testing.T) {
+	github := LinkStyle{Kind: LinkGitHub, RepoURL: "https://github.com/org/repo/", Ref: "main"}
+
+	tests := []struct {
+		style    LinkStyle
+		prefix   string
+		mdDir    string
+		filename string
+		line     int
+		endLine  int
+		want     string
+	}{
+		{LinkStyle{}, "", "docs", "src/a.js", 3, 0, "../src/a.js#L3"},
+		{LinkStyle{}, "sub/", ".", "a.js", 3, 5, "a.js#L3-L5"},
+		{github, "", ".", "sub/a.js", 3, 0, "https://github.com/org/repo/blob/main/sub/a.js#L3"},
+		// Paths are from the root of the repository, wherever it's run.
+		{github, "sub/", ".", "a.js", 3, 0, "https://github.com/org/repo/blob/main/sub/a.js#L3"},
+		{github, "sub/deep/", ".", "../a.js", 0, 0, "https://github.com/org/repo/blob/main/sub/a.js"},
+		{LinkStyle{Kind: LinkGitLab, RepoURL: "https://gitlab.com/org/repo", Ref: "main"}, "sub/", ".", "a.js", 3, 5,
+			"https://gitlab.com/org/repo/-/blob/main/sub/a.js#L3-5"},
+		{LinkStyle{Kind: LinkBitbucket, RepoURL: "https://bitbucket.org/org/repo", Ref: "main"}, "", ".", "a.js", 3, 5,
+			"https://bitbucket.org/org/repo/src/main/a.js#lines-3:5"},
+		{LinkStyle{Kind: LinkTemplate, Template: "{{.Path}}:{{.Line}}-{{.EndLine}}"}, "sub/", ".", "a.js", 3, 0, "sub/a.js:3-3"},
+	}
+
+	for _, tt := range tests {
+		l, err := newLinker(tt.style, nil, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := l.href(tt.mdDir, filepath.FromSlash(tt.filename), tt.line, tt.endLine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != filepath.FromSlash(tt.want) && got != tt.want {
+			t.Errorf("%s from %q: href(%q, %q, %d, %d) = %q, want %q", tt.style.Kind, tt.prefix, tt.mdDir, tt.filename, tt.line, tt.endLine, got, tt.want)
+		}
+	}
+}
+
+func TestLinkerHrefInRepository(t *testing.T) {
+	l, err := newLinker(LinkStyle{}, []Repository{
+		{Name: "lib", Path: filepath.FromSlash("../lib"), LinkStyle: LinkStyle{Kind: LinkGitHub, RepoURL: "https://github.com/org/lib", Ref: "v1"}},
+	}, "sub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := l.href(".", filepath.FromSlash("../lib/src/b.go"), 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://github.com/org/lib/blob/v1/src/b.go#L7"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRepoWebURL(t *testing.T) {
+	tests := map[string]string{
+		"git@github.com:org/repo.git":            "https://github.com/org/repo",
+		"ssh://git@gitlab.com/org/repo.git":      "https://gitlab.com/org/repo",
+		"https://bitbucket.org/org/repo.git":     "https://bitbucket.org/org/repo",
+		"https://github.com/org/repo/":           "https://github.com/org/repo",
+		"https://user@example.com/git/repo.git/": "https://user@example.com/git/repo",
+	}
+
+	for remoteURL, want := range tests {
+		if got := repoWebURL(remoteURL); got != want {
+			t.Errorf("repoWebURL(%q) = %q, want %q", remoteURL, got, want)
+		}
+	}
+}
+
+func TestPinnedLinks(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"sub/a.go":   "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+		"sub/doc.md": "See [a<!--" + tagBase + ":tokA-->]().\n",
+	})
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "files")
+
+	style := LinkStyle{Kind: LinkGitHub, RepoURL: "https://github.com/org/repo", Pin: true}
+	opts := func(ref string) Options {
+		style.Ref = ref
+		return Options{LinkStyle: style}
+	}
+	oldRef := strings.Repeat("1", 40)
+	newRef := strings.Repeat("2", 40)
+
+	inSubdirectory(t, "sub")
+	fileSources := fileSourcesOf("a.go", "doc.md")
+
+	_, err := Update(opts(oldRef), fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "See [a<!--" + tagBase + ":tokA-->](https://github.com/org/repo/blob/" + oldRef + "/sub/a.go#L4).\n"
+	if got := readFile(t, "doc.md"); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// A check after another commit accepts the link pinned to the older commit.
+	result, err := Check(opts(newRef), fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Problems) != 0 {
+		t.Errorf("got problems %+v, want none", result.Problems)
+	}
+
+	// Other changes to the link are still incorrect.
+	replaceInFile(t, "a.go", "package a\n", "package a\n\nconst b = 2\n")
+	result, err = Check(opts(newRef), fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasProblem(result.Problems, "incorrect link") {
+		t.Errorf("got problems %+v, want an incorrect link", result.Problems)
+	}
+
+	// Updating pins the link to the current commit.
+	_, err = Update(opts(newRef), fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, "doc.md"); !strings.Contains(got, "/blob/"+newRef+"/sub/a.go#L6)") {
+		t.Errorf("got %q, want a link pinned to %s", got, newRef)
+	}
+}
+
+func TestSamePinnedLinks(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	sha2 := strings.Repeat("b", 40)
+
+	pinned := &linker{style: LinkStyle{Pin: true}}
+	unpinned := &linker{}
+	pinnedRepository := &linker{repositories: []repositoryLinker{{path: "lib", linker: pinned}}}
+
+	tests := []struct {
+		l        *linker
+		existing string
+		want     string
+		same     bool
+	}{
+		{pinned, "blob/" + sha1 + "/a.go#L1", "blob/" + sha2 + "/a.go#L1", true},
+		{pinned, "blob/" + sha1 + "/a.go#L1", "blob/" + sha2 + "/a.go#L2", false},
+		{pinned, "blob/main/a.go#L1", "blob/" + sha2 + "/a.go#L1", false},
+		{unpinned, "blob/" + sha1 + "/a.go#L1", "blob/" + sha2 + "/a.go#L1", false},
+		{pinnedRepository, "blob/" + sha1 + "/a.go#L1", "blob/" + sha2 + "/a.go#L1", true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.l.samePinnedLinks(tt.existing, tt.want); got != tt.same {
+			t.Errorf("samePinnedLinks(%q, %q) = %v, want %v", tt.existing, tt.want, got, tt.same)
+		}
+	}
+}
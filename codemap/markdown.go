@@ -0,0 +1,475 @@
+package codemap
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"text/template"
+)
+
+type markdownContext struct {
+	Changed     bool
+	FileBytes   []byte
+	Inventory   *Inventory
+	Filename    string
+	FilenameDir string
+	Format      DocFormat
+	Patterns    *docPatterns
+}
+
+// processMarkdownFile checks or updates the references and group templates of a documentation file,
+// which is Markdown or another DocFormat.
+func (r *runner) processMarkdownFile(mdFileSource FileSource, inventory *Inventory) error {
+	fileBytes, err := r.readFile(mdFileSource)
+	if err != nil {
+		return fmt.Errorf(`failed to read "%s": %w`, mdFileSource.Filename, err)
+	}
+
+	format := r.opts.docFormat(mdFileSource.Filename)
+	if format == nil {
+		format = Markdown
+	}
+
+	docPatterns, err := r.patterns.doc(format)
+	if err != nil {
+		return err
+	}
+
+	mdContext := &markdownContext{
+		FileBytes:   fileBytes,
+		Inventory:   inventory,
+		Filename:    mdFileSource.Filename,
+		FilenameDir: filepath.Dir(mdFileSource.Filename),
+		Format:      format,
+		Patterns:    docPatterns,
+	}
+
+	err = r.processTokenRefs(mdContext)
+	if err != nil {
+		return err
+	}
+
+	err = r.processGroupTemplates(mdContext)
+	if err != nil {
+		return err
+	}
+
+	if r.mode != ModeCheck && mdContext.Changed {
+		err := r.writeFile(mdFileSource.Filename, mdContext.FileBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *runner) processTokenRefs(mdContext *markdownContext) error {
+	var resultBuf bytes.Buffer
+
+	fileBytes := mdContext.FileBytes
+	matches := mdContext.Patterns.reference.FindAllSubmatchIndex(fileBytes, -1)
+
+	r.processMalformedRefs(mdContext, matches)
+
+	remainingIndex := 0
+	for _, match := range matches {
+		tokenStart, tokenEnd := submatch(match, mdContext.Patterns.tokenIndexes)
+		token := string(fileBytes[tokenStart:tokenEnd])
+		targetStart, targetEnd := submatch(match, mdContext.Patterns.targetIndexes)
+		lineNum, column := lineAndColumn(fileBytes, match[0])
+
+		_, err := resultBuf.Write(fileBytes[remainingIndex:targetStart])
+		if err != nil {
+			return err
+		}
+		remainingIndex = targetEnd
+
+		target, err := r.processTokenRef(mdContext, token, fileBytes[targetStart:targetEnd], lineNum, column)
+		if err != nil {
+			return err
+		}
+
+		_, err = resultBuf.Write(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := resultBuf.Write(fileBytes[remainingIndex:])
+	if err != nil {
+		return err
+	}
+
+	mdContext.FileBytes = resultBuf.Bytes()
+
+	return nil
+}
+
+// processMalformedRefs reports the token markers that aren't part of any of the references in matches,
+// such as a Markdown marker in the text of a reference-style link instead of in its definition.
+// Markers in Markdown code are examples, and aren't reported.
+func (r *runner) processMalformedRefs(mdContext *markdownContext, matches [][]int) {
+	markerIndex := mdContext.Patterns.markerIndex
+
+	var code [][]int
+	if format, ok := mdContext.Format.(builtinDocFormat); ok && format.markdownCode {
+		code = markdownCode(mdContext.FileBytes)
+	}
+
+	for _, marker := range mdContext.Patterns.marker.FindAllSubmatchIndex(mdContext.FileBytes, -1) {
+		if isWithin(marker, matches) || isWithin(marker, code) {
+			continue
+		}
+
+		token := string(mdContext.FileBytes[marker[2*markerIndex]:marker[2*markerIndex+1]])
+		lineNum, column := lineAndColumn(mdContext.FileBytes, marker[0])
+		r.addProblem(Problem{
+			Kind:     ProblemMalformedReference,
+			Filename: mdContext.Filename,
+			Line:     lineNum,
+			Column:   column,
+			Token:    token,
+			Message:  fmt.Sprintf(`malformed reference at "%s:%d" token "%s"`, mdContext.Filename, lineNum, token),
+		})
+	}
+}
+
+// processTokenRef checks a single token reference, and returns what its link target should be replaced with.
+func (r *runner) processTokenRef(mdContext *markdownContext, token string, target []byte, lineNum int, column int) ([]byte, error) {
+	r.addReference(Reference{
+		Token:    token,
+		Location: Location{Filename: mdContext.Filename, Line: lineNum, Column: column},
+	})
+
+	tokenLocs := mdContext.Inventory.Singles(token)
+	if len(tokenLocs) == 0 {
+		r.addProblem(Problem{
+			Kind:     ProblemTokenNotFound,
+			Filename: mdContext.Filename,
+			Line:     lineNum,
+			Column:   column,
+			Token:    token,
+			Message:  fmt.Sprintf(`token "%s" at "%s:%d" was not found`, token, mdContext.Filename, lineNum),
+		})
+		return target, nil
+	}
+
+	loc := tokenLocs[0]
+	locRelPath, err := filepath.Rel(mdContext.FilenameDir, loc.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var mdTarget string
+	var outputTarget string
+	if loc.LinkToFile {
+		mdTarget, err = r.linker.href(mdContext.FilenameDir, loc.Filename, 0, 0)
+		outputTarget = locRelPath
+	} else if loc.EndLineNum > 0 {
+		mdTarget, err = r.linker.href(mdContext.FilenameDir, loc.Filename, loc.LineNum, loc.EndLineNum)
+		outputTarget = fmt.Sprintf("%s:%d-%d", locRelPath, loc.LineNum, loc.EndLineNum)
+	} else {
+		mdTarget, err = r.linker.href(mdContext.FilenameDir, loc.Filename, loc.LineNum, 0)
+		outputTarget = fmt.Sprintf("%s:%d", locRelPath, loc.LineNum)
+	}
+	if err != nil {
+		return nil, err
+	}
+	replacement := mdContext.Format.Target(mdTarget)
+	if string(target) == replacement {
+		return target, nil
+	}
+
+	if r.mode == ModeCheck {
+		// Links pinned to an older commit are only updated by generating links.
+		if r.linker.samePinnedLinks(string(target), replacement) {
+			return target, nil
+		}
+
+		r.addProblem(Problem{
+			Kind:     ProblemIncorrectLink,
+			Filename: mdContext.Filename,
+			Line:     lineNum,
+			Column:   column,
+			Token:    token,
+			Message:  fmt.Sprintf(`incorrect link at "%s:%d" token "%s"`, mdContext.Filename, lineNum, token),
+		})
+		return target, nil
+	}
+
+	mdContext.Changed = true
+	r.addChange(Change{
+		Kind:     ChangeLinkUpdated,
+		Filename: mdContext.Filename,
+		Line:     lineNum,
+		Column:   column,
+		Token:    token,
+		Message:  fmt.Sprintf("updated link at \"%s:%d\" token \"%s\" -> \"%s\"", mdContext.Filename, lineNum, token, outputTarget),
+	})
+
+	return []byte(replacement), nil
+}
+
+// GroupTemplateData is the data available to each block in a Markdown group template.
+type GroupTemplateData struct {
+	File              string
+	Line              int
+	FileLine          string
+	RangeHref         string
+	MarkdownRangeLink string
+}
+
+func (r *runner) processGroupTemplates(mdContext *markdownContext) error {
+	var resultBuf bytes.Buffer
+
+	remainingIndex := 0
+
+	matches := mdContext.Patterns.groupTemplate.FindAllSubmatchIndex(mdContext.FileBytes, -1)
+	for _, match := range matches {
+		_, err := resultBuf.Write(mdContext.FileBytes[remainingIndex:match[0]])
+		if err != nil {
+			return err
+		}
+
+		remainingIndex = match[1]
+		lineNum, column := lineAndColumn(mdContext.FileBytes, match[0])
+		startTag := mdContext.FileBytes[match[2]:match[3]]
+		token := string(mdContext.FileBytes[match[4]:match[5]])
+		templateText := string(mdContext.FileBytes[match[6]:match[7]])
+		existingContent := mdContext.FileBytes[match[8]:match[9]]
+		endTag := mdContext.FileBytes[match[10]:match[11]]
+
+		r.addReference(Reference{
+			Token:    token,
+			Group:    true,
+			Location: Location{Filename: mdContext.Filename, Line: lineNum, Column: column},
+		})
+
+		groupInfos := mdContext.Inventory.GroupsByToken[token]
+
+		if len(groupInfos) == 0 {
+			r.addProblem(Problem{
+				Kind:     ProblemGroupNotFound,
+				Filename: mdContext.Filename,
+				Line:     lineNum,
+				Column:   column,
+				Token:    token,
+				Message:  fmt.Sprintf(`group token "%s" at "%s:%d" was not found`, token, mdContext.Filename, lineNum),
+			})
+			_, err := resultBuf.Write(mdContext.FileBytes[match[0]:match[1]])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		tpl, err := template.New("").Parse(templateText)
+		if err != nil {
+			return err
+		}
+
+		templateData := make([]GroupTemplateData, len(groupInfos))
+		for i, groupInfo := range groupInfos {
+			fileLine := fmt.Sprintf("%s:%d", groupInfo.FileSource.Filename, groupInfo.StartLineNumber)
+
+			rangeHref, err := r.linker.href(mdContext.FilenameDir, groupInfo.FileSource.Filename, groupInfo.StartLineNumber+1, groupInfo.EndLineNumber-1)
+			if err != nil {
+				return err
+			}
+
+			markdownRangeLink := fmt.Sprintf("[%s](%s)", fileLine, rangeHref)
+
+			templateData[i] = GroupTemplateData{
+				File:              groupInfo.FileSource.Filename,
+				Line:              groupInfo.StartLineNumber,
+				FileLine:          fileLine,
+				RangeHref:         rangeHref,
+				MarkdownRangeLink: markdownRangeLink,
+			}
+		}
+
+		_, err = resultBuf.Write(startTag)
+		if err != nil {
+			return err
+		}
+		err = resultBuf.WriteByte('\n')
+		if err != nil {
+			return err
+		}
+
+		var templateOutputBuf bytes.Buffer
+		err = tpl.Execute(&templateOutputBuf, templateData)
+		if err != nil {
+			return err
+		}
+
+		changed := !bytes.Equal(templateOutputBuf.Bytes(), existingContent)
+		if changed && r.mode == ModeCheck {
+			changed = !r.linker.samePinnedLinks(string(existingContent), templateOutputBuf.String())
+		}
+
+		if changed {
+			mdContext.Changed = true
+
+			if r.mode == ModeCheck {
+				r.addProblem(Problem{
+					Kind:     ProblemIncorrectGroupContent,
+					Filename: mdContext.Filename,
+					Line:     lineNum,
+					Column:   column,
+					Token:    token,
+					Message:  fmt.Sprintf(`incorrect group "%s" template content at "%s:%d"`, token, mdContext.Filename, lineNum),
+				})
+			} else {
+				r.addChange(Change{
+					Kind:     ChangeGroupTemplateUpdated,
+					Filename: mdContext.Filename,
+					Line:     lineNum,
+					Column:   column,
+					Token:    token,
+					Message:  fmt.Sprintf(`updating group "%s" template content at "%s:%d"`, token, mdContext.Filename, lineNum),
+				})
+			}
+		}
+
+		_, err = resultBuf.Write(templateOutputBuf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		_, err = resultBuf.Write(endTag)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := resultBuf.Write(mdContext.FileBytes[remainingIndex:])
+	if err != nil {
+		return err
+	}
+
+	mdContext.FileBytes = resultBuf.Bytes()
+	return nil
+}
+
+// isWithin reports whether the match at offsets is within one of the matches at ranges.
+func isWithin(offsets []int, ranges [][]int) bool {
+	for _, r := range ranges {
+		if offsets[0] >= r[0] && offsets[1] <= r[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+var (
+	// codeFenceRegexp matches the opening fence of a fenced code block (1), which may be indented up to 3 spaces.
+	codeFenceRegexp = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	// blankLineRegexp matches a blank line, which ends a paragraph and any code span in it.
+	blankLineRegexp = regexp.MustCompile(`\n[ \t]*\r?\n`)
+)
+
+// markdownCode returns the offsets of the fenced code blocks and code spans in a Markdown file.
+func markdownCode(fileBytes []byte) [][]int {
+	var code [][]int
+
+	// The start of the text since the last code block.
+	textStart := 0
+	// The fence of the code block that's open, if any.
+	var fence []byte
+	blockStart := 0
+
+	for offset := 0; offset < len(fileBytes); {
+		lineEnd := bytes.IndexByte(fileBytes[offset:], '\n')
+		if lineEnd == -1 {
+			lineEnd = len(fileBytes)
+		} else {
+			lineEnd += offset + 1
+		}
+		line := fileBytes[offset:lineEnd]
+
+		if fence == nil {
+			if m := codeFenceRegexp.FindSubmatch(line); m != nil && !(m[1][0] == '`' && bytes.IndexByte(line[len(m[0]):], '`') != -1) {
+				code = append(code, codeSpans(fileBytes, textStart, offset)...)
+				fence = m[1]
+				blockStart = offset
+			}
+		} else if m := codeFenceRegexp.FindSubmatch(line); m != nil && m[1][0] == fence[0] && len(m[1]) >= len(fence) &&
+			len(bytes.TrimSpace(line[len(m[0]):])) == 0 {
+			code = append(code, []int{blockStart, lineEnd})
+			fence = nil
+			textStart = lineEnd
+		}
+
+		offset = lineEnd
+	}
+
+	// A code block that isn't closed runs to the end of the file.
+	if fence != nil {
+		return append(code, []int{blockStart, len(fileBytes)})
+	}
+
+	return append(code, codeSpans(fileBytes, textStart, len(fileBytes))...)
+}
+
+// codeSpans returns the offsets of the code spans in fileBytes[start:end]. A code span starts with a run of
+// backticks, and ends with a run of the same length in the same paragraph.
+func codeSpans(fileBytes []byte, start int, end int) [][]int {
+	var spans [][]int
+
+	for i := start; i < end; {
+		if fileBytes[i] == '\\' {
+			i += 2
+			continue
+		}
+		if fileBytes[i] != '`' {
+			i++
+			continue
+		}
+
+		runEnd := backtickRunEnd(fileBytes, i, end)
+		paragraphEnd := end
+		if m := blankLineRegexp.FindIndex(fileBytes[runEnd:end]); m != nil {
+			paragraphEnd = runEnd + m[0]
+		}
+
+		closeEnd := -1
+		for j := runEnd; j < paragraphEnd; {
+			if fileBytes[j] != '`' {
+				j++
+				continue
+			}
+
+			jEnd := backtickRunEnd(fileBytes, j, paragraphEnd)
+			if jEnd-j == runEnd-i {
+				closeEnd = jEnd
+				break
+			}
+			j = jEnd
+		}
+
+		if closeEnd == -1 {
+			// The backticks are literal.
+			i = runEnd
+			continue
+		}
+
+		spans = append(spans, []int{i, closeEnd})
+		i = closeEnd
+	}
+
+	return spans
+}
+
+// backtickRunEnd returns the offset after the run of backticks at start.
+func backtickRunEnd(fileBytes []byte, start int, end int) int {
+	i := start
+	for i < end && fileBytes[i] == '`' {
+		i++
+	}
+
+	return i
+}
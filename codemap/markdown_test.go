@@ -0,0 +1,101 @@
+package codemap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownCode(t *testing.T) {
+	tests := []struct {
+		text string
+		// code are the parts of text that are code.
+		code []string
+	}{
+		{"a `b` c ``d ` e`` f", []string{"`b`", "``d ` e``"}},
+		{"a `b\nc` d", []string{"`b\nc`"}},
+		// Code spans end with their paragraph, and backticks may be escaped.
+		{"a `b\n\nc` d", nil},
+		{"a \\`b` c", nil},
+		{"a ``b` c", nil},
+		{"```go\nx := `a`\n```\nb `c`", []string{"```go\nx := `a`\n```\n", "`c`"}},
+		{"  ~~~~\n~~~\n~~~~~ \nafter", []string{"  ~~~~\n~~~\n~~~~~ \n"}},
+		// An opening run without a closing run of the same length is literal.
+		{"``` not a fence ` here\n`a`", []string{"` here\n`"}},
+		{"text\n```\nunclosed `a`\n", []string{"```\nunclosed `a`\n"}},
+		{"    ```\nindented too far\n", nil},
+	}
+
+	for _, tt := range tests {
+		var code []string
+		for _, offsets := range markdownCode([]byte(tt.text)) {
+			code = append(code, tt.text[offsets[0]:offsets[1]])
+		}
+
+		if strings.Join(code, "|") != strings.Join(tt.code, "|") {
+			t.Errorf("%q: got code %q, want %q", tt.text, code, tt.code)
+		}
+	}
+}
+
+func TestMalformedReferencesInCode(t *testing.T) {
+	marker := "<!--" + tagBase + ":tokA-->"
+	inTempDir(t, map[string]string{
+		"a.go": "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+		"doc.md": "Write references like `[text" + marker + "](a.go)`.\n\n" +
+			"```markdown\nSee [the code" + marker + "][code].\n```\n\n" +
+			"But not [like this" + marker + "][code].\n",
+		"doc.html": "<p>Not <code>" + marker + "</code>.</p>\n",
+	})
+
+	result, err := Check(Options{}, fileSourcesOf("a.go", "doc.md", "doc.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var malformed []string
+	for _, problem := range result.Problems {
+		if problem.Kind == ProblemMalformedReference {
+			malformed = append(malformed, fmt.Sprintf("%s:%d", problem.Filename, problem.Line))
+		}
+	}
+	sort.Strings(malformed)
+	if strings.Join(malformed, " ") != "doc.html:1 doc.md:7" {
+		t.Errorf("got malformed references at %q, want doc.md:7 and doc.html:1", malformed)
+	}
+}
+
+func TestReferenceDefinitions(t *testing.T) {
+	inTempDir(t, map[string]string{
+		"a.go": "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n\n// [" + tagBase + ":tokB]\nvar b = 1\n",
+		"doc.md": "See [a][code a] and [b][code b].\n\n" +
+			"[code a]: <!--" + tagBase + ":tokA--> <> \"Title\"\n" +
+			"[code b]: <!--" + tagBase + ":tokB--> old.go#L1 'Title'\n",
+	})
+	fileSources := fileSourcesOf("a.go", "doc.md")
+
+	// The URLs are filled in or updated, keeping the angle brackets and titles.
+	result, err := Update(Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Problems) != 0 {
+		t.Errorf("got problems %+v, want none", result.Problems)
+	}
+
+	want := "See [a][code a] and [b][code b].\n\n" +
+		"[code a]: <!--" + tagBase + ":tokA--> <a.go#L4> \"Title\"\n" +
+		"[code b]: <!--" + tagBase + ":tokB--> a.go#L7 'Title'\n"
+	if got := readFile(t, "doc.md"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	result, err = Check(Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Problems) != 0 || len(result.UnusedTokens) != 0 {
+		t.Errorf("got problems %+v and unused tokens %+v, want none", result.Problems, result.UnusedTokens)
+	}
+}
@@ -0,0 +1,186 @@
+package codemap
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A Normalization makes the hash of a group block insensitive to a kind of formatting change.
+// The normalizations used for a block are written in its end tag, e.g.
+// "end-eyecue-codemap-group:TOKEN:norm=eol,trailing:HASH" (in brackets), so that its hash can be reproduced
+// whatever the configuration.
+type Normalization string
+
+const (
+	// NormalizeEOL treats CRLF line endings as LF.
+	NormalizeEOL Normalization = "eol"
+	// NormalizeTrailing ignores whitespace at the end of lines.
+	NormalizeTrailing Normalization = "trailing"
+	// NormalizeIndent ignores whitespace at the start of lines.
+	NormalizeIndent Normalization = "indent"
+	// NormalizeBlank ignores blank lines.
+	NormalizeBlank Normalization = "blank"
+	// NormalizeComments ignores lines that contain only a comment, in the comment syntax of the file.
+	NormalizeComments Normalization = "comments"
+)
+
+// Normalizations are the known normalizations, in the order they're written in end tags.
+var Normalizations = []Normalization{
+	NormalizeEOL,
+	NormalizeTrailing,
+	NormalizeIndent,
+	NormalizeBlank,
+	NormalizeComments,
+}
+
+// ParseNormalizations parses a comma-separated list of normalizations, as written in end tags.
+func ParseNormalizations(s string) ([]Normalization, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	return validNormalizations(strings.Split(s, ","))
+}
+
+// validNormalizations checks that names are known normalizations, and returns them
+// without duplicates in the order of Normalizations.
+func validNormalizations(names []string) ([]Normalization, error) {
+	seen := map[Normalization]bool{}
+	for _, name := range names {
+		normalization := Normalization(strings.TrimSpace(name))
+		if !isNormalization(normalization) {
+			return nil, fmt.Errorf(`unknown normalization "%s" (expected one of %s)`, name, normalizationNames())
+		}
+		seen[normalization] = true
+	}
+
+	var normalizations []Normalization
+	for _, normalization := range Normalizations {
+		if seen[normalization] {
+			normalizations = append(normalizations, normalization)
+		}
+	}
+
+	return normalizations, nil
+}
+
+func isNormalization(normalization Normalization) bool {
+	for _, known := range Normalizations {
+		if normalization == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalizationNames() string {
+	names := make([]string, len(Normalizations))
+	for i, normalization := range Normalizations {
+		names[i] = string(normalization)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func formatNormalizations(normalizations []Normalization) string {
+	names := make([]string, len(normalizations))
+	for i, normalization := range normalizations {
+		names[i] = string(normalization)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// blockNormalizer rewrites the lines of a group block before they're hashed.
+type blockNormalizer struct {
+	eol, trailing, indent, blank, comments bool
+	syntax                                 CommentSyntax
+	// inBlockComment is the end of the block comment that the previous lines started, if any.
+	inBlockComment string
+}
+
+func newBlockNormalizer(normalizations []Normalization, syntax CommentSyntax) *blockNormalizer {
+	n := &blockNormalizer{syntax: syntax}
+	for _, normalization := range normalizations {
+		switch normalization {
+		case NormalizeEOL:
+			n.eol = true
+		case NormalizeTrailing:
+			n.trailing = true
+		case NormalizeIndent:
+			n.indent = true
+		case NormalizeBlank:
+			n.blank = true
+		case NormalizeComments:
+			n.comments = true
+		}
+	}
+
+	return n
+}
+
+// normalize returns the line (including its line ending) as it should be hashed, or nil to skip it.
+func (n *blockNormalizer) normalize(line []byte) []byte {
+	content := bytes.TrimSuffix(line, []byte("\n"))
+	ending := line[len(content):]
+
+	if n.eol && bytes.HasSuffix(content, []byte("\r")) {
+		content = content[:len(content)-1]
+	}
+	if n.trailing {
+		content = bytes.TrimRight(content, " \t\r")
+	}
+	if n.indent {
+		content = bytes.TrimLeft(content, " \t")
+	}
+
+	trimmed := strings.TrimSpace(string(content))
+	if n.blank && trimmed == "" {
+		return nil
+	}
+	if n.comments && n.isComment(trimmed) {
+		return nil
+	}
+
+	return append(content[:len(content):len(content)], ending...)
+}
+
+// isComment reports whether the trimmed line is only a comment, or is inside a block comment.
+func (n *blockNormalizer) isComment(trimmed string) bool {
+	if n.inBlockComment != "" {
+		if strings.Contains(trimmed, n.inBlockComment) {
+			if !strings.HasSuffix(trimmed, n.inBlockComment) {
+				// Code follows the end of the comment.
+				n.inBlockComment = ""
+				return false
+			}
+			n.inBlockComment = ""
+		}
+		return true
+	}
+
+	for _, marker := range n.syntax.Line {
+		if strings.HasPrefix(trimmed, marker) {
+			return true
+		}
+	}
+
+	for _, block := range n.syntax.Block {
+		if !strings.HasPrefix(trimmed, block.Start) {
+			continue
+		}
+
+		rest := trimmed[len(block.Start):]
+		end := strings.Index(rest, block.End)
+		if end == -1 {
+			n.inBlockComment = block.End
+			return true
+		}
+
+		return strings.TrimSpace(rest[end+len(block.End):]) == ""
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package codemap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlockNormalizer(t *testing.T) {
+	goSyntax := CommentSyntaxes[".go"]
+	sqlSyntax := CommentSyntaxes[".sql"]
+
+	tests := []struct {
+		normalizations string
+		syntax         CommentSyntax
+		block          string
+		want           string
+	}{
+		{"", goSyntax, "  a := 1 \r\n\n", "  a := 1 \r\n\n"},
+		{"eol", goSyntax, "a := 1\r\nb := 2 \r\n", "a := 1\nb := 2 \n"},
+		{"trailing", goSyntax, "a := 1 \t\r\nb := 2", "a := 1\nb := 2"},
+		{"indent", goSyntax, "\t a := 1\n  b := 2\n", "a := 1\nb := 2\n"},
+		{"blank", goSyntax, "a := 1\n\n \t\nb := 2\n", "a := 1\nb := 2\n"},
+		{"blank", goSyntax, "a := 1\r\n\r\n", "a := 1\r\n"},
+		{"comments", goSyntax, "// a\na := 1 // b\n  /* c */\n/* d */ b := 2\n", "a := 1 // b\n/* d */ b := 2\n"},
+		{
+			"comments",
+			goSyntax,
+			"/* a\nb := 1\n*/\nc := 2\n/* d\n*/ e := 3\n",
+			"c := 2\n*/ e := 3\n",
+		},
+		// Other languages' comments aren't ignored.
+		{"comments", goSyntax, "# a\n-- b\n", "# a\n-- b\n"},
+		{"comments", sqlSyntax, "-- a\nSELECT 1;\n", "SELECT 1;\n"},
+		{"eol,trailing,indent,blank,comments", goSyntax, "\ta := 1  \r\n\r\n  // b\r\n", "a := 1\n"},
+	}
+
+	for _, tt := range tests {
+		normalizations, err := ParseNormalizations(tt.normalizations)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		normalizer := newBlockNormalizer(normalizations, tt.syntax)
+		var b strings.Builder
+		for _, line := range strings.SplitAfter(tt.block, "\n") {
+			if line == "" {
+				continue
+			}
+			b.Write(normalizer.normalize([]byte(line)))
+		}
+
+		if b.String() != tt.want {
+			t.Errorf("%q: normalized %q to %q, want %q", tt.normalizations, tt.block, b.String(), tt.want)
+		}
+	}
+}
+
+func TestParseNormalizations(t *testing.T) {
+	normalizations, err := ParseNormalizations("comments, eol,trailing,eol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatNormalizations(normalizations); got != "eol,trailing,comments" {
+		t.Errorf("got %q, want %q", got, "eol,trailing,comments")
+	}
+
+	_, err = ParseNormalizations("eol,tabs")
+	if err == nil || !strings.Contains(err.Error(), `unknown normalization "tabs"`) {
+		t.Errorf("got error %v, want an unknown normalization", err)
+	}
+}
@@ -0,0 +1,40 @@
+package codemap
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// patterns holds the regular expressions for a particular tag base name.
+type patterns struct {
+	tagBase string
+	// tokenNeeded matches tags without tokens: "end-" of a group end tag (1), "-group" (2) and a line count (3).
+	tokenNeeded *regexp.Regexp
+	token       *regexp.Regexp
+	tokenEnd    *regexp.Regexp
+	groupStart  *regexp.Regexp
+	groupEnd    *regexp.Regexp
+	// anyTag finds the token of every kind of tag, and of the references and group templates of the
+	// built-in DocFormats. References to external repositories have namespaced tokens.
+	anyTag *regexp.Regexp
+
+	// docs are the patterns of each DocFormat, by name; see doc.
+	docs  map[string]*docPatterns
+	docMu sync.Mutex
+}
+
+func newPatterns(tagBase string) *patterns {
+	quoted := regexp.QuoteMeta(tagBase)
+
+	return &patterns{
+		tagBase:     tagBase,
+		tokenNeeded: regexp.MustCompile(fmt.Sprintf(`\[(?:(end-)%s-group|%s(-group(?: lines=(\d+))?)?)]`, quoted, quoted)),
+		token:       regexp.MustCompile(fmt.Sprintf(`^(.*)\[%s:([A-Za-z0-9]+)](.*)$`, quoted)),
+		tokenEnd:    regexp.MustCompile(fmt.Sprintf(`^(.*)\[end-%s:([A-Za-z0-9]+)](.*)$`, quoted)),
+		groupStart:  regexp.MustCompile(fmt.Sprintf(`\[%s-group:([A-Za-z0-9]+)((?::[A-Za-z0-9-]+)*)]`, quoted)),
+		groupEnd:    regexp.MustCompile(fmt.Sprintf(`\[end-%s-group:([A-Za-z0-9]+)(:norm=([^:\]]*))?(:(%s))?]`, quoted, hashPattern)),
+		anyTag:      regexp.MustCompile(fmt.Sprintf(`(?:(?:\[|<!--|\{/\*|// |\.\. )(?:end-)?%[1]s(-group)?:|,\s*%[1]s=)(%[2]s)`, quoted, TokenPattern)),
+		docs:        map[string]*docPatterns{},
+	}
+}
@@ -0,0 +1,282 @@
+package codemap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// GroupPolicy is a rule that the blocks of a group must follow, besides being acked after every change.
+// Policies are set in the configuration file by token, or with attributes on start tags, e.g.
+// "eyecue-codemap-group:TOKEN:identical" (in brackets).
+type GroupPolicy struct {
+	// Identical requires the blocks to have the same content, after their normalizations and Substitute.
+	Identical bool `yaml:"identical"`
+	// Substitute replaces whole words in every block before they're compared, so that blocks that
+	// differ only in names can be required to be identical, e.g. {"bar": "foo", "Bar": "Foo"}.
+	Substitute map[string]string `yaml:"substitute"`
+	// Primary is the file containing the group's primary block. The block may instead have the
+	// "primary" attribute on its start tag. Whenever the primary block changes, every other block
+	// must be acked again.
+	Primary string `yaml:"primary"`
+}
+
+// Start tag attributes
+const (
+	groupAttributeIdentical = "identical"
+	groupAttributePrimary   = "primary"
+)
+
+func (p GroupPolicy) validate() error {
+	if len(p.Substitute) > 0 && !p.Identical {
+		return errors.New("substitute requires identical")
+	}
+
+	for word := range p.Substitute {
+		if !wordRegexp.MatchString(word) {
+			return fmt.Errorf("substitute: %q must be a single word", word)
+		}
+	}
+
+	return nil
+}
+
+var wordRegexp = regexp.MustCompile(`^\w+$`)
+
+// parseGroupAttributes parses the attributes of a start tag, e.g. ":identical:primary".
+func parseGroupAttributes(attributes string) (identical bool, primary bool, err error) {
+	for _, attribute := range strings.Split(attributes, ":") {
+		switch attribute {
+		case "":
+		case groupAttributeIdentical:
+			identical = true
+		case groupAttributePrimary:
+			primary = true
+		default:
+			return false, false, fmt.Errorf(`unknown attribute "%s" (expected %s or %s)`, attribute, groupAttributeIdentical, groupAttributePrimary)
+		}
+	}
+
+	return identical, primary, nil
+}
+
+// groupPolicy combines the configured policy of a group with the attributes on its start tags.
+func (r *runner) groupPolicy(token string, groupInfos []TokenGroupInfo) GroupPolicy {
+	policy := r.opts.GroupPolicies[token]
+
+	for _, groupInfo := range groupInfos {
+		policy.Identical = policy.Identical || groupInfo.Identical
+	}
+
+	return policy
+}
+
+// primaryBlock returns the index of the primary block in groupInfos, or -1 if it has none.
+// Marking more than one block as primary is a problem.
+func (r *runner) primaryBlock(token string, groupInfos []TokenGroupInfo) int {
+	if len(groupInfos) == 0 {
+		return -1
+	}
+
+	policy := r.opts.GroupPolicies[token]
+
+	// The primary file is configured from the project root.
+	var primaryFilename string
+	if policy.Primary != "" {
+		primaryFilename = workingDirPath(r.prefix, policy.Primary)
+	}
+
+	var primaries []int
+	for i, groupInfo := range groupInfos {
+		if groupInfo.primaryAttribute || primaryFilename != "" && groupInfo.FileSource.Filename == primaryFilename {
+			primaries = append(primaries, i)
+		}
+	}
+
+	if policy.Primary != "" && len(primaries) == 0 {
+		r.addProblem(Problem{
+			Kind:     ProblemGroupPolicy,
+			Filename: groupInfos[0].FileSource.Filename,
+			Line:     groupInfos[0].StartLineNumber,
+			Column:   groupInfos[0].StartColumn,
+			Token:    token,
+			Message:  fmt.Sprintf(`group "%s" has no block in its primary file "%s"`, token, policy.Primary),
+		})
+		return -1
+	}
+
+	if len(primaries) > 1 {
+		msg := fmt.Sprintf(`group "%s" has more than one primary block:`, token)
+		var related []Location
+		for _, i := range primaries {
+			msg = fmt.Sprintf("%s\n   %s:%d", msg, groupInfos[i].FileSource.Filename, groupInfos[i].StartLineNumber)
+			related = append(related, groupInfos[i].location())
+		}
+
+		r.addProblem(Problem{
+			Kind:     ProblemGroupPolicy,
+			Filename: groupInfos[primaries[0]].FileSource.Filename,
+			Line:     groupInfos[primaries[0]].StartLineNumber,
+			Column:   groupInfos[primaries[0]].StartColumn,
+			Token:    token,
+			Message:  msg,
+			Related:  related,
+		})
+		return -1
+	}
+
+	if len(primaries) == 0 {
+		return -1
+	}
+
+	return primaries[0]
+}
+
+// applyGroupPolicies sets the ActualHash of each block from its ContentHash. In a group with a primary
+// block, the hashes of the other blocks include the primary's, so that they change whenever it does.
+func (r *runner) applyGroupPolicies(inventory *Inventory) {
+	for _, token := range inventory.sortedGroupTokens() {
+		groupInfos := inventory.GroupsByToken[token]
+
+		primary := r.primaryBlock(token, groupInfos)
+		for i := range groupInfos {
+			groupInfos[i].Primary = i == primary
+		}
+
+		setGroupHashes(groupInfos, primary)
+	}
+}
+
+// setGroupHashes sets the ActualHash of each of groupInfos from the ContentHashes, given the index of
+// the primary block (or -1).
+func setGroupHashes(groupInfos []TokenGroupInfo, primary int) {
+	for i := range groupInfos {
+		groupInfos[i].ActualHash = groupInfos[i].ContentHash
+		if primary != -1 && i != primary {
+			groupInfos[i].ActualHash = combineHashes(groupInfos[i].ContentHash, groupInfos[primary].ContentHash)
+		}
+	}
+}
+
+// combineHashes hashes a block's content hash with the content hash of its group's primary block,
+// in the format of the block's hash.
+func combineHashes(contentHash string, primaryHash string) string {
+	format := hashFormatOf(contentHash)
+
+	hasher := format.newHash()
+	hasher.Write([]byte(contentHash + "\n" + primaryHash + "\n"))
+
+	return format.format(hasher.Sum(nil))
+}
+
+// checkIdenticalBlocks reports the blocks of groups with the Identical policy that differ from the first block.
+func (r *runner) checkIdenticalBlocks(inventory *Inventory) error {
+	for _, token := range inventory.sortedGroupTokens() {
+		groupInfos := inventory.GroupsByToken[token]
+
+		policy := r.groupPolicy(token, groupInfos)
+		if !policy.Identical || len(groupInfos) < 2 {
+			continue
+		}
+
+		substitute := newWordSubstituter(policy.Substitute)
+
+		var first []string
+		for i, groupInfo := range groupInfos {
+			lines, err := r.comparableLines(groupInfo, substitute)
+			if err != nil {
+				return err
+			}
+
+			if i == 0 {
+				first = lines
+				continue
+			}
+
+			difference := firstDifference(first, lines)
+			if difference == "" {
+				continue
+			}
+
+			r.addProblem(Problem{
+				Kind:     ProblemGroupPolicy,
+				Filename: groupInfo.FileSource.Filename,
+				Line:     groupInfo.StartLineNumber,
+				Column:   groupInfo.StartColumn,
+				Token:    token,
+				Message: fmt.Sprintf(`group "%s" must have identical blocks, but %s:%d differs from %s:%d: %s`, token,
+					groupInfo.FileSource.Filename, groupInfo.StartLineNumber,
+					groupInfos[0].FileSource.Filename, groupInfos[0].StartLineNumber,
+					difference),
+				Related: []Location{groupInfos[0].location()},
+			})
+		}
+	}
+
+	return nil
+}
+
+// comparableLines returns the lines of a block after its normalizations and substitute.
+func (r *runner) comparableLines(groupInfo TokenGroupInfo, substitute func(string) string) ([]string, error) {
+	fileBytes, err := r.readFile(groupInfo.FileSource)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to read "%s": %w`, groupInfo.FileSource.Filename, err)
+	}
+
+	normalizer := newBlockNormalizer(groupInfo.Normalizations, r.opts.commentSyntax(groupInfo.FileSource.Filename))
+
+	var lines []string
+	for _, line := range blockLines(fileBytes, groupInfo.StartLineNumber, groupInfo.EndLineNumber) {
+		if len(groupInfo.Normalizations) > 0 {
+			line = normalizer.normalize(line)
+			if line == nil {
+				continue
+			}
+		}
+
+		lines = append(lines, substitute(string(bytes.TrimSuffix(line, []byte("\n")))))
+	}
+
+	return lines, nil
+}
+
+// firstDifference describes the first line where b differs from a, or returns "" if they're the same.
+func firstDifference(a []string, b []string) string {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i >= len(a):
+			return fmt.Sprintf("line %d (%q) is extra", i+1, b[i])
+		case i >= len(b):
+			return fmt.Sprintf("line %d (%q) is missing", i+1, a[i])
+		case a[i] != b[i]:
+			return fmt.Sprintf("line %d is %q instead of %q", i+1, b[i], a[i])
+		}
+	}
+
+	return ""
+}
+
+// newWordSubstituter returns a function that replaces the whole words in substitutions.
+func newWordSubstituter(substitutions map[string]string) func(string) string {
+	if len(substitutions) == 0 {
+		return func(s string) string { return s }
+	}
+
+	words := make([]string, 0, len(substitutions))
+	for word := range substitutions {
+		words = append(words, regexp.QuoteMeta(word))
+	}
+	// Prefer the longest word where one is a prefix of another.
+	sort.Slice(words, func(i, j int) bool { return len(words[i]) > len(words[j]) })
+
+	re := regexp.MustCompile(`\b(?:` + strings.Join(words, "|") + `)\b`)
+
+	return func(s string) string {
+		return re.ReplaceAllStringFunc(s, func(word string) string {
+			return substitutions[word]
+		})
+	}
+}
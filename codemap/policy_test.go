@@ -0,0 +1,110 @@
+package codemap
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPrimaryFile(t *testing.T) {
+	for _, dir := range []string{".", "sub"} {
+		t.Run(dir, func(t *testing.T) {
+			inGitRepo(t, map[string]string{
+				"sub/a.go": "// [" + tagBase + "-group:grpA]\nconst A = 1\n// [end-" + tagBase + "-group:grpA]\n",
+				"sub/b.go": "// [" + tagBase + "-group:grpA]\nconst B = 1\n// [end-" + tagBase + "-group:grpA]\n",
+			})
+			inSubdirectory(t, dir)
+
+			prefix, err := filepath.Rel(dir, "sub")
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := filepath.Join(prefix, "a.go")
+			fileSources := fileSourcesOf(a, filepath.Join(prefix, "b.go"))
+
+			// The primary file is configured from the project root, wherever it's run.
+			opts := Options{GroupPolicies: map[string]GroupPolicy{"grpA": {Primary: "sub/a.go"}}}
+
+			_, err = Ack(opts, fileSources)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			replaceInFile(t, a, "A = 1", "A = 2")
+
+			result, err := Check(opts, fileSources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Problems) != 0 {
+				t.Errorf("got problems %+v, want none", result.Problems)
+			}
+			if len(result.ChangedGroups) != 1 {
+				t.Fatalf("got changed groups %+v, want grpA", result.ChangedGroups)
+			}
+			for _, groupInfo := range result.ChangedGroups[0].Blocks {
+				if groupInfo.Primary != (groupInfo.FileSource.Filename == a) {
+					t.Errorf("%s: got primary %v", groupInfo.FileSource.Filename, groupInfo.Primary)
+				}
+				if !groupInfo.Changed() {
+					t.Errorf("%s: block isn't changed", groupInfo.FileSource.Filename)
+				}
+			}
+		})
+	}
+}
+
+func TestPrimaryFileWithoutBlock(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"a.go": "// [" + tagBase + "-group:grpA]\nconst A = 1\n// [end-" + tagBase + "-group:grpA]\n",
+		"b.go": "// [" + tagBase + "-group:grpA]\nconst B = 1\n// [end-" + tagBase + "-group:grpA]\n",
+	})
+
+	opts := Options{GroupPolicies: map[string]GroupPolicy{"grpA": {Primary: "c.go"}}}
+	result, err := Check(opts, fileSourcesOf("a.go", "b.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasProblem(result.Problems, `group "grpA" has no block in its primary file "c.go"`) {
+		t.Errorf("got problems %+v, want no block in the primary file", result.Problems)
+	}
+}
+
+func TestIdenticalBlocks(t *testing.T) {
+	block := func(attributes string, content string) string {
+		return "// [" + tagBase + "-group:grpA" + attributes + "]\n" + content + "// [end-" + tagBase + "-group:grpA]\n"
+	}
+
+	tests := []struct {
+		name     string
+		a        string
+		b        string
+		policies map[string]GroupPolicy
+		want     string
+	}{
+		{"identical", block(":identical", "x := 1\n"), block("", "x := 1\n"), nil, ""},
+		{"different", block(":identical", "x := 1\n"), block("", "x := 2\n"), nil, `line 1 is "x := 2" instead of "x := 1"`},
+		{"missing line", block("", "x := 1\ny := 2\n"), block("", "x := 1\n"),
+			map[string]GroupPolicy{"grpA": {Identical: true}}, `line 2 ("y := 2") is missing`},
+		{"without the policy", block("", "x := 1\n"), block("", "x := 2\n"), nil, ""},
+		{"substitute", block("", "fooBar := Foo()\n"), block("", "fooBar := Bar()\n"),
+			map[string]GroupPolicy{"grpA": {Identical: true, Substitute: map[string]string{"Bar": "Foo"}}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t, map[string]string{"a.go": tt.a, "b.go": tt.b})
+
+			result, err := Check(Options{GroupPolicies: tt.policies}, fileSourcesOf("a.go", "b.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == "" && len(result.Problems) != 0 {
+				t.Errorf("got problems %+v, want none", result.Problems)
+			}
+			if tt.want != "" && !hasProblem(result.Problems, tt.want) {
+				t.Errorf("got problems %+v, want %q", result.Problems, tt.want)
+			}
+		})
+	}
+}
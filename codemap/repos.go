@@ -0,0 +1,277 @@
+package codemap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Repository is another Git repository whose files are linked to from the project's Markdown: a submodule,
+// whose files are listed with the project's, or an external repository, whose single tags are referenced
+// with its name as a namespace, e.g. <!--eyecue-codemap:api/4vov64BcsXn-->. See Options.Repositories.
+type Repository struct {
+	// Name is the namespace of an external repository's tokens. Submodules don't have one.
+	Name string
+	// Path is the repository's working directory, absolute or relative to the working directory.
+	Path string
+	// LinkStyle decides how links to the repository's files are written. Paths in links are relative to
+	// the repository's root, except for relative links, which go through Path. The zero value links relatively.
+	LinkStyle LinkStyle
+}
+
+// RepositoryConfig is an external repository in the project configuration file.
+type RepositoryConfig struct {
+	// Path is the repository's local checkout, absolute or relative to the project root.
+	Path string `yaml:"path"`
+	// LinkStyle defaults to the project's kind of link, to the repository's "origin" remote and its current branch.
+	LinkStyle LinkStyle `yaml:"link-style"`
+}
+
+var repositoryNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func (c RepositoryConfig) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+
+	err := c.LinkStyle.validate()
+	if err != nil {
+		return fmt.Errorf("link-style: %w", err)
+	}
+
+	return nil
+}
+
+// Submodules lists the checked-out submodules of the repository in the working directory, including
+// nested ones. Their paths are relative to the working directory.
+func Submodules() ([]Repository, error) {
+	cmd := exec.Command("git", "submodule", "--quiet", "foreach", "--recursive", `printf '%s\0' "$displaypath"`)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git submodule foreach: %w", err)
+	}
+
+	var repos []Repository
+	for _, path := range splitNulDelimited(output) {
+		repos = append(repos, Repository{Path: path})
+	}
+
+	return repos, nil
+}
+
+// ReadFilenames lists the tracked and untracked (but not ignored) files in the repository, like
+// ReadFilenamesFromGit. Their names start with the repository's Path.
+func (repo Repository) ReadFilenames() ([]FileSource, error) {
+	names, err := repo.filenames()
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.fileSources(names)
+}
+
+func (repo Repository) filenames() ([]string, error) {
+	cmd := exec.Command("git", "-C", repo.Path, "ls-files", "--cached", "--others", "--exclude-standard", "-z")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run git ls-files in %s: %s: %w", repo.Path, strings.TrimSpace(string(output)), err)
+	}
+
+	return splitNulDelimited(output), nil
+}
+
+// fileSources returns the files with the given names in the repository that exist and are regular files.
+func (repo Repository) fileSources(names []string) ([]FileSource, error) {
+	var fileSources []FileSource
+
+	for _, name := range names {
+		filename := path.Join(filepath.ToSlash(repo.Path), name)
+
+		shouldInclude, err := shouldIncludeFile(filename)
+		// Tracked files that have been deleted from the working directory are still listed.
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if shouldInclude {
+			fileSources = append(fileSources, FileSource{Filename: filename})
+		}
+	}
+
+	return fileSources, nil
+}
+
+// ResolveFromGit completes the repository's LinkStyle. The kind of link (and its template) defaults to
+// projectStyle's. For links to a web URL, a missing RepoURL is filled in from the repository's "origin"
+// remote, and a missing Ref from its current branch, or its current commit SHA if it's pinned or
+// isn't on a branch (as submodules usually aren't).
+func (repo *Repository) ResolveFromGit(projectStyle LinkStyle) error {
+	style := &repo.LinkStyle
+
+	if style.Kind == "" {
+		style.Kind = projectStyle.Kind
+		if style.Template == "" {
+			style.Template = projectStyle.Template
+		}
+		style.Pin = style.Pin || projectStyle.Pin
+	}
+
+	if style.Kind == LinkRelative || style.Kind == "" {
+		return nil
+	}
+
+	if style.Ref == "" && !style.Pin {
+		branch, err := gitOutputIn(repo.Path, "rev-parse", "--abbrev-ref", "HEAD")
+		if err != nil {
+			return err
+		}
+
+		if branch == "HEAD" {
+			style.Pin = true
+		} else {
+			style.Ref = branch
+		}
+	}
+
+	return style.resolveFromGit(repo.Path)
+}
+
+// inventoryRepositories adds the single tags of the external repositories to inventory.ExternalSinglesByToken.
+// The repositories are only read: their tags without tokens are left alone, and their problems are theirs
+// to report. Files are excluded by DefaultExclude and each repository's own IgnoreFilename.
+func (r *runner) inventoryRepositories(inventory *Inventory) error {
+	for _, repo := range r.opts.Repositories {
+		if repo.Name == "" {
+			continue
+		}
+
+		fileSources, err := repo.filteredFileSources()
+		if err != nil {
+			return fmt.Errorf("repository %s: %w", repo.Name, err)
+		}
+
+		repoOpts := r.opts
+		repoOpts.FileSystem = nil
+		repoOpts.Repositories = nil
+
+		repoRunner := &runner{
+			opts:     repoOpts,
+			mode:     ModeCheck,
+			fs:       repoOpts.fileSystem(),
+			patterns: r.patterns,
+			linker:   r.linker,
+			result:   &Result{},
+			prefix:   r.prefix,
+		}
+
+		repoInventory, err := repoRunner.inventoryFiles(fileSources)
+		if err != nil {
+			return fmt.Errorf("repository %s: %w", repo.Name, err)
+		}
+
+		for token, locs := range repoInventory.SinglesByToken {
+			namespaced := repo.Name + "/" + token
+			inventory.ExternalSinglesByToken[namespaced] = append(inventory.ExternalSinglesByToken[namespaced], locs...)
+		}
+	}
+
+	return nil
+}
+
+func (repo Repository) filteredFileSources() ([]FileSource, error) {
+	ignorePatterns, err := ReadPatternFile(filepath.Join(repo.Path, IgnoreFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := newFileFilter(Options{Exclude: ignorePatterns}, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", IgnoreFilename, err)
+	}
+
+	names, err := repo.filenames()
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []string
+	for _, fileSource := range filter.filter(namesToFileSources(names)) {
+		kept = append(kept, fileSource.Filename)
+	}
+
+	return repo.fileSources(kept)
+}
+
+func namesToFileSources(names []string) []FileSource {
+	fileSources := make([]FileSource, len(names))
+	for i, name := range names {
+		fileSources[i] = FileSource{Filename: name}
+	}
+
+	return fileSources
+}
+
+// repositories returns the external repositories in the configuration file, in name order. Their paths
+// are converted from the project root to the working directory.
+func (c *ProjectConfig) repositories() []Repository {
+	names := make([]string, 0, len(c.Repositories))
+	for name := range c.Repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prefix := ProjectPrefix()
+
+	var repos []Repository
+	for _, name := range names {
+		repoConfig := c.Repositories[name]
+
+		repoPath := filepath.Clean(repoConfig.Path)
+		if !filepath.IsAbs(repoPath) {
+			repoPath = workingDirPath(prefix, filepath.ToSlash(repoPath))
+		}
+
+		repos = append(repos, Repository{
+			Name:      name,
+			Path:      repoPath,
+			LinkStyle: repoConfig.LinkStyle,
+		})
+	}
+
+	return repos
+}
+
+func hasRepository(repos []Repository, name string) bool {
+	for _, repo := range repos {
+		if repo.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathInRepository returns filename relative to the repository at dir, if it's in it.
+func pathInRepository(dir string, filename string) (string, bool) {
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	filename = filepath.ToSlash(filepath.Clean(filename))
+
+	if dir == "." {
+		return filename, true
+	}
+
+	if !strings.HasPrefix(filename, dir+"/") {
+		return "", false
+	}
+
+	return filename[len(dir)+1:], true
+}
@@ -0,0 +1,93 @@
+package codemap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositoriesPathFromProjectRoot(t *testing.T) {
+	inGitRepo(t, map[string]string{"docs/guide/README.md": ""})
+
+	config := &ProjectConfig{Repositories: map[string]RepositoryConfig{
+		"api":  {Path: "../api"},
+		"abs":  {Path: "/src/lib/"},
+		"vend": {Path: "vendor/x"},
+	}}
+
+	tests := []struct {
+		dir  string
+		want map[string]string
+	}{
+		{".", map[string]string{"abs": "/src/lib", "api": "../api", "vend": "vendor/x"}},
+		{"docs/guide", map[string]string{"abs": "/src/lib", "api": "../../../api", "vend": "../../vendor/x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Chdir(tt.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.Chdir(wd) }()
+
+			for _, repo := range config.repositories() {
+				if repo.Path != filepath.FromSlash(tt.want[repo.Name]) {
+					t.Errorf("%s: got path %q, want %q", repo.Name, repo.Path, tt.want[repo.Name])
+				}
+			}
+		})
+	}
+}
+
+func TestExternalRepository(t *testing.T) {
+	libDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := inGitRepo(t, map[string]string{
+		"doc.md": "See [b<!--" + tagBase + ":lib/tokL-->]() and [i<!--" + tagBase + ":lib/tokI-->]().\n",
+	})
+
+	libFiles := map[string]string{}
+	for name, content := range map[string]string{
+		"src/b.go":     "package b\n\n// [" + tagBase + ":tokL]\nvar b = 1\n",
+		"src/c.go":     "package c\n\n// [" + tagBase + "]\nvar c = 1\n",
+		"ignored/i.go": "package i\n\n// [" + tagBase + ":tokI]\nvar i = 1\n",
+		IgnoreFilename: "ignored/\n",
+	} {
+		libFiles[filepath.Join(libDir, name)] = content
+	}
+	writeFiles(t, libFiles)
+	git(t, "-C", libDir, "init", "-q")
+
+	libPath, err := filepath.Rel(dir, libDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Repositories: []Repository{{Name: "lib", Path: libPath}}}
+
+	result, err := Update(opts, fileSourcesOf("doc.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Relative links go through the repository's path. Its ignored files aren't read.
+	want := "See [b<!--" + tagBase + ":lib/tokL-->](" + filepath.ToSlash(libPath) + "/src/b.go#L4) and [i<!--" + tagBase + ":lib/tokI-->]().\n"
+	if got := readFile(t, "doc.md"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !hasProblem(result.Problems, `"lib/tokI"`) {
+		t.Errorf("got problems %+v, want lib/tokI not found", result.Problems)
+	}
+
+	// The repository is only read: its new tags aren't given tokens.
+	if got := readFile(t, filepath.Join(libDir, "src", "c.go")); got != "package c\n\n// ["+tagBase+"]\nvar c = 1\n" {
+		t.Errorf("got %q, want c.go unchanged", got)
+	}
+}
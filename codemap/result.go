@@ -0,0 +1,108 @@
+package codemap
+
+// ProblemKind identifies the category of a Problem.
+type ProblemKind string
+
+const (
+	ProblemDuplicateToken        ProblemKind = "duplicate-token"
+	ProblemTokenNotFound         ProblemKind = "token-not-found"
+	ProblemGroupNotFound         ProblemKind = "group-not-found"
+	ProblemIncorrectLink         ProblemKind = "incorrect-link"
+	ProblemMalformedReference    ProblemKind = "malformed-reference"
+	ProblemIncorrectGroupContent ProblemKind = "incorrect-group-content"
+	ProblemGroupPolicy           ProblemKind = "group-policy"
+
+	// Unused tokens and changed groups are reported in Result.UnusedTokens and
+	// Result.ChangedGroups rather than Result.Problems, but have kinds for use in reports.
+	ProblemUnusedToken  ProblemKind = "unused-token"
+	ProblemGroupChanged ProblemKind = "group-changed"
+)
+
+// Location is a position within a file. Line and Column are 1-based; Column counts bytes.
+type Location struct {
+	Filename string
+	Line     int
+	Column   int
+}
+
+// Problem is something wrong with the files that needs a person's attention.
+type Problem struct {
+	Kind     ProblemKind
+	Filename string
+	Line     int
+	Column   int
+	Token    string
+	Message  string
+	// Related lists other locations involved in the problem, such as every use of a duplicate token.
+	Related []Location
+}
+
+// ChangeKind identifies the category of a Change.
+type ChangeKind string
+
+const (
+	ChangeTokenAdded           ChangeKind = "token-added"
+	ChangeGroupEndAdded        ChangeKind = "group-end-added"
+	ChangeLinkUpdated          ChangeKind = "link-updated"
+	ChangeGroupTemplateUpdated ChangeKind = "group-template-updated"
+	ChangeGroupAcked           ChangeKind = "group-acked"
+	ChangeGroupHashMigrated    ChangeKind = "group-hash-migrated"
+)
+
+// Change is a modification made to a file by an update or ack.
+type Change struct {
+	Kind     ChangeKind
+	Filename string
+	Line     int
+	Column   int
+	Token    string
+	Message  string
+}
+
+// Reference is a token link or group template found in a Markdown file.
+type Reference struct {
+	Token string
+	// Group is set for group templates.
+	Group bool
+	Location
+}
+
+type UnusedToken struct {
+	Token string
+	TokenLocation
+}
+
+// GroupStatus lists every block of a group that has at least one changed block.
+type GroupStatus struct {
+	Token  string
+	Blocks []TokenGroupInfo
+}
+
+type Result struct {
+	Inventory     *Inventory
+	Changes       []Change
+	Problems      []Problem
+	UnusedTokens  []UnusedToken
+	ChangedGroups []GroupStatus
+	FilesWritten  []string
+	// References are the references in the Markdown files that were processed, in order.
+	References []Reference
+}
+
+func (r *runner) addChange(change Change) {
+	r.mu.Lock()
+	r.result.Changes = append(r.result.Changes, change)
+	r.mu.Unlock()
+}
+
+func (r *runner) addProblem(problem Problem) {
+	r.mu.Lock()
+	r.result.Problems = append(r.result.Problems, problem)
+	r.mu.Unlock()
+}
+
+func (r *runner) addReference(reference Reference) {
+	r.mu.Lock()
+	r.result.References = append(r.result.References, reference)
+	r.mu.Unlock()
+}
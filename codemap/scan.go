@@ -1,4 +1,4 @@
-package main
+package codemap
 
 import "bytes"
 
@@ -35,3 +35,11 @@ func scanNullDelimited(data []byte, atEOF bool) (advance int, token []byte, err
 	// Request more data.
 	return 0, nil, nil
 }
+
+// lineAndColumn converts a byte offset in data to a 1-based line and column.
+func lineAndColumn(data []byte, offset int) (line int, column int) {
+	line = bytes.Count(data[:offset], []byte("\n")) + 1
+	column = offset - bytes.LastIndexByte(data[:offset], '\n')
+
+	return line, column
+}
@@ -0,0 +1,337 @@
+package codemap
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Session keeps the inventory of a set of files between runs, so that a run after
+// some files have changed only has to read those files (and the Markdown files that
+// refer to them) again.
+type Session struct {
+	opts     Options
+	mode     Mode
+	patterns *patterns
+	linker   *linker
+	filter   *fileFilter
+	prefix   string
+
+	inventory *Inventory
+	// references are the references found in each Markdown file, by filename. Markdown files
+	// that haven't been processed yet (e.g. because of duplicate tokens) have no entry.
+	references map[string][]Reference
+	// problems are the problems found in each Markdown file when it was last processed, by filename.
+	problems map[string][]Problem
+}
+
+func NewSession(opts Options, mode Mode) (*Session, error) {
+	prefix := ProjectPrefix()
+
+	linker, err := newLinker(opts.LinkStyle, opts.Repositories, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := newFileFilter(opts, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, normalization := range opts.GroupNormalize {
+		if !isNormalization(normalization) {
+			return nil, fmt.Errorf(`unknown group normalization "%s" (expected one of %s)`, normalization, normalizationNames())
+		}
+	}
+
+	if opts.Changed != nil && mode != ModeCheck && mode != ModeUpdate {
+		return nil, fmt.Errorf("only %s and %s can be limited to changes, not %s", ModeCheck, ModeUpdate, mode)
+	}
+
+	if opts.GroupHash != "" && !opts.GroupHash.valid() {
+		return nil, fmt.Errorf(`unknown group hash format "%s" (expected one of %s)`, opts.GroupHash, hashFormatNames())
+	}
+
+	return &Session{
+		opts:       opts,
+		mode:       mode,
+		patterns:   newPatterns(opts.tagBase()),
+		linker:     linker,
+		filter:     filter,
+		prefix:     prefix,
+		references: map[string][]Reference{},
+		problems:   map[string][]Problem{},
+	}, nil
+}
+
+func (s *Session) newRunner() *runner {
+	return &runner{
+		opts:     s.opts,
+		mode:     s.mode,
+		fs:       s.opts.fileSystem(),
+		patterns: s.patterns,
+		linker:   s.linker,
+		result:   &Result{},
+		prefix:   s.prefix,
+	}
+}
+
+// Load inventories fileSources and processes them like Run.
+func (s *Session) Load(fileSources []FileSource) (*Result, error) {
+	r := s.newRunner()
+
+	inventory, err := r.inventoryFiles(s.filter.filter(fileSources))
+	if err != nil {
+		return nil, err
+	}
+
+	s.inventory = inventory
+	s.references = map[string][]Reference{}
+	s.problems = map[string][]Problem{}
+
+	if s.opts.Changed != nil {
+		return s.processChanges(r, s.opts.Changed)
+	}
+
+	return s.process(r, nil, nil)
+}
+
+// processChanges processes the Markdown files that changed or refer to tokens affected by changes,
+// and reports only on those tokens and groups.
+func (s *Session) processChanges(r *runner, changes *ChangeSet) (*Result, error) {
+	changedFiles, affectedTokens := changes.scope(s.inventory)
+
+	// The other Markdown files are treated as processed, with no references that matter.
+	for _, fileSource := range s.inventory.MarkdownFileSources {
+		if _, isChanged := changedFiles[fileSource.Filename]; isChanged {
+			continue
+		}
+
+		fileBytes, err := r.readFile(fileSource)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to read "%s": %w`, fileSource.Filename, err)
+		}
+
+		if !s.mentionsAny(fileBytes, affectedTokens) {
+			s.references[fileSource.Filename] = []Reference{}
+		}
+	}
+
+	result, err := s.process(r, changedFiles, affectedTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	r.limitToTokens(affectedTokens)
+
+	return result, nil
+}
+
+// mentionsAny reports whether fileBytes has a tag or reference with any of tokens.
+func (s *Session) mentionsAny(fileBytes []byte, tokens map[string]struct{}) bool {
+	for _, m := range s.patterns.anyTag.FindAllSubmatch(fileBytes, -1) {
+		if _, ok := tokens[string(m[2])]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Refresh re-inventories the changed files and forgets the removed ones. It then processes
+// the Markdown files that changed or that refer to tokens in the changed or removed files,
+// and all the groups. Problems in the other Markdown files aren't reported again.
+//
+// Result.Inventory is shared with the session, and is modified by later calls to Refresh.
+func (s *Session) Refresh(changed []FileSource, removed []string) (*Result, error) {
+	if s.inventory == nil {
+		return nil, errors.New("session has not been loaded")
+	}
+
+	r := s.newRunner()
+
+	changed = s.filter.filter(changed)
+
+	affectedTokens := make(map[string]struct{})
+	changedFiles := make(map[string]struct{})
+
+	for _, filename := range removed {
+		s.inventory.fileTokens(filename, affectedTokens)
+		s.inventory.removeFile(filename)
+		delete(s.references, filename)
+		delete(s.problems, filename)
+	}
+
+	for _, fileSource := range changed {
+		s.inventory.fileTokens(fileSource.Filename, affectedTokens)
+		s.inventory.removeFile(fileSource.Filename)
+		changedFiles[fileSource.Filename] = struct{}{}
+	}
+
+	for _, fileSource := range changed {
+		err := r.inventoryFileAndGenerateTokens(fileSource, s.inventory)
+		if err != nil {
+			return nil, err
+		}
+
+		s.inventory.fileTokens(fileSource.Filename, affectedTokens)
+	}
+
+	s.inventory.sort()
+
+	return s.process(r, changedFiles, affectedTokens)
+}
+
+// process checks the tokens, then processes the Markdown files that haven't been processed yet,
+// changed, or refer to any of affectedTokens, and then the groups.
+func (s *Session) process(r *runner, changedFiles map[string]struct{}, affectedTokens map[string]struct{}) (*Result, error) {
+	r.result.Inventory = s.inventory
+
+	ok, err := r.checkTokens(s.inventory)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return r.result, nil
+	}
+
+	var mdFileSources []FileSource
+	var otherReferences []Reference
+
+	for _, fileSource := range s.inventory.MarkdownFileSources {
+		references, processed := s.references[fileSource.Filename]
+		_, isChanged := changedFiles[fileSource.Filename]
+
+		if !processed || isChanged || refersToAny(references, affectedTokens) {
+			mdFileSources = append(mdFileSources, fileSource)
+		} else {
+			otherReferences = append(otherReferences, references...)
+		}
+	}
+
+	for _, fileSource := range mdFileSources {
+		err := r.processMarkdownFile(fileSource, s.inventory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.recordMarkdown(r, mdFileSources)
+
+	r.findUnusedTokens(s.inventory, append(otherReferences, r.result.References...))
+
+	err = r.processTokenGroups(s.inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.result, nil
+}
+
+// recordMarkdown remembers the references and problems that r found in each of mdFileSources.
+func (s *Session) recordMarkdown(r *runner, mdFileSources []FileSource) {
+	for _, fileSource := range mdFileSources {
+		s.references[fileSource.Filename] = []Reference{}
+		delete(s.problems, fileSource.Filename)
+	}
+
+	for _, reference := range r.result.References {
+		s.references[reference.Filename] = append(s.references[reference.Filename], reference)
+	}
+
+	for _, problem := range r.result.Problems {
+		s.problems[problem.Filename] = append(s.problems[problem.Filename], problem)
+	}
+}
+
+// Inventory returns the current inventory. It is modified by Refresh.
+func (s *Session) Inventory() *Inventory {
+	return s.inventory
+}
+
+// References returns the references to token in the Markdown files, in filename and line order.
+func (s *Session) References(token string) []Reference {
+	var references []Reference
+
+	for _, fileReferences := range s.references {
+		for _, reference := range fileReferences {
+			if reference.Token == token {
+				references = append(references, reference)
+			}
+		}
+	}
+
+	sortLocations(references, func(i int) Location { return references[i].Location })
+
+	return references
+}
+
+// MarkdownProblems returns the problems found in each Markdown file when it was last processed,
+// in filename and line order.
+func (s *Session) MarkdownProblems() []Problem {
+	var problems []Problem
+
+	for _, fileProblems := range s.problems {
+		problems = append(problems, fileProblems...)
+	}
+
+	sortLocations(problems, func(i int) Location {
+		return Location{Filename: problems[i].Filename, Line: problems[i].Line, Column: problems[i].Column}
+	})
+
+	return problems
+}
+
+func sortLocations(slice interface{}, location func(i int) Location) {
+	sort.SliceStable(slice, func(i, j int) bool {
+		a, b := location(i), location(j)
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// Tag is a tag in code, or a reference in Markdown, found by TagsInLine.
+type Tag struct {
+	Token string
+	// Group is set for group tags and group templates.
+	Group bool
+	// Column and EndColumn are the 1-based byte offsets of the start of the tag and the end of its token.
+	Column    int
+	EndColumn int
+}
+
+// TagsInLine finds the tags and references in a line of any file.
+func (s *Session) TagsInLine(line string) []Tag {
+	var tags []Tag
+
+	for _, m := range s.patterns.anyTag.FindAllStringSubmatchIndex(line, -1) {
+		tags = append(tags, Tag{
+			Token:     line[m[4]:m[5]],
+			Group:     m[2] != -1,
+			Column:    m[0] + 1,
+			EndColumn: m[1] + 1,
+		})
+	}
+
+	return tags
+}
+
+// AckGroupEnd returns line, the end tag line of groupInfo, rewritten to acknowledge the block's current content.
+func (s *Session) AckGroupEnd(line string, groupInfo TokenGroupInfo) string {
+	return string(s.patterns.ackGroupEnd([]byte(line), groupInfo))
+}
+
+func refersToAny(references []Reference, tokens map[string]struct{}) bool {
+	for _, reference := range references {
+		if _, ok := tokens[reference.Token]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -4,6 +4,9 @@ go 1.16
 
 require (
 	github.com/akamensky/base58 v0.0.0-20210829145138-ce8bf8802e8f
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/mattn/go-isatty v0.0.14
 	golang.org/x/sync v0.1.0
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
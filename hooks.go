@@ -0,0 +1,579 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+	"gopkg.in/yaml.v3"
+)
+
+// The lines that install-hooks adds to a file are surrounded by these markers, so that it can replace
+// them and uninstall-hooks can remove them.
+const (
+	hookMarkerStart = "# >>> eyecue-codemap >>>"
+	hookMarkerEnd   = "# <<< eyecue-codemap <<<"
+)
+
+const defaultHookCommand = "eyecue-codemap"
+
+// hookArgs make the hooks check the files that are about to be committed.
+const hookArgs = "--git-index --check-only"
+
+// hookID is the name of the hook in the configuration of hook managers.
+const hookID = "eyecue-codemap"
+
+const (
+	huskyDirname            = ".husky"
+	preCommitConfigFilename = ".pre-commit-config.yaml"
+)
+
+var lefthookFilenames = []string{"lefthook.yml", ".lefthook.yml", "lefthook.yaml", ".lefthook.yaml"}
+
+// huskyHelperLine sets up the environment in the hook scripts of husky versions before 9.
+const huskyHelperLine = `. "$(dirname -- "$0")/_/husky.sh"`
+
+const huskyHeader = "#!/usr/bin/env sh\n" + huskyHelperLine + "\n"
+
+// hookNames are the Git hooks to install.
+func (c Config) hookNames() []string {
+	if c.HookPrePush {
+		return []string{"pre-commit", "pre-push"}
+	}
+
+	return []string{"pre-commit"}
+}
+
+// hookLine is the command that the hooks run.
+func (c Config) hookLine() string {
+	command := c.HookCommand
+	if command == "" {
+		command = defaultHookCommand
+	}
+
+	return command + " " + hookArgs
+}
+
+// installHooks adds a check to the hook manager that the repo uses (husky, lefthook or pre-commit),
+// or else to the scripts in the Git hooks directory.
+func installHooks(config Config) error {
+	root := codemap.ProjectRoot()
+
+	if isDir(filepath.Join(root, huskyDirname)) {
+		header := "#!/bin/sh\n"
+		if _, err := os.Stat(filepath.Join(root, huskyDirname, "_", "husky.sh")); err == nil {
+			header = huskyHeader
+		}
+
+		for _, hook := range config.hookNames() {
+			err := installScriptHook(root, filepath.Join(huskyDirname, hook), header, config.hookLine())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if filename := findLefthookConfig(root); filename != "" {
+		err := editHookFile(root, filename, func(content []byte) ([]byte, error) {
+			for _, hook := range config.hookNames() {
+				var err error
+				content, err = lefthookConfigWithHook(content, hook, config.hookLine())
+				if err != nil {
+					return nil, err
+				}
+			}
+			return content, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(out, "Run \"lefthook install\" if the hooks aren't installed yet")
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(root, preCommitConfigFilename)); err == nil {
+		err := editHookFile(root, preCommitConfigFilename, func(content []byte) ([]byte, error) {
+			return preCommitConfigWithHook(content, config.hookNames(), config.hookLine())
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, hook := range config.hookNames() {
+			fmt.Fprintf(out, "Run \"pre-commit install --hook-type %s\" if the hook isn't installed yet\n", hook)
+		}
+		return nil
+	}
+
+	hooksDir, err := gitHooksDir(root)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range config.hookNames() {
+		err := installScriptHook(root, filepath.Join(hooksDir, hook), "#!/bin/sh\n", config.hookLine())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uninstallHooks removes the lines added by installHooks from every file it might have added them to.
+func uninstallHooks() error {
+	root := codemap.ProjectRoot()
+
+	hooksDir, err := gitHooksDir(root)
+	if err != nil {
+		return err
+	}
+
+	var scripts []string
+	for _, hook := range []string{"pre-commit", "pre-push"} {
+		scripts = append(scripts, filepath.Join(hooksDir, hook), filepath.Join(huskyDirname, hook))
+	}
+
+	removed := false
+
+	for _, filename := range scripts {
+		found, err := uninstallScriptHook(root, filename)
+		if err != nil {
+			return err
+		}
+		removed = removed || found
+	}
+
+	for _, filename := range append([]string{preCommitConfigFilename}, lefthookFilenames...) {
+		path := filepath.Join(root, filename)
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		newContent, found := withoutHookBlocks(content)
+		if !found {
+			continue
+		}
+
+		err = os.WriteFile(path, newContent, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Removed eyecue-codemap from %s\n", filename)
+		removed = true
+	}
+
+	if !removed {
+		fmt.Fprintln(out, "No eyecue-codemap hooks were found")
+	}
+
+	return nil
+}
+
+// gitHooksDir returns the directory that Git runs hooks from, taking core.hooksPath into account.
+// It is relative to root unless core.hooksPath is absolute.
+func gitHooksDir(root string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--git-path", "hooks")
+	cmd.Dir = root
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the Git hooks directory: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+func findLefthookConfig(root string) string {
+	for _, filename := range lefthookFilenames {
+		if _, err := os.Stat(filepath.Join(root, filename)); err == nil {
+			return filename
+		}
+	}
+
+	return ""
+}
+
+// rootPath returns the path of filename, which is relative to root unless it's absolute.
+func rootPath(root string, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+
+	return filepath.Join(root, filename)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// hookBlock surrounds lines with the hook markers, each with the given indentation.
+func hookBlock(indent string, lines ...string) string {
+	var b strings.Builder
+	for _, line := range append(append([]string{hookMarkerStart}, lines...), hookMarkerEnd) {
+		b.WriteString(indent + line + "\n")
+	}
+
+	return b.String()
+}
+
+// withoutHookBlocks removes the lines between hook markers, and reports whether there were any.
+func withoutHookBlocks(content []byte) ([]byte, bool) {
+	var b strings.Builder
+	inBlock, found := false, false
+
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		switch strings.TrimSpace(line) {
+		case hookMarkerStart:
+			inBlock, found = true, true
+			continue
+		case hookMarkerEnd:
+			inBlock = false
+			continue
+		}
+
+		if !inBlock {
+			b.WriteString(line)
+		}
+	}
+
+	return []byte(b.String()), found
+}
+
+// editHookFile replaces the hook block in filename (relative to root) using edit, which is given the
+// content without any previous block.
+func editHookFile(root string, filename string, edit func([]byte) ([]byte, error)) error {
+	path := rootPath(root, filename)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	content, replaced := withoutHookBlocks(content)
+
+	content, err = edit(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		return err
+	}
+
+	if replaced {
+		fmt.Fprintf(out, "Updated eyecue-codemap in %s\n", filename)
+	} else {
+		fmt.Fprintf(out, "Added eyecue-codemap to %s\n", filename)
+	}
+
+	return nil
+}
+
+// installScriptHook adds the hook line to the start of a hook script, or creates the script with header.
+// An existing script is chained into rather than replaced, so it must be a shell script.
+func installScriptHook(root string, filename string, header string, line string) error {
+	path := rootPath(root, filename)
+
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(path, []byte(header+hookBlock("", line+" || exit $?")), 0755)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Created %s\n", filename)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return editHookFile(root, filename, func(content []byte) ([]byte, error) {
+		return scriptWithHook(content, line)
+	})
+}
+
+// scriptWithHook adds the hook line after the shebang of a shell script, so that it runs even if the
+// script exits early.
+func scriptWithHook(script []byte, line string) ([]byte, error) {
+	lines := strings.SplitAfter(string(script), "\n")
+
+	var shebang string
+	if strings.HasPrefix(lines[0], "#!") {
+		shebang = lines[0]
+		lines = lines[1:]
+
+		if !isShellShebang(shebang) {
+			return nil, fmt.Errorf(`can't chain into a script run by "%s"; add "%s" to it instead`,
+				strings.TrimSpace(strings.TrimPrefix(shebang, "#!")), line)
+		}
+		if !strings.HasSuffix(shebang, "\n") {
+			shebang += "\n"
+		}
+	}
+
+	// Keep the husky helper before the hook, as it sets up the environment.
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == huskyHelperLine {
+		shebang += lines[0]
+		lines = lines[1:]
+	}
+
+	return []byte(shebang + hookBlock("", line+" || exit $?") + strings.Join(lines, "")), nil
+}
+
+// isShellShebang reports whether the shebang line runs a POSIX-like shell, e.g. "#!/bin/sh" or
+// "#!/usr/bin/env bash".
+func isShellShebang(shebang string) bool {
+	fields := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(fields) == 0 {
+		return false
+	}
+
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				interpreter = filepath.Base(field)
+				break
+			}
+		}
+	}
+
+	return strings.HasSuffix(interpreter, "sh")
+}
+
+// uninstallScriptHook removes the hook block from a hook script, deleting the script if nothing else is left.
+func uninstallScriptHook(root string, filename string) (bool, error) {
+	path := rootPath(root, filename)
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	content, found := withoutHookBlocks(content)
+	if !found {
+		return false, nil
+	}
+
+	if isEmptyScript(content) {
+		err = os.Remove(path)
+		if err != nil {
+			return false, err
+		}
+
+		fmt.Fprintf(out, "Deleted %s\n", filename)
+		return true, nil
+	}
+
+	err = os.WriteFile(path, content, 0755)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(out, "Removed eyecue-codemap from %s\n", filename)
+	return true, nil
+}
+
+// isEmptyScript reports whether a hook script does nothing but start, as installScriptHook creates it.
+func isEmptyScript(content []byte) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#!") && line != huskyHelperLine {
+			return false
+		}
+	}
+
+	return true
+}
+
+// preCommitConfigWithHook adds a local hook to a pre-commit framework configuration, at the end of its repos.
+// The file is edited as text so that its formatting and comments are kept.
+func preCommitConfigWithHook(content []byte, hooks []string, line string) ([]byte, error) {
+	hookLines := []string{
+		"- repo: local",
+		"  hooks:",
+		"    - id: " + hookID,
+		"      name: " + hookID,
+		"      entry: " + yamlScalar(line),
+		"      language: system",
+		"      pass_filenames: false",
+		"      always_run: true",
+		"      stages: [" + strings.Join(hooks, ", ") + "]",
+	}
+
+	root, err := yamlRootMapping(content)
+	if err != nil {
+		return nil, err
+	}
+
+	i := yamlMappingValue(root, "repos")
+	if i == -1 {
+		return insertYAMLLines(content, -1, "", append([]string{"repos:"}, indentLines("  ", hookLines)...)), nil
+	}
+
+	repos := root.Content[i]
+	end := yamlValueEnd(root, i, -1)
+
+	switch {
+	case repos.Kind == yaml.SequenceNode && repos.Style&yaml.FlowStyle == 0 && len(repos.Content) > 0:
+		// The column of an item follows its "- ".
+		indent := strings.Repeat(" ", repos.Content[0].Column-3)
+		return insertYAMLLines(content, end, indent, hookLines), nil
+	case repos.Kind == yaml.ScalarNode && repos.Tag == "!!null":
+		return insertYAMLLines(content, end, "", hookLines), nil
+	}
+
+	return nil, fmt.Errorf(`can't add to repos, which isn't a list on separate lines; add a local hook running "%s" instead`, line)
+}
+
+// lefthookConfigWithHook adds a command to a hook in a lefthook configuration.
+// The file is edited as text so that its formatting and comments are kept.
+func lefthookConfigWithHook(content []byte, hook string, line string) ([]byte, error) {
+	commandLines := []string{
+		hookID + ":",
+		"  run: " + yamlScalar(line),
+	}
+
+	root, err := yamlRootMapping(content)
+	if err != nil {
+		return nil, err
+	}
+
+	i := yamlMappingValue(root, hook)
+	if i == -1 {
+		return insertYAMLLines(content, -1, "", append([]string{hook + ":", "  commands:"}, indentLines("    ", commandLines)...)), nil
+	}
+
+	hookNode := root.Content[i]
+	hookEnd := yamlValueEnd(root, i, -1)
+	if hookNode.Kind != yaml.MappingNode || hookNode.Style&yaml.FlowStyle != 0 || len(hookNode.Content) == 0 {
+		return nil, fmt.Errorf(`can't add to %s, which isn't a mapping on separate lines; add a command running "%s" instead`, hook, line)
+	}
+
+	j := yamlMappingValue(hookNode, "commands")
+	if j == -1 {
+		indent := strings.Repeat(" ", hookNode.Content[0].Column-1)
+		return insertYAMLLines(content, hookEnd, indent, append([]string{"commands:"}, indentLines("  ", commandLines)...)), nil
+	}
+
+	commands := hookNode.Content[j]
+	if commands.Kind != yaml.MappingNode || commands.Style&yaml.FlowStyle != 0 || len(commands.Content) == 0 {
+		return nil, fmt.Errorf(`can't add to %s.commands, which isn't a mapping on separate lines; add a command running "%s" instead`, hook, line)
+	}
+	if yamlMappingValue(commands, hookID) != -1 {
+		return nil, fmt.Errorf(`%s.commands already has an %s command`, hook, hookID)
+	}
+
+	indent := strings.Repeat(" ", commands.Content[0].Column-1)
+	return insertYAMLLines(content, yamlValueEnd(hookNode, j, hookEnd), indent, commandLines), nil
+}
+
+func yamlRootMapping(content []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty file
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode || root.Style&yaml.FlowStyle != 0 {
+		return nil, errors.New("expected a mapping on separate lines")
+	}
+
+	return root, nil
+}
+
+// yamlMappingValue returns the index in mapping.Content of the value of key, or -1 if there's no such key.
+func yamlMappingValue(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// yamlValueEnd returns the line number of the key after the value at index i of mapping.
+// If it's the last value, the mapping ends at end (or the end of the file, for -1).
+func yamlValueEnd(mapping *yaml.Node, i int, end int) int {
+	if i+1 < len(mapping.Content) {
+		return mapping.Content[i+1].Line
+	}
+
+	return end
+}
+
+// insertYAMLLines inserts a hook block of lines before line number end (or at the end of the file, for -1),
+// after any comments and blank lines directly before it.
+func insertYAMLLines(content []byte, end int, indent string, lines []string) []byte {
+	fileLines := strings.SplitAfter(string(content), "\n")
+	if fileLines[len(fileLines)-1] == "" {
+		fileLines = fileLines[:len(fileLines)-1]
+	}
+	if len(fileLines) > 0 && !strings.HasSuffix(fileLines[len(fileLines)-1], "\n") {
+		fileLines[len(fileLines)-1] += "\n"
+	}
+
+	at := len(fileLines)
+	if end != -1 {
+		at = end - 1
+	}
+	for at > 0 {
+		trimmed := strings.TrimSpace(fileLines[at-1])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		at--
+	}
+
+	block := hookBlock(indent, lines...)
+
+	return []byte(strings.Join(fileLines[:at], "") + block + strings.Join(fileLines[at:], ""))
+}
+
+func indentLines(indent string, lines []string) []string {
+	indented := make([]string, len(lines))
+	for i, line := range lines {
+		indented[i] = indent + line
+	}
+
+	return indented
+}
+
+// yamlScalar writes s as a YAML scalar, quoting it if necessary.
+func yamlScalar(s string) string {
+	b, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("%q", s)
+	}
+
+	return strings.TrimSuffix(string(b), "\n")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testHookLine = "eyecue-codemap --git-index --check-only"
+
+// hookLines is the hook block that the tests expect, with the given indentation.
+func hookLines(indent string, lines ...string) string {
+	return indent + hookMarkerStart + "\n" + indent + strings.Join(lines, "\n"+indent) + "\n" + indent + hookMarkerEnd + "\n"
+}
+
+func TestLefthookConfigWithHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		err     string
+	}{
+		{
+			name:    "empty file",
+			content: "",
+			want:    hookLines("", "pre-commit:", "  commands:", "    eyecue-codemap:", "      run: "+testHookLine),
+		},
+		{
+			name:    "other hooks",
+			content: "# Hooks\npre-push:\n  commands:\n    test:\n      run: npm test\n",
+			want: "# Hooks\npre-push:\n  commands:\n    test:\n      run: npm test\n" +
+				hookLines("", "pre-commit:", "  commands:", "    eyecue-codemap:", "      run: "+testHookLine),
+		},
+		{
+			name:    "hook without commands",
+			content: "pre-commit:\n  parallel: true\n",
+			want:    "pre-commit:\n  parallel: true\n" + hookLines("  ", "commands:", "  eyecue-codemap:", "    run: "+testHookLine),
+		},
+		{
+			name: "commands before another hook",
+			content: "pre-commit:\n  commands:\n    lint:\n      run: npm run lint\n\n" +
+				"# Tests\npre-push:\n  commands:\n    test:\n      run: npm test\n",
+			want: "pre-commit:\n  commands:\n    lint:\n      run: npm run lint\n" +
+				hookLines("    ", "eyecue-codemap:", "  run: "+testHookLine) +
+				"\n# Tests\npre-push:\n  commands:\n    test:\n      run: npm test\n",
+		},
+		{
+			name:    "no final newline",
+			content: "pre-commit:\n  commands:\n    lint:\n      run: npm run lint",
+			want:    "pre-commit:\n  commands:\n    lint:\n      run: npm run lint\n" + hookLines("    ", "eyecue-codemap:", "  run: "+testHookLine),
+		},
+		{
+			name:    "existing command",
+			content: "pre-commit:\n  commands:\n    eyecue-codemap:\n      run: eyecue-codemap\n",
+			err:     "already has an eyecue-codemap command",
+		},
+		{
+			name:    "flow mapping",
+			content: "pre-commit: {commands: {}}\n",
+			err:     "isn't a mapping on separate lines",
+		},
+		{
+			name:    "commands isn't a mapping",
+			content: "pre-commit:\n  commands: []\n",
+			err:     "isn't a mapping on separate lines",
+		},
+		{
+			name:    "not a mapping",
+			content: "- pre-commit\n",
+			err:     "expected a mapping on separate lines",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lefthookConfigWithHook([]byte(tt.content), "pre-commit", testHookLine)
+			checkHookEdit(t, tt.content, string(got), err, tt.want, tt.err)
+		})
+	}
+}
+
+func TestPreCommitConfigWithHook(t *testing.T) {
+	localRepo := []string{
+		"- repo: local",
+		"  hooks:",
+		"    - id: eyecue-codemap",
+		"      name: eyecue-codemap",
+		"      entry: " + testHookLine,
+		"      language: system",
+		"      pass_filenames: false",
+		"      always_run: true",
+		"      stages: [pre-commit, pre-push]",
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		err     string
+	}{
+		{
+			name:    "empty file",
+			content: "",
+			want:    hookLines("", append([]string{"repos:"}, indentLines("  ", localRepo)...)...),
+		},
+		{
+			name:    "no repos",
+			content: "default_stages: [pre-commit]\n",
+			want:    "default_stages: [pre-commit]\n" + hookLines("", append([]string{"repos:"}, indentLines("  ", localRepo)...)...),
+		},
+		{
+			name:    "empty repos",
+			content: "repos:\n",
+			want:    "repos:\n" + hookLines("", localRepo...),
+		},
+		{
+			name: "indented repos before another key",
+			content: "repos:\n  - repo: https://github.com/pre-commit/pre-commit-hooks\n    rev: v4.0.0\n    hooks:\n      - id: trailing-whitespace\n" +
+				"# CI\nci:\n  autofix_prs: false\n",
+			want: "repos:\n  - repo: https://github.com/pre-commit/pre-commit-hooks\n    rev: v4.0.0\n    hooks:\n      - id: trailing-whitespace\n" +
+				hookLines("  ", localRepo...) + "# CI\nci:\n  autofix_prs: false\n",
+		},
+		{
+			name:    "unindented repos",
+			content: "repos:\n- repo: meta\n  hooks:\n  - id: check-useless-excludes\n",
+			want:    "repos:\n- repo: meta\n  hooks:\n  - id: check-useless-excludes\n" + hookLines("", localRepo...),
+		},
+		{
+			name:    "flow repos",
+			content: "repos: []\n",
+			err:     "isn't a list on separate lines",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := preCommitConfigWithHook([]byte(tt.content), []string{"pre-commit", "pre-push"}, testHookLine)
+			checkHookEdit(t, tt.content, string(got), err, tt.want, tt.err)
+		})
+	}
+}
+
+// checkHookEdit checks the result of adding a hook to content, and that removing the hook block restores it.
+func checkHookEdit(t *testing.T, content string, got string, err error, want string, wantErr string) {
+	t.Helper()
+
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("got error %v, want %q", err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	without, found := withoutHookBlocks([]byte(got))
+	if !found {
+		t.Fatal("hook block not found")
+	}
+	if strings.TrimSuffix(content, "\n") != strings.TrimSuffix(string(without), "\n") {
+		t.Errorf("without the hook block:\n%s\nwant:\n%s", without, content)
+	}
+}
+
+func TestYAMLScalar(t *testing.T) {
+	tests := map[string]string{
+		testHookLine:                    testHookLine,
+		"./bin/codemap: --git-index":    `'./bin/codemap: --git-index'`,
+		"eyecue-codemap # --check-only": `'eyecue-codemap # --check-only'`,
+		"'quoted' --git-index":          `'''quoted'' --git-index'`,
+	}
+
+	for s, want := range tests {
+		got := yamlScalar(s)
+		if got != want {
+			t.Errorf("yamlScalar(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSON-RPC and LSP error codes
+const (
+	jsonrpcParseError       = -32700
+	jsonrpcInvalidParams    = -32602
+	jsonrpcMethodNotFound   = -32601
+	jsonrpcInternalError    = -32603
+	lspServerNotInitialized = -32002
+)
+
+// jsonrpcConn reads and writes JSON-RPC 2.0 messages framed with the Content-Length
+// headers of the LSP base protocol.
+type jsonrpcConn struct {
+	r  *bufio.Reader
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// jsonrpcMessage is a request (with an ID) or a notification (without).
+type jsonrpcMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+}
+
+type jsonrpcErrorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *jsonrpcError   `json:"error"`
+}
+
+type jsonrpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *jsonrpcError) Error() string {
+	return e.Message
+}
+
+func newJSONRPCConn(r io.Reader, w io.Writer) *jsonrpcConn {
+	return &jsonrpcConn{
+		r: bufio.NewReader(r),
+		w: w,
+	}
+}
+
+// read returns the next message. A message that isn't valid JSON is returned with a *jsonrpcError.
+func (c *jsonrpcConn) read() (*jsonrpcMessage, error) {
+	length := -1
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			return nil, fmt.Errorf("invalid header: %q", line)
+		}
+
+		if strings.EqualFold(strings.TrimSpace(line[:colon]), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[colon+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length: %w", err)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+
+	body := make([]byte, length)
+	_, err := io.ReadFull(c.r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg jsonrpcMessage
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		return nil, &jsonrpcError{Code: jsonrpcParseError, Message: err.Error()}
+	}
+
+	return &msg, nil
+}
+
+func (c *jsonrpcConn) write(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err = fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(body))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.w.Write(body)
+	return err
+}
+
+func (c *jsonrpcConn) reply(id json.RawMessage, result interface{}) error {
+	return c.write(jsonrpcResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Result:  result,
+	})
+}
+
+func (c *jsonrpcConn) replyError(id json.RawMessage, err error) error {
+	var rpcErr *jsonrpcError
+	if !errors.As(err, &rpcErr) {
+		rpcErr = &jsonrpcError{Code: jsonrpcInternalError, Message: err.Error()}
+	}
+
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+
+	return c.write(jsonrpcErrorResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   rpcErr,
+	})
+}
+
+func (c *jsonrpcConn) notify(method string, params interface{}) error {
+	return c.write(jsonrpcNotification{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+}
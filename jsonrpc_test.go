@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPCConn(t *testing.T) {
+	var buf bytes.Buffer
+	conn := newJSONRPCConn(&buf, &buf)
+
+	err := conn.notify("window/logMessage", lspMessageParams{Type: lspMessageLog, Message: "héllo 😀"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Header names are case-insensitive, and other headers are ignored.
+	buf.WriteString("content-length: 41\r\nContent-Type: application/vscode-jsonrpc\r\n\r\n")
+	buf.WriteString(`{"jsonrpc":"2.0","id":7,"method":"a/b"}` + "  ")
+
+	msg, err := conn.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Method != "window/logMessage" || msg.ID != nil || !strings.Contains(string(msg.Params), "héllo 😀") {
+		t.Errorf("got %+v, want the notification", msg)
+	}
+
+	msg, err = conn.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Method != "a/b" || msg.ID == nil || string(*msg.ID) != "7" {
+		t.Errorf("got %+v, want request 7", msg)
+	}
+}
+
+func TestJSONRPCConnInvalid(t *testing.T) {
+	tests := map[string]string{
+		"Content-Type: text/plain\r\n\r\n{}": "missing Content-Length header",
+		"Content-Length: x\r\n\r\n{}":        "invalid Content-Length",
+		"Content-Length\r\n\r\n{}":           "invalid header",
+	}
+
+	for input, want := range tests {
+		_, err := newJSONRPCConn(strings.NewReader(input), nil).read()
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got %v, want %q", input, err, want)
+		}
+	}
+
+	// A body that isn't JSON is a parse error, which the server replies to.
+	_, err := newJSONRPCConn(strings.NewReader("Content-Length: 2\r\n\r\n{]"), nil).read()
+	var rpcErr *jsonrpcError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != jsonrpcParseError {
+		t.Errorf("got %v, want a parse error", err)
+	}
+}
@@ -0,0 +1,869 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+)
+
+// LSP types, limited to the fields used here. See
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type lspTextDocumentItem struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspInitializeParams struct {
+	RootURI          string `json:"rootUri"`
+	RootPath         string `json:"rootPath"`
+	WorkspaceFolders []struct {
+		URI string `json:"uri"`
+	} `json:"workspaceFolders"`
+}
+
+type lspDidOpenParams struct {
+	TextDocument lspTextDocumentItem `json:"textDocument"`
+}
+
+type lspDidChangeParams struct {
+	TextDocument   lspTextDocumentIdentifier `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type lspDocumentParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+	Position     lspPosition               `json:"position"`
+	Context      struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+type lspCodeActionParams struct {
+	TextDocument lspTextDocumentIdentifier `json:"textDocument"`
+	Range        lspRange                  `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range              lspRange                `json:"range"`
+	Severity           int                     `json:"severity"`
+	Code               string                  `json:"code"`
+	Source             string                  `json:"source"`
+	Message            string                  `json:"message"`
+	RelatedInformation []lspRelatedInformation `json:"relatedInformation,omitempty"`
+}
+
+type lspRelatedInformation struct {
+	Location lspLocation `json:"location"`
+	Message  string      `json:"message"`
+}
+
+type lspPublishDiagnosticsParams struct {
+	URI         string          `json:"uri"`
+	Diagnostics []lspDiagnostic `json:"diagnostics"`
+}
+
+type lspCodeAction struct {
+	Title string            `json:"title"`
+	Kind  string            `json:"kind"`
+	Edit  *lspWorkspaceEdit `json:"edit"`
+}
+
+type lspWorkspaceEdit struct {
+	Changes map[string][]lspTextEdit `json:"changes"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspMessageParams struct {
+	Type    int    `json:"type"`
+	Message string `json:"message"`
+}
+
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+
+	lspMessageError = 1
+	lspMessageLog   = 4
+)
+
+var errLSPExitWithoutShutdown = errors.New("language server exited without a shutdown request")
+
+// lspServer answers LSP requests from the inventory of a codemap.Session. It never writes
+// files: links are checked rather than updated, and groups are acked with code actions
+// that the editor applies.
+type lspServer struct {
+	conn    *jsonrpcConn
+	config  Config
+	root    string
+	fs      *overlayFileSystem
+	opts    codemap.Options
+	session *codemap.Session
+	// known are the files listed by Git.
+	known map[string]struct{}
+	// result is the result of the latest Load or Refresh.
+	result *codemap.Result
+	// published are the documents that have diagnostics.
+	published map[string]struct{}
+	shutdown  bool
+}
+
+// serveLSP runs a language server over r and w until the client sends "exit".
+func serveLSP(config Config, r io.Reader, w io.Writer) error {
+	s := &lspServer{
+		conn:      newJSONRPCConn(r, w),
+		config:    config,
+		fs:        &overlayFileSystem{documents: map[string][]byte{}},
+		published: map[string]struct{}{},
+	}
+
+	for {
+		msg, err := s.conn.read()
+		if errors.Is(err, io.EOF) {
+			return errLSPExitWithoutShutdown
+		}
+
+		var rpcErr *jsonrpcError
+		if errors.As(err, &rpcErr) {
+			err = s.conn.replyError(nil, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errLSPExitWithoutShutdown
+			}
+			return nil
+		}
+
+		result, err := s.handle(msg.Method, msg.Params)
+
+		if msg.ID == nil {
+			if err != nil {
+				s.logMessage(lspMessageError, err.Error())
+			}
+			continue
+		}
+
+		if err != nil {
+			err = s.conn.replyError(*msg.ID, err)
+		} else {
+			err = s.conn.reply(*msg.ID, result)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *lspServer) handle(method string, params json.RawMessage) (interface{}, error) {
+	if s.session == nil && method != "initialize" {
+		if strings.HasPrefix(method, "$/") || method == "initialized" {
+			return nil, nil
+		}
+		return nil, &jsonrpcError{Code: lspServerNotInitialized, Message: "server not initialized"}
+	}
+
+	switch method {
+	case "initialize":
+		var p lspInitializeParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.initialize(p)
+	case "initialized":
+		return nil, s.load()
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p lspDidOpenParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.updateDocument(p.TextDocument.URI, []byte(p.TextDocument.Text))
+	case "textDocument/didChange":
+		var p lspDidChangeParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		if len(p.ContentChanges) == 0 {
+			return nil, &jsonrpcError{Code: jsonrpcInvalidParams, Message: "didChange has no content changes"}
+		}
+		// Only full document sync is supported, so the last change is the whole document.
+		return nil, s.updateDocument(p.TextDocument.URI, []byte(p.ContentChanges[len(p.ContentChanges)-1].Text))
+	case "textDocument/didSave":
+		var p lspDocumentParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.refreshDocument(p.TextDocument.URI)
+	case "textDocument/didClose":
+		var p lspDocumentParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.updateDocument(p.TextDocument.URI, nil)
+	case "textDocument/definition":
+		var p lspPositionParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.definition(p)
+	case "textDocument/references":
+		var p lspPositionParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.references(p)
+	case "textDocument/codeAction":
+		var p lspCodeActionParams
+		if err := decode(params, &p); err != nil {
+			return nil, err
+		}
+		return s.codeActions(p)
+	}
+
+	if strings.HasPrefix(method, "$/") {
+		return nil, nil
+	}
+
+	return nil, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: fmt.Sprintf("method not found: %s", method)}
+}
+
+func decode(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return &jsonrpcError{Code: jsonrpcInvalidParams, Message: err.Error()}
+	}
+
+	return nil
+}
+
+// initialize loads the configuration from the working directory. The server checks the files
+// there, like the other commands, so it should be started in the workspace root.
+func (s *lspServer) initialize(p lspInitializeParams) (interface{}, error) {
+	var err error
+	s.root, err = os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	if root := workspaceRoot(p); root != "" && root != s.root {
+		s.logMessage(lspMessageLog, fmt.Sprintf(`workspace root "%s" isn't the working directory; checking "%s"`, root, s.root))
+	}
+
+	err = loadProjectConfig(&s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := libraryOptions(s.config)
+	if err != nil {
+		return nil, err
+	}
+	opts.FileSystem = s.fs
+	s.opts = opts
+
+	s.session, err = codemap.NewSession(opts, codemap.ModeCheck)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			"textDocumentSync": map[string]interface{}{
+				"openClose": true,
+				"change":    1, // full
+				"save":      map[string]interface{}{"includeText": false},
+			},
+			"definitionProvider": true,
+			"referencesProvider": true,
+			"codeActionProvider": map[string]interface{}{
+				"codeActionKinds": []string{"quickfix"},
+			},
+		},
+		"serverInfo": map[string]interface{}{
+			"name":    "eyecue-codemap",
+			"version": Version,
+		},
+	}, nil
+}
+
+// workspaceRoot returns the directory of the client's workspace, or "" if it has none.
+func workspaceRoot(p lspInitializeParams) string {
+	rootURI := p.RootURI
+	if rootURI == "" && len(p.WorkspaceFolders) > 0 {
+		rootURI = p.WorkspaceFolders[0].URI
+	}
+
+	if rootURI == "" {
+		return p.RootPath
+	}
+
+	u, err := url.Parse(rootURI)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+
+	return filepath.FromSlash(u.Path)
+}
+
+func (s *lspServer) load() error {
+	fileSources, err := readFilenamesFromGit(s.opts)
+	if err != nil {
+		return err
+	}
+
+	s.known = filenameSet(fileSources)
+
+	result, err := s.session.Load(fileSources)
+	if err != nil {
+		s.showMessage(lspMessageError, fmt.Sprintf("eyecue-codemap: %v", err))
+		return nil
+	}
+	s.result = result
+
+	return s.publishDiagnostics()
+}
+
+// updateDocument replaces the content of an open document, or closes it when text is nil.
+func (s *lspServer) updateDocument(uri string, text []byte) error {
+	filename, ok := s.filename(uri)
+	if !ok {
+		return nil
+	}
+
+	if text == nil {
+		delete(s.fs.documents, filename)
+	} else {
+		s.fs.documents[filename] = text
+	}
+
+	return s.refresh(filename)
+}
+
+func (s *lspServer) refreshDocument(uri string) error {
+	filename, ok := s.filename(uri)
+	if !ok {
+		return nil
+	}
+
+	return s.refresh(filename)
+}
+
+// refresh re-inventories a file and republishes the diagnostics.
+func (s *lspServer) refresh(filename string) error {
+	if _, ok := s.known[filename]; !ok {
+		// It may be a new file.
+		fileSources, err := readFilenamesFromGit(s.opts)
+		if err != nil {
+			return err
+		}
+		s.known = filenameSet(fileSources)
+
+		if _, ok := s.known[filename]; !ok {
+			return nil
+		}
+	}
+
+	var changed []codemap.FileSource
+	var removed []string
+
+	_, isOpen := s.fs.documents[filename]
+	if _, err := os.Lstat(filename); isOpen || err == nil {
+		changed = append(changed, codemap.FileSource{Filename: filename})
+	} else {
+		removed = append(removed, filename)
+		delete(s.known, filename)
+	}
+
+	result, err := s.session.Refresh(changed, removed)
+	if err != nil {
+		// Most likely the file is in the middle of being edited, e.g. a group's end tag hasn't been typed yet.
+		s.logMessage(lspMessageLog, err.Error())
+		return nil
+	}
+	s.result = result
+
+	return s.publishDiagnostics()
+}
+
+func (s *lspServer) publishDiagnostics() error {
+	lines := s.newDocumentLines()
+	diagnostics := map[string][]lspDiagnostic{}
+
+	addDiagnostic := func(filename string, diagnostic lspDiagnostic) {
+		diagnostic.Source = "eyecue-codemap"
+		diagnostics[filename] = append(diagnostics[filename], diagnostic)
+	}
+
+	for _, problem := range s.result.Problems {
+		if problem.Kind != codemap.ProblemDuplicateToken {
+			continue
+		}
+
+		for _, loc := range problem.Related {
+			var related []lspRelatedInformation
+			for _, other := range problem.Related {
+				if other != loc {
+					related = append(related, lspRelatedInformation{
+						Location: lspLocation{URI: s.uri(other.Filename), Range: lines.tokenRange(other.Filename, other.Line, problem.Token)},
+						Message:  "also used here",
+					})
+				}
+			}
+
+			addDiagnostic(loc.Filename, lspDiagnostic{
+				Range:              lines.tokenRange(loc.Filename, loc.Line, problem.Token),
+				Severity:           lspSeverityError,
+				Code:               string(problem.Kind),
+				Message:            fmt.Sprintf(`duplicate token "%s"`, problem.Token),
+				RelatedInformation: related,
+			})
+		}
+	}
+
+	for _, problem := range s.result.Problems {
+		if problem.Kind != codemap.ProblemGroupPolicy {
+			continue
+		}
+
+		addDiagnostic(problem.Filename, lspDiagnostic{
+			Range:    lines.tokenRange(problem.Filename, problem.Line, problem.Token),
+			Severity: lspSeverityError,
+			Code:     string(problem.Kind),
+			Message:  problem.Message,
+		})
+	}
+
+	for _, problem := range s.session.MarkdownProblems() {
+		addDiagnostic(problem.Filename, lspDiagnostic{
+			Range:    lines.tokenRange(problem.Filename, problem.Line, problem.Token),
+			Severity: lspSeverityError,
+			Code:     string(problem.Kind),
+			Message:  problem.Message,
+		})
+	}
+
+	unusedSeverity := lspSeverityWarning
+	if s.config.NoUnused {
+		unusedSeverity = lspSeverityError
+	}
+
+	for _, unused := range s.result.UnusedTokens {
+		addDiagnostic(unused.Filename, lspDiagnostic{
+			Range:    lines.tokenRange(unused.Filename, unused.LineNum, unused.Token),
+			Severity: unusedSeverity,
+			Code:     string(codemap.ProblemUnusedToken),
+			Message:  fmt.Sprintf(`unused token "%s"`, unused.Token),
+		})
+	}
+
+	for _, group := range s.result.ChangedGroups {
+		for i, block := range group.Blocks {
+			if !block.Changed() {
+				continue
+			}
+
+			var related []lspRelatedInformation
+			for j, other := range group.Blocks {
+				if j != i {
+					related = append(related, lspRelatedInformation{
+						Location: lspLocation{URI: s.uri(other.FileSource.Filename), Range: lines.blockRange(other)},
+						Message:  "another block of the group",
+					})
+				}
+			}
+
+			addDiagnostic(block.FileSource.Filename, lspDiagnostic{
+				Range:              lines.blockRange(block),
+				Severity:           lspSeverityError,
+				Code:               string(codemap.ProblemGroupChanged),
+				Message:            fmt.Sprintf(`group "%s" has changed since it was last acked; update the other blocks as needed, then ack it`, group.Token),
+				RelatedInformation: related,
+			})
+		}
+	}
+
+	published := map[string]struct{}{}
+
+	for filename, fileDiagnostics := range diagnostics {
+		uri := s.uri(filename)
+		published[uri] = struct{}{}
+
+		err := s.conn.notify("textDocument/publishDiagnostics", lspPublishDiagnosticsParams{
+			URI:         uri,
+			Diagnostics: fileDiagnostics,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Clear the diagnostics of documents that no longer have any.
+	for uri := range s.published {
+		if _, ok := published[uri]; ok {
+			continue
+		}
+
+		err := s.conn.notify("textDocument/publishDiagnostics", lspPublishDiagnosticsParams{
+			URI:         uri,
+			Diagnostics: []lspDiagnostic{},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	s.published = published
+
+	return nil
+}
+
+// definition goes from a tag or reference to the code it marks.
+func (s *lspServer) definition(p lspPositionParams) (interface{}, error) {
+	tag, ok := s.tagAt(p.TextDocument.URI, p.Position)
+	if !ok {
+		return nil, nil
+	}
+
+	return s.declarations(tag), nil
+}
+
+// references goes from a tag or reference to the Markdown that refers to it.
+func (s *lspServer) references(p lspPositionParams) (interface{}, error) {
+	tag, ok := s.tagAt(p.TextDocument.URI, p.Position)
+	if !ok {
+		return nil, nil
+	}
+
+	lines := s.newDocumentLines()
+	locations := []lspLocation{}
+
+	if p.Context.IncludeDeclaration {
+		locations = append(locations, s.declarations(tag)...)
+	}
+
+	for _, reference := range s.session.References(tag.Token) {
+		if reference.Group != tag.Group {
+			continue
+		}
+
+		locations = append(locations, lspLocation{
+			URI:   s.uri(reference.Filename),
+			Range: lines.tokenRange(reference.Filename, reference.Line, reference.Token),
+		})
+	}
+
+	return locations, nil
+}
+
+func (s *lspServer) declarations(tag codemap.Tag) []lspLocation {
+	lines := s.newDocumentLines()
+	inventory := s.session.Inventory()
+	locations := []lspLocation{}
+
+	if tag.Group {
+		for _, block := range inventory.GroupsByToken[tag.Token] {
+			locations = append(locations, lspLocation{
+				URI:   s.uri(block.FileSource.Filename),
+				Range: lines.blockRange(block),
+			})
+		}
+
+		return locations
+	}
+
+	for _, loc := range inventory.Singles(tag.Token) {
+		var r lspRange
+		switch {
+		case loc.LinkToFile:
+			// the start of the file
+		case loc.EndLineNum > 0:
+			r = lines.lineRange(loc.Filename, loc.LineNum, loc.EndLineNum)
+		default:
+			r = lines.lineRange(loc.Filename, loc.LineNum, loc.LineNum)
+		}
+
+		locations = append(locations, lspLocation{
+			URI:   s.uri(loc.Filename),
+			Range: r,
+		})
+	}
+
+	return locations
+}
+
+// codeActions offers to ack the changed group blocks in the requested range.
+func (s *lspServer) codeActions(p lspCodeActionParams) (interface{}, error) {
+	filename, ok := s.filename(p.TextDocument.URI)
+	if !ok {
+		return nil, nil
+	}
+
+	lines := s.newDocumentLines()
+	actions := []lspCodeAction{}
+
+	inventory := s.session.Inventory()
+	for _, token := range sortedKeys(inventory.GroupsByToken) {
+		for _, block := range inventory.GroupsByToken[token] {
+			if block.FileSource.Filename != filename || !block.Changed() {
+				continue
+			}
+
+			// Block lines are 1-based, LSP lines are 0-based.
+			if p.Range.End.Line < block.StartLineNumber-1 || p.Range.Start.Line > block.EndLineNumber-1 {
+				continue
+			}
+
+			endLine := lines.line(filename, block.EndLineNumber)
+
+			actions = append(actions, lspCodeAction{
+				Title: fmt.Sprintf(`Ack this block of group "%s"`, token),
+				Kind:  "quickfix",
+				Edit: &lspWorkspaceEdit{
+					Changes: map[string][]lspTextEdit{
+						p.TextDocument.URI: {{
+							Range: lspRange{
+								Start: lspPosition{Line: block.EndLineNumber - 1},
+								End:   lspPosition{Line: block.EndLineNumber - 1, Character: utf16Length(endLine)},
+							},
+							NewText: s.session.AckGroupEnd(endLine, block),
+						}},
+					},
+				},
+			})
+		}
+	}
+
+	return actions, nil
+}
+
+func (s *lspServer) tagAt(uri string, position lspPosition) (codemap.Tag, bool) {
+	filename, ok := s.filename(uri)
+	if !ok {
+		return codemap.Tag{}, false
+	}
+
+	line := s.newDocumentLines().line(filename, position.Line+1)
+	column := byteOffset(line, position.Character) + 1
+
+	for _, tag := range s.session.TagsInLine(line) {
+		if tag.Column <= column && column <= tag.EndColumn {
+			return tag, true
+		}
+	}
+
+	return codemap.Tag{}, false
+}
+
+func (s *lspServer) showMessage(messageType int, message string) {
+	err := s.conn.notify("window/showMessage", lspMessageParams{Type: messageType, Message: message})
+	if err != nil {
+		fmt.Fprintf(out, "ERROR: %v\n", err)
+	}
+}
+
+func (s *lspServer) logMessage(messageType int, message string) {
+	err := s.conn.notify("window/logMessage", lspMessageParams{Type: messageType, Message: message})
+	if err != nil {
+		fmt.Fprintf(out, "ERROR: %v\n", err)
+	}
+}
+
+// filename converts a file URI to a path relative to the workspace root. It returns
+// false for documents outside the workspace.
+func (s *lspServer) filename(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(s.root, filepath.FromSlash(u.Path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return filepath.ToSlash(rel), true
+}
+
+func (s *lspServer) uri(filename string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(s.root, filename))}).String()
+}
+
+// overlayFileSystem reads the editor's content of open documents, and the working directory otherwise.
+type overlayFileSystem struct {
+	documents map[string][]byte
+}
+
+func (fs *overlayFileSystem) ReadFile(fileSource codemap.FileSource) ([]byte, error) {
+	if text, ok := fs.documents[fileSource.Filename]; ok && !fileSource.FromGitIndex {
+		return text, nil
+	}
+
+	return codemap.OSFileSystem{}.ReadFile(fileSource)
+}
+
+func (fs *overlayFileSystem) FileSize(fileSource codemap.FileSource) (int64, error) {
+	if text, ok := fs.documents[fileSource.Filename]; ok && !fileSource.FromGitIndex {
+		return int64(len(text)), nil
+	}
+
+	return codemap.OSFileSystem{}.FileSize(fileSource)
+}
+
+func (fs *overlayFileSystem) WriteFile(filename string, data []byte) error {
+	return fmt.Errorf(`language server cannot write "%s"`, filename)
+}
+
+// documentLines reads the lines of documents as needed, to convert between byte columns and LSP positions.
+type documentLines struct {
+	fs    *overlayFileSystem
+	files map[string][]string
+}
+
+func (s *lspServer) newDocumentLines() *documentLines {
+	return &documentLines{
+		fs:    s.fs,
+		files: map[string][]string{},
+	}
+}
+
+// line returns a 1-based line of filename, or "" if it can't be read.
+func (d *documentLines) line(filename string, lineNum int) string {
+	lines, ok := d.files[filename]
+	if !ok {
+		data, err := d.fs.ReadFile(codemap.FileSource{Filename: filename})
+		if err == nil {
+			lines = strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+		}
+		d.files[filename] = lines
+	}
+
+	if lineNum < 1 || lineNum > len(lines) {
+		return ""
+	}
+
+	return lines[lineNum-1]
+}
+
+// tokenRange finds token on a 1-based line, or the line before it (where the tag of a token
+// that marks the following line is). It falls back to the start of the line.
+func (d *documentLines) tokenRange(filename string, lineNum int, token string) lspRange {
+	for _, n := range []int{lineNum, lineNum - 1} {
+		line := d.line(filename, n)
+		if i := strings.Index(line, token); i != -1 && token != "" {
+			return lspRange{
+				Start: lspPosition{Line: n - 1, Character: utf16Length(line[:i])},
+				End:   lspPosition{Line: n - 1, Character: utf16Length(line[:i+len(token)])},
+			}
+		}
+	}
+
+	return lspRange{
+		Start: lspPosition{Line: lineNum - 1},
+		End:   lspPosition{Line: lineNum - 1},
+	}
+}
+
+// lineRange covers the 1-based lines startLine through endLine.
+func (d *documentLines) lineRange(filename string, startLine int, endLine int) lspRange {
+	return lspRange{
+		Start: lspPosition{Line: startLine - 1},
+		End:   lspPosition{Line: endLine - 1, Character: utf16Length(d.line(filename, endLine))},
+	}
+}
+
+// blockRange covers a group block, from its start tag to its end tag.
+func (d *documentLines) blockRange(block codemap.TokenGroupInfo) lspRange {
+	return d.lineRange(block.FileSource.Filename, block.StartLineNumber, block.EndLineNumber)
+}
+
+// utf16Length returns the length of s in UTF-16 code units, which LSP positions count by default.
+func utf16Length(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+
+	return n
+}
+
+// byteOffset converts a position in UTF-16 code units within line to a byte offset.
+func byteOffset(line string, character int) int {
+	n := 0
+	for i, r := range line {
+		if n >= character {
+			return i
+		}
+
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+
+	return len(line)
+}
+
+func sortedKeys(groupsByToken map[string][]codemap.TokenGroupInfo) []string {
+	tokens := make([]string, 0, len(groupsByToken))
+	for token := range groupsByToken {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+
+	return tokens
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLSPFilenameAndURI(t *testing.T) {
+	root := filepath.FromSlash("/work/repo")
+	s := &lspServer{root: root}
+
+	tests := []struct {
+		uri      string
+		filename string
+		ok       bool
+	}{
+		{"file:///work/repo/a.go", "a.go", true},
+		{"file:///work/repo/docs/with%20space.md", "docs/with space.md", true},
+		{"file:///work/other/a.go", "", false},
+		{"file:///work/repo/../a.go", "", false},
+		{"file:///work/repo2/a.go", "", false},
+		{"untitled:Untitled-1", "", false},
+	}
+
+	for _, tt := range tests {
+		filename, ok := s.filename(tt.uri)
+		if filename != tt.filename || ok != tt.ok {
+			t.Errorf("filename(%q) = %q, %v, want %q, %v", tt.uri, filename, ok, tt.filename, tt.ok)
+		}
+	}
+
+	for _, filename := range []string{"a.go", "docs/with space.md", "docs/#1?.md"} {
+		uri := s.uri(filename)
+		got, ok := s.filename(uri)
+		if !ok || got != filename {
+			t.Errorf("filename(uri(%q)) = %q, %v (from %q)", filename, got, ok, uri)
+		}
+	}
+
+	if got, want := s.uri("docs/with space.md"), "file:///work/repo/docs/with%20space.md"; filepath.Separator == '/' && got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUTF16Positions(t *testing.T) {
+	// "é" is 2 bytes and 1 UTF-16 code unit, "😀" is 4 bytes and 2 code units (a surrogate pair).
+	line := "é😀x"
+
+	tests := []struct {
+		character int
+		offset    int
+	}{
+		{0, 0},
+		{1, 2},
+		{3, 6},
+		{4, 7},
+		{10, 7},
+	}
+
+	for _, tt := range tests {
+		if got := byteOffset(line, tt.character); got != tt.offset {
+			t.Errorf("byteOffset(%q, %d) = %d, want %d", line, tt.character, got, tt.offset)
+		}
+		if tt.character <= 4 {
+			if got := utf16Length(line[:tt.offset]); got != tt.character {
+				t.Errorf("utf16Length(%q) = %d, want %d", line[:tt.offset], got, tt.character)
+			}
+		}
+	}
+}
+
+func TestTokenRange(t *testing.T) {
+	lines := (&lspServer{fs: &overlayFileSystem{documents: map[string][]byte{
+		"a.go": []byte("package a\r\n\r\n// 😀 tokA\r\nvar a = 1\r\n"),
+	}}}).newDocumentLines()
+
+	tests := []struct {
+		lineNum int
+		token   string
+		want    lspRange
+	}{
+		{3, "tokA", lspRange{Start: lspPosition{Line: 2, Character: 6}, End: lspPosition{Line: 2, Character: 10}}},
+		// The tag is on the line before the line it marks.
+		{4, "tokA", lspRange{Start: lspPosition{Line: 2, Character: 6}, End: lspPosition{Line: 2, Character: 10}}},
+		{4, "tokB", lspRange{Start: lspPosition{Line: 3}, End: lspPosition{Line: 3}}},
+		{1, "", lspRange{Start: lspPosition{Line: 0}, End: lspPosition{Line: 0}}},
+	}
+
+	for _, tt := range tests {
+		if got := lines.tokenRange("a.go", tt.lineNum, tt.token); got != tt.want {
+			t.Errorf("tokenRange(%d, %q) = %+v, want %+v", tt.lineNum, tt.token, got, tt.want)
+		}
+	}
+}
+
+// lspRequests frames messages as a client would send them.
+func lspRequests(t *testing.T, messages ...interface{}) io.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	conn := newJSONRPCConn(nil, &buf)
+	for _, message := range messages {
+		err := conn.write(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &buf
+}
+
+// lspMessages reads the messages that the server wrote.
+func lspMessages(t *testing.T, r io.Reader) []jsonrpcMessage {
+	t.Helper()
+
+	conn := newJSONRPCConn(r, nil)
+	var messages []jsonrpcMessage
+	for {
+		msg, err := conn.read()
+		if errors.Is(err, io.EOF) {
+			return messages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, *msg)
+	}
+}
+
+func TestLSPDiagnostics(t *testing.T) {
+	root := inGitRepo(t, map[string]string{
+		"a.go":   "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+		"doc.md": "See [a<!--" + tagBase + ":tokA-->](a.go#L4).\n",
+	})
+	uri := (&lspServer{root: root}).uri("a.go")
+
+	request := func(id int, method string, params interface{}) map[string]interface{} {
+		return map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+	}
+	notification := func(method string, params interface{}) map[string]interface{} {
+		return map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	}
+
+	var output bytes.Buffer
+	err := serveLSP(Config{}, lspRequests(t,
+		request(1, "initialize", map[string]interface{}{"rootUri": (&lspServer{root: root}).uri("")}),
+		notification("initialized", map[string]interface{}{}),
+		// An unsaved tag that isn't used anywhere.
+		notification("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]interface{}{
+			"uri":  uri,
+			"text": "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n\n// [" + tagBase + ":tokB]\nvar b = 1\n",
+		}}),
+		notification("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": uri},
+			"contentChanges": []interface{}{},
+		}),
+		notification("textDocument/didClose", map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri}}),
+		request(2, "shutdown", nil),
+		notification("exit", nil),
+	), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var published []lspPublishDiagnosticsParams
+	var logged []lspMessageParams
+	for _, msg := range lspMessages(t, &output) {
+		switch msg.Method {
+		case "textDocument/publishDiagnostics":
+			var p lspPublishDiagnosticsParams
+			if err := json.Unmarshal(msg.Params, &p); err != nil {
+				t.Fatal(err)
+			}
+			published = append(published, p)
+		case "window/logMessage":
+			var p lspMessageParams
+			if err := json.Unmarshal(msg.Params, &p); err != nil {
+				t.Fatal(err)
+			}
+			logged = append(logged, p)
+		}
+	}
+
+	// The files on disk have no problems, so the first diagnostics are for the opened document,
+	// and the last clear them when it's closed.
+	if len(published) != 2 {
+		t.Fatalf("got diagnostics %+v, want 2 notifications", published)
+	}
+
+	if published[0].URI != uri || len(published[0].Diagnostics) != 1 {
+		t.Fatalf("got diagnostics %+v, want one for %s", published[0], uri)
+	}
+	diagnostic := published[0].Diagnostics[0]
+	character := strings.Index("// ["+tagBase+":tokB]", "tokB")
+	wantRange := lspRange{Start: lspPosition{Line: 5, Character: character}, End: lspPosition{Line: 5, Character: character + 4}}
+	if diagnostic.Message != `unused token "tokB"` || diagnostic.Severity != lspSeverityWarning || diagnostic.Range != wantRange {
+		t.Errorf("got %+v, want an unused token warning at %+v", diagnostic, wantRange)
+	}
+
+	if published[1].URI != uri || len(published[1].Diagnostics) != 0 {
+		t.Errorf("got diagnostics %+v, want them cleared for %s", published[1], uri)
+	}
+
+	// A change without content is an error, rather than being ignored.
+	if len(logged) != 1 || logged[0].Type != lspMessageError || !strings.Contains(logged[0].Message, "no content changes") {
+		t.Errorf("got logged messages %+v, want the empty change", logged)
+	}
+}
+
+func TestLSPExitWithoutShutdown(t *testing.T) {
+	err := serveLSP(Config{}, lspRequests(t), io.Discard)
+	if !errors.Is(err, errLSPExitWithoutShutdown) {
+		t.Errorf("got %v, want %v", err, errLSPExitWithoutShutdown)
+	}
+}
@@ -1,80 +1,17 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"context"
-	"crypto/rand"
-	"crypto/sha1"
 	"errors"
 	"fmt"
-	"hash"
+	"io"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
-	"regexp"
-	"runtime"
-	"sort"
 	"strings"
-	"sync"
-	"text/template"
 
-	"github.com/akamensky/base58"
+	"eyecuelab.com/eyecue-codemap/codemap"
 	"github.com/mattn/go-isatty"
-	"golang.org/x/sync/errgroup"
 )
 
-type TokenLocation struct {
-	Filename   string
-	LineNum    int
-	LinkToFile bool
-}
-
-type TokenGroupInfo struct {
-	Token           string
-	FileSource      FileSource
-	StartLineNumber int
-	EndLineNumber   int
-	ActualHash      string
-	ExpectedHash    string
-}
-
-type FileInventory struct {
-	SinglesByToken      map[string][]TokenLocation
-	GroupsByToken       map[string][]TokenGroupInfo
-	MarkdownFileSources []FileSource
-	sync.Mutex
-}
-
-var tagBaseName = func() string {
-	s := os.Getenv("CODEMAP_TAG_BASE")
-	if s != "" {
-		return s
-	}
-
-	return "eyecue-codemap"
-}()
-
-var tokenNeededRegexp = regexp.MustCompile(fmt.Sprintf(`\[%s(-group)?]`, tagBaseName))
-var tokenRegexp = regexp.MustCompile(fmt.Sprintf(`^(.*)\[%s:([A-Za-z0-9]+)](.*)$`, tagBaseName))
-var tokenGroupStartRegexp = regexp.MustCompile(fmt.Sprintf(`\[%s-group:([A-Za-z0-9]+)]`, tagBaseName))
-var tokenGroupEndRegexp = regexp.MustCompile(fmt.Sprintf(`\[end-%s-group:([A-Za-z0-9]+)(:([a-f0-9]{40}))?]`, tagBaseName))
-var tokenRefRegexp = regexp.MustCompile(fmt.Sprintf(`<!--%s:[A-Za-z0-9]+-->]\(.*?\)`, tagBaseName))
-var tokenGroupRefRegexp = regexp.MustCompile(fmt.Sprintf(`(?s)(<!--%s-group:([A-Za-z0-9]+):(.+?)-->)\n(.*?)(<!--end-%s-group-->)`, tagBaseName, tagBaseName))
-
-var ignoreExtensions = []string{
-	".csv",
-	".jpeg",
-	".jpg",
-	".otf",
-	".png",
-	".ttf",
-	".webp",
-	".woff",
-	".woff2",
-}
-
 var Version = "dev"
 
 type FilenameSource int
@@ -84,43 +21,181 @@ const (
 	FilenameSourceStdinNul
 	FilenameSourceGit
 	FilenameSourceGitIndex
+	FilenameSourceGitRevision
+)
+
+type OutputFormat int
+
+const (
+	OutputFormatText OutputFormat = iota
+	OutputFormatJSON
+	OutputFormatSARIF
 )
 
 type Config struct {
-	AckGroups      bool
+	AckGroups bool
+	// AckInteractive asks before acking each changed block.
+	AckInteractive bool
 	CheckOnly      bool
 	FilenameSource FilenameSource
+	Format         OutputFormat
 	NoUnused       bool
 	Verbose        bool
+	// MigrateHashes rewrites the hashes of unchanged group blocks in the configured format.
+	MigrateHashes bool
+	// ShowDiff prints how each changed group block differs from its acked content.
+	ShowDiff bool
+	// Since limits the run to the changes since this revision, and Diff to the changes in this range of commits.
+	Since string
+	Diff  string
+	// Revision is the commit, tag or tree whose files are checked with FilenameSourceGitRevision.
+	Revision string
+	// Submodules lists the files of checked-out submodules with the files listed by Git.
+	Submodules bool
+	// Watch keeps running, updating whenever files change.
+	Watch bool
+	// LSP runs a language server over stdin and stdout.
+	LSP bool
+	// InstallHooks adds a check of the Git index to the pre-commit hook, and UninstallHooks removes it.
+	InstallHooks   bool
+	UninstallHooks bool
+	// HookPrePush installs the pre-push hook too.
+	HookPrePush bool
+	// HookCommand runs eyecue-codemap from the hooks, e.g. the path of a wrapper script.
+	HookCommand string
+	// NoCache inventories every file, without reading or writing the inventory cache.
+	NoCache bool
+	// CacheCommand is set for the cache subcommand, and CacheAction is what it does, e.g. "clear".
+	CacheCommand bool
+	CacheAction  string
+	// ConfigFile overrides the discovery of the project configuration file.
+	ConfigFile string
+	// Options are the library options set by command line flags.
+	Options codemap.Options
 }
 
-type FileSource struct {
-	Filename     string
-	FromGitIndex bool
+func (c Config) Mode() codemap.Mode {
+	if c.AckGroups {
+		return codemap.ModeAck
+	}
+
+	if c.MigrateHashes {
+		return codemap.ModeMigrateHashes
+	}
+
+	if c.CheckOnly {
+		return codemap.ModeCheck
+	}
+
+	return codemap.ModeUpdate
 }
 
+// out receives human-readable messages. It is stderr when stdout is reserved for a report.
+var out io.Writer = os.Stdout
+
 var ErrMarkdownInvalid = errors.New("invalid token usage in Markdown")
 
 func main() {
 	var config Config
 
 	for _, arg := range os.Args[1:] {
-		switch arg {
+		// Options with values are written as --name=value
+		name, value := arg, ""
+		if i := strings.Index(arg, "="); i != -1 && strings.HasPrefix(arg, "--") {
+			name, value = arg[:i], arg[i+1:]
+		}
+
+		switch name {
 		case "--help", "-h":
 			fmt.Printf("eyecue-codemap version %s\n"+
-				"Usage: eyecue-codemap [--check-only] [--git-index] [--no-unused]\n"+
-				"If not using --git-index, pipe in a list of filenames to stdin, one per line.\n", Version)
+				"Usage: eyecue-codemap [ack [-i] [TOKEN|FILE:LINE ...]|migrate-hashes|watch|lsp] [--check-only] [--git-index|--rev=REV] [--no-unused] [--show-diff] [--format=text|json|sarif] [--config=FILE]\n"+
+				"                      [--since=REV|--diff=BASE...HEAD] [--no-cache] [--submodules]\n"+
+				"                      [--link-style=relative|github|gitlab|bitbucket|template] [--link-repo=URL]\n"+
+				"                      [--link-ref=REF] [--link-pin] [--link-template=TEMPLATE]\n"+
+				"                      [--group-hash=sha1|sha256|sha256-short]\n"+
+				"       eyecue-codemap install-hooks [--pre-push] [--hook-command=COMMAND] | uninstall-hooks | cache clear\n"+
+				"If not using --git-index or --rev, pipe in a list of filenames to stdin, one per line.\n"+
+				"--rev checks the files of a commit, tag or tree with its configuration, without checking it out.\n"+
+				"ack acks every changed group block, or only the blocks of the given groups and containing the given lines.\n"+
+				"ack -i shows the changes to each block and asks before acking it.\n"+
+				"migrate-hashes rewrites the hash of every unchanged group block in the --group-hash format.\n"+
+				"--since and --diff only process the Markdown files and groups affected by the changes since REV, or between BASE and HEAD.\n"+
+				"--show-diff finds the content of each changed block when it was last acked in the Git history, and shows the changes since.\n"+
+				"watch lists files with Git, then updates links and reports changed groups whenever files change.\n"+
+				"lsp runs a language server over stdin and stdout, for editors.\n"+
+				"install-hooks adds a check of the Git index to the pre-commit (and pre-push) hook, or to the husky, lefthook\n"+
+				"or pre-commit configuration. The hooks run COMMAND, which defaults to eyecue-codemap.\n"+
+				"--submodules lists the files of checked-out submodules with the files listed by Git.\n"+
+				"Unchanged files are inventoried from a cache in the Git directory. --no-cache skips it, and cache clear deletes it.\n", Version)
 			os.Exit(0)
 		case "ack":
 			config.AckGroups = true
+		case "-i", "--interactive":
+			config.AckInteractive = true
+		case "migrate-hashes":
+			config.MigrateHashes = true
+		case "watch":
+			config.Watch = true
+		case "lsp":
+			config.LSP = true
+		case "install-hooks":
+			config.InstallHooks = true
+		case "uninstall-hooks":
+			config.UninstallHooks = true
+		case "cache":
+			config.CacheCommand = true
+		case "--submodules":
+			config.Submodules = true
+		case "--no-cache":
+			config.NoCache = true
+		case "--pre-push":
+			config.HookPrePush = true
+		case "--hook-command":
+			config.HookCommand = value
 		case "--check-only":
 			config.CheckOnly = true
+		case "--config":
+			config.ConfigFile = value
 		case "--git":
 			config.FilenameSource = FilenameSourceGit
 		case "--git-index":
 			config.FilenameSource = FilenameSourceGitIndex
+		case "--rev":
+			config.FilenameSource = FilenameSourceGitRevision
+			config.Revision = value
+		case "--format":
+			switch value {
+			case "text":
+				config.Format = OutputFormatText
+			case "json":
+				config.Format = OutputFormatJSON
+			case "sarif":
+				config.Format = OutputFormatSARIF
+			default:
+				fmt.Printf("ERROR: unrecognized format: %s\n", value)
+				os.Exit(2)
+			}
+		case "--group-hash":
+			config.Options.GroupHash = codemap.HashFormat(value)
+		case "--link-style":
+			config.Options.LinkStyle.Kind = codemap.LinkKind(value)
+		case "--link-repo":
+			config.Options.LinkStyle.RepoURL = value
+		case "--link-ref":
+			config.Options.LinkStyle.Ref = value
+		case "--link-pin":
+			config.Options.LinkStyle.Pin = true
+		case "--link-template":
+			config.Options.LinkStyle.Kind = codemap.LinkTemplate
+			config.Options.LinkStyle.Template = value
 		case "--no-unused":
 			config.NoUnused = true
+		case "--show-diff":
+			config.ShowDiff = true
+		case "--since":
+			config.Since = value
+		case "--diff":
+			config.Diff = value
 		case "--stdin":
 			config.FilenameSource = FilenameSourceStdin
 		case "--stdin0":
@@ -128,6 +203,17 @@ func main() {
 		case "--verbose":
 			config.Verbose = true
 		default:
+			// After ack, other arguments select the groups and blocks to ack.
+			if config.AckGroups && !strings.HasPrefix(arg, "-") {
+				config.Options.AckOnly = append(config.Options.AckOnly, arg)
+				continue
+			}
+
+			if config.CacheCommand && config.CacheAction == "" && !strings.HasPrefix(arg, "-") {
+				config.CacheAction = arg
+				continue
+			}
+
 			fmt.Printf("ERROR: unrecognized argument: %s\n", arg)
 			os.Exit(2)
 		}
@@ -138,896 +224,627 @@ func main() {
 		os.Exit(2)
 	}
 
-	if config.AckGroups && config.CheckOnly {
-		fmt.Println("ERROR: cannot specify both ack and --check-only")
+	if config.FilenameSource == FilenameSourceGitRevision && !config.CheckOnly {
+		fmt.Println("ERROR: --check-only must be specified when using --rev")
 		os.Exit(2)
 	}
 
-	err := run(config)
-	if err != nil {
-		if !errors.Is(err, ErrMarkdownInvalid) {
-			fmt.Printf("ERROR: %v\n", err)
-		}
-		fmt.Println("eyecue-codemap completed with errors")
-		os.Exit(1)
+	if config.FilenameSource == FilenameSourceGitRevision && (config.Since != "" || config.Diff != "" || config.ShowDiff) {
+		fmt.Println("ERROR: --rev cannot be combined with --since, --diff or --show-diff")
+		os.Exit(2)
 	}
 
-	fmt.Println("eyecue-codemap completed successfully")
-}
-
-func run(config Config) error {
-	var modeDesc string
-
-	switch config.FilenameSource {
-	case FilenameSourceGit:
-		modeDesc = "Git"
-	case FilenameSourceGitIndex:
-		modeDesc = "Git index"
-	case FilenameSourceStdin:
-		modeDesc = "stdin"
-	case FilenameSourceStdinNul:
-		modeDesc = "stdin, NUL delimited"
+	if config.AckGroups && config.CheckOnly {
+		fmt.Println("ERROR: cannot specify both ack and --check-only")
+		os.Exit(2)
 	}
 
-	if config.CheckOnly {
-		modeDesc += ", check only"
+	if config.AckInteractive && (!config.AckGroups || config.Format != OutputFormatText) {
+		fmt.Println("ERROR: -i can only be used with ack, and not with --format")
+		os.Exit(2)
 	}
 
-	if config.AckGroups {
-		modeDesc += ", ack groups"
+	if config.MigrateHashes && (config.AckGroups || config.CheckOnly || config.Watch || config.LSP) {
+		fmt.Println("ERROR: migrate-hashes cannot be combined with ack, watch, lsp or --check-only")
+		os.Exit(2)
 	}
 
-	fmt.Printf("eyecue-codemap %s running (filenames from %s) ...\n", Version, modeDesc)
-
-	var fileSources []FileSource
-	var err error
-
-	switch config.FilenameSource {
-	case FilenameSourceGit:
-		fileSources, err = readFilenamesFromGit()
-	case FilenameSourceGitIndex:
-		fileSources, err = readFilenamesFromGitIndex()
-	case FilenameSourceStdin:
-		fileSources, err = readFilenamesFromStdin(false)
-	case FilenameSourceStdinNul:
-		fileSources, err = readFilenamesFromStdin(true)
-	}
-	if err != nil {
-		return err
+	if config.Watch && (config.AckGroups || config.CheckOnly || config.FilenameSource == FilenameSourceGitIndex || config.Format != OutputFormatText) {
+		fmt.Println("ERROR: watch cannot be combined with ack, --check-only, --git-index or --format")
+		os.Exit(2)
 	}
 
-	fileInventory, err := inventoryFiles(config, fileSources)
-	if err != nil {
-		return err
+	if config.LSP && (config.AckGroups || config.CheckOnly || config.Watch || config.FilenameSource == FilenameSourceGitIndex || config.Format != OutputFormatText) {
+		fmt.Println("ERROR: lsp cannot be combined with ack, watch, --check-only, --git-index or --format")
+		os.Exit(2)
 	}
 
-	// Prohibit tokens from being used in both groups and single-line locations.
-	for token := range fileInventory.SinglesByToken {
-		if _, ok := fileInventory.GroupsByToken[token]; ok {
-			return fmt.Errorf("cannot use same token for group and single-line: %s", token)
-		}
+	if config.Since != "" && config.Diff != "" {
+		fmt.Println("ERROR: cannot specify both --since and --diff")
+		os.Exit(2)
 	}
 
-	unusedTokens := make(map[string]struct{})
-	var dupTokensErrs []string
-
-	for token, tokenLocs := range fileInventory.SinglesByToken {
-		if len(tokenLocs) > 1 {
-			errMsg := fmt.Sprintf("duplicate token \"%s\" at:", token)
-			for _, tokenLoc := range tokenLocs {
-				errMsg = fmt.Sprintf("%s\n   %s:%d", errMsg, tokenLoc.Filename, tokenLoc.LineNum)
-			}
-			dupTokensErrs = append(dupTokensErrs, errMsg)
-		}
-
-		unusedTokens[token] = struct{}{}
+	if (config.Since != "" || config.Diff != "") && (config.AckGroups || config.MigrateHashes || config.Watch || config.LSP) {
+		fmt.Println("ERROR: --since and --diff cannot be combined with ack, migrate-hashes, watch or lsp")
+		os.Exit(2)
 	}
 
-	if len(dupTokensErrs) > 0 {
-		return errors.New(strings.Join(dupTokensErrs, "\n"))
+	if config.CacheCommand && config.CacheAction != "clear" {
+		fmt.Println("ERROR: expected cache clear")
+		os.Exit(2)
 	}
 
-	// check or update the Markdown files
-	hadCheckErrors := false
-	for _, fileSource := range fileInventory.MarkdownFileSources {
-		checkErrors, err := processMarkdownFile(config, fileSource, fileInventory, unusedTokens)
-		if err != nil {
-			return err
-		}
-
-		if len(checkErrors) > 0 {
-			hadCheckErrors = true
-			fmt.Println(strings.Join(checkErrors, "\n"))
-		}
+	if (config.HookPrePush || config.HookCommand != "") && !config.InstallHooks {
+		fmt.Println("ERROR: --pre-push and --hook-command can only be used with install-hooks")
+		os.Exit(2)
 	}
 
-	// show unused tokens
-	var unusedTokenErrs []string
-	for token := range unusedTokens {
-		tokenLoc := fileInventory.SinglesByToken[token][0]
-		msg := fmt.Sprintf(`unused token "%s" at %s:%d`, token, tokenLoc.Filename, tokenLoc.LineNum)
-		unusedTokenErrs = append(unusedTokenErrs, msg)
+	if (config.InstallHooks || config.UninstallHooks) && (config.InstallHooks == config.UninstallHooks || config.AckGroups || config.CheckOnly || config.MigrateHashes || config.Watch || config.LSP || config.Format != OutputFormatText) {
+		fmt.Println("ERROR: install-hooks and uninstall-hooks cannot be combined with each other, ack, migrate-hashes, watch, lsp, --check-only or --format")
+		os.Exit(2)
 	}
 
-	if len(unusedTokenErrs) > 0 {
-		fmt.Println(strings.Join(unusedTokenErrs, "\n"))
+	if config.Format != OutputFormatText || config.LSP {
+		out = os.Stderr
 	}
 
-	// Process groups
-	if config.AckGroups {
-		err := ackTokenGroups(config, fileInventory)
+	if config.CacheCommand {
+		err := clearCache()
 		if err != nil {
-			return err
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if config.InstallHooks || config.UninstallHooks {
+		var err error
+		if config.InstallHooks {
+			err = installHooks(config)
+		} else {
+			err = uninstallHooks()
 		}
-	} else {
-		err := checkTokenGroups(fileInventory)
 		if err != nil {
-			return err
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+			os.Exit(1)
 		}
+		return
 	}
 
-	if config.NoUnused && len(unusedTokenErrs) > 0 || hadCheckErrors {
-		return ErrMarkdownInvalid
+	// The language server loads the configuration when it's initialized.
+	if config.LSP {
+		err := serveLSP(config, os.Stdin, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	return nil
-}
+	if config.FilenameSource == FilenameSourceGitRevision {
+		revisionFS, err := codemap.NewGitRevisionFileSystem(config.Revision)
+		if err != nil {
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+			os.Exit(2)
+		}
 
-func inventoryFiles(config Config, fileSources []FileSource) (*FileInventory, error) {
-	fileInventory := &FileInventory{
-		SinglesByToken: map[string][]TokenLocation{},
-		GroupsByToken:  map[string][]TokenGroupInfo{},
+		config.Options.FileSystem = revisionFS
 	}
 
-	fileSourcesCh := make(chan FileSource, len(fileSources))
-	for _, fileSource := range fileSources {
-		fileSourcesCh <- fileSource
+	err := loadProjectConfig(&config)
+	if err != nil {
+		fmt.Fprintf(out, "ERROR: %v\n", err)
+		os.Exit(2)
 	}
-	close(fileSourcesCh)
 
-	wg, wgCtx := errgroup.WithContext(context.Background())
-	wg.SetLimit(runtime.GOMAXPROCS(0))
-LOOP:
-	for {
-		select {
-		case <-wgCtx.Done():
-			break LOOP
-		case fileSource, ok := <-fileSourcesCh:
-			if !ok {
-				break LOOP
-			}
+	if config.Watch {
+		err := watch(config)
+		if err != nil {
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-			wg.Go(func() error {
-				err := inventoryFileAndGenerateTokens(config, fileSource, fileInventory)
-				if err != nil {
-					return err
-				}
+	result, err := run(config)
 
-				if strings.ToLower(path.Ext(fileSource.Filename)) == ".md" {
-					fileInventory.Lock()
-					fileInventory.MarkdownFileSources = append(fileInventory.MarkdownFileSources, fileSource)
-					fileInventory.Unlock()
-				}
+	switch config.Format {
+	case OutputFormatText:
+		if result != nil {
+			printResult(config, result)
+		}
+	case OutputFormatJSON, OutputFormatSARIF:
+		writeReport := writeJSONReport
+		if config.Format == OutputFormatSARIF {
+			writeReport = writeSARIFReport
+		}
 
-				return nil
-			})
+		reportErr := writeReport(os.Stdout, config, result, err)
+		if reportErr != nil {
+			fmt.Fprintf(out, "ERROR: failed to write report: %v\n", reportErr)
+			os.Exit(1)
 		}
 	}
 
-	err := wg.Wait()
-	if err != nil {
-		return nil, err
+	if err == nil {
+		err = resultError(config, result)
 	}
 
-	for _, groupInfos := range fileInventory.GroupsByToken {
-		sort.Slice(groupInfos, func(i, j int) bool {
-			if groupInfos[i].FileSource.Filename == groupInfos[j].FileSource.Filename {
-				return groupInfos[i].StartLineNumber < groupInfos[j].StartLineNumber
-			}
-
-			return groupInfos[i].FileSource.Filename < groupInfos[j].FileSource.Filename
-		})
+	if err != nil {
+		if !errors.Is(err, ErrMarkdownInvalid) {
+			fmt.Fprintf(out, "ERROR: %v\n", err)
+		}
+		fmt.Fprintln(out, "eyecue-codemap completed with errors")
+		os.Exit(1)
 	}
 
-	return fileInventory, nil
+	fmt.Fprintln(out, "eyecue-codemap completed successfully")
 }
 
-func inventoryFileAndGenerateTokens(config Config, fileSource FileSource, fileInventory *FileInventory) error {
-	for _, ext := range ignoreExtensions {
-		if strings.HasSuffix(fileSource.Filename, ext) {
-			return nil
-		}
-	}
+func run(config Config) (*codemap.Result, error) {
+	var modeDesc string
 
-	fileBytes, err := readFile(config, fileSource)
-	if err != nil {
-		return fmt.Errorf(`failed to read "%s": %w`, fileSource.Filename, err)
+	switch config.FilenameSource {
+	case FilenameSourceGit:
+		modeDesc = "Git"
+	case FilenameSourceGitIndex:
+		modeDesc = "Git index"
+	case FilenameSourceGitRevision:
+		modeDesc = "Git revision " + config.Revision
+	case FilenameSourceStdin:
+		modeDesc = "stdin"
+	case FilenameSourceStdinNul:
+		modeDesc = "stdin, NUL delimited"
 	}
 
-	// generate tokens
-	if !config.CheckOnly {
-		changed := false
-		fileBytes = tokenNeededRegexp.ReplaceAllFunc(fileBytes, func(matched []byte) []byte {
-			changed = true
-			token := generateToken()
-			fmt.Printf("Added new token \"%s\" to \"%s\"\n", token, fileSource.Filename)
-			return []byte("[" + string(matched[1:len(matched)-1]) + ":" + token + "]")
-		})
+	if config.CheckOnly {
+		modeDesc += ", check only"
+	}
 
-		if changed {
-			err := os.WriteFile(fileSource.Filename, fileBytes, 0)
-			if err != nil {
-				return fmt.Errorf(`failed to write "%s": %w`, fileSource.Filename, err)
-			}
-		}
+	if config.AckGroups {
+		modeDesc += ", ack groups"
 	}
 
-	err = inventoryTokenGroups(fileSource, fileBytes, fileInventory)
-	if err != nil {
-		return err
+	if config.MigrateHashes {
+		modeDesc += ", migrate hashes"
 	}
 
-	// We'll link to the entire file (instead of a specific line) for any [eyecue-codemap] that:
-	// * Is preceded only by the shebang and/or blank lines
-	// * Is followed by a blank line or EOF
-	linkToFile := true
+	if config.Since != "" {
+		modeDesc += ", changes since " + config.Since
+	}
 
-	// inventory tokens
-	currentLine := 1
-	var line string
-	var peekLine bool
-	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
-	for {
-		if peekLine {
-			peekLine = false
-		} else {
-			if !scn.Scan() {
-				break
-			}
-			line = scn.Text()
-		}
+	if config.Diff != "" {
+		modeDesc += ", changes in " + config.Diff
+	}
 
-		doneScanning := false
-
-		m := tokenRegexp.FindAllStringSubmatch(line, -1)
-
-		// If we found a token, and we still think we want to link to the file,
-		// check the next line to make sure it's blank or EOF.
-		if linkToFile && len(m) > 0 {
-			if scn.Scan() {
-				peekLine = true
-				line = scn.Text()
-				if strings.TrimSpace(line) != "" {
-					linkToFile = false
-				}
-			} else {
-				// no more lines, we'll link to the file
-				doneScanning = true
-			}
-		}
+	fmt.Fprintf(out, "eyecue-codemap %s running (filenames from %s) ...\n", Version, modeDesc)
 
-		for _, match := range m {
-			before := strings.TrimSpace(match[1])
-			token := match[2]
-			after := strings.TrimSpace(match[3])
-
-			// If the only thing on the line is the codemap comment,
-			// link to the next line. Add more comment strings here as needed.
-			lineNum := currentLine
-			if after == "" && (before == "//" || before == "#") {
-				lineNum++
-			} else if before == "<!--" && after == "-->" {
-				lineNum++
-			}
+	var fileSources []codemap.FileSource
+	var err error
 
-			fileInventory.Lock()
-			fileInventory.SinglesByToken[token] = append(fileInventory.SinglesByToken[token], TokenLocation{
-				Filename:   fileSource.Filename,
-				LineNum:    lineNum,
-				LinkToFile: linkToFile,
-			})
-			fileInventory.Unlock()
-		}
+	switch config.FilenameSource {
+	case FilenameSourceGit:
+		fileSources, err = codemap.ReadFilenamesFromGit()
+	case FilenameSourceGitIndex:
+		fileSources, err = codemap.ReadFilenamesFromGitIndex()
+	case FilenameSourceGitRevision:
+		fileSources, err = config.Options.FileSystem.(*codemap.GitRevisionFileSystem).ReadFilenames()
+	case FilenameSourceStdin:
+		fileSources, err = readFilenamesFromStdin(false)
+	case FilenameSourceStdinNul:
+		fileSources, err = readFilenamesFromStdin(true)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		if doneScanning {
-			break
-		}
+	opts, err := libraryOptions(config)
+	if err != nil {
+		return nil, err
+	}
 
-		if linkToFile && !(strings.HasPrefix(line, "#!") || strings.TrimSpace(line) == "") {
-			linkToFile = false
+	// Submodule files are read from their working directories, even with --git-index.
+	if config.FilenameSource == FilenameSourceGit || config.FilenameSource == FilenameSourceGitIndex {
+		fileSources, err = appendSubmoduleFilenames(fileSources, opts)
+		if err != nil {
+			return nil, err
 		}
-
-		currentLine++
 	}
-	if scn.Err() != nil {
-		if errors.Is(scn.Err(), bufio.ErrTooLong) {
-			// probably not a text file. This is OK.
-			return nil
-		}
 
-		return fmt.Errorf(`failed to scan "%s": %w`, fileSource.Filename, scn.Err())
+	switch {
+	case config.Since != "":
+		opts.Changed, err = codemap.ChangeSetSince(opts, config.Since, config.FilenameSource == FilenameSourceGitIndex)
+	case config.Diff != "":
+		opts.Changed, err = codemap.ChangeSetOfDiff(opts, config.Diff)
 	}
-
-	return nil
-}
-
-func inventoryTokenGroups(fileSource FileSource, fileBytes []byte, fileInventory *FileInventory) error {
-	type CurrentGroup struct {
-		Hasher          hash.Hash
-		Token           string
-		StartLineNumber int
+	if err != nil {
+		return nil, err
 	}
-	var currentGroup *CurrentGroup
-
-	currentLine := 1
 
-	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
-	scn.Split(scanLinesWithNewlines)
-	for scn.Scan() {
-		line := scn.Text()
+	if config.AckInteractive {
+		prompter, closePrompter, err := newAckPrompter(opts)
+		if err != nil {
+			return nil, err
+		}
+		defer closePrompter()
 
-		groupMatch := tokenGroupEndRegexp.FindStringSubmatch(line)
-		if len(groupMatch) > 0 {
-			token := groupMatch[1]
-			expectedHash := groupMatch[3]
+		opts.ConfirmAck = prompter.confirm
+	}
 
-			if currentGroup == nil {
-				return fmt.Errorf(`end-%s-group for unknown group "%s" (%s:%d)`, tagBaseName, token, fileSource.Filename, currentLine)
-			}
+	// The cache only knows about the working directory and the Git index.
+	if !config.NoCache && config.FilenameSource != FilenameSourceGitRevision {
+		opts.Cache = openCache(config)
+	}
 
-			fileInventory.Lock()
-			fileInventory.GroupsByToken[token] = append(fileInventory.GroupsByToken[token], TokenGroupInfo{
-				Token:           token,
-				FileSource:      fileSource,
-				StartLineNumber: currentGroup.StartLineNumber,
-				EndLineNumber:   currentLine,
-				ActualHash:      fmt.Sprintf("%x", currentGroup.Hasher.Sum(nil)),
-				ExpectedHash:    expectedHash,
-			})
-			fileInventory.Unlock()
-
-			currentGroup = nil
-		}
+	result, err := codemap.Run(opts, config.Mode(), fileSources)
 
-		if currentGroup != nil {
-			_, err := currentGroup.Hasher.Write(scn.Bytes())
-			if err != nil {
-				return err
-			}
+	if err == nil && opts.Cache != nil {
+		saveErr := opts.Cache.Save()
+		if saveErr != nil {
+			fmt.Fprintf(out, "WARNING: failed to save the inventory cache: %v\n", saveErr)
 		}
+	}
 
-		groupMatch = tokenGroupStartRegexp.FindStringSubmatch(line)
-		if len(groupMatch) > 0 {
-			token := groupMatch[1]
-			if currentGroup != nil {
-				return fmt.Errorf(`overlapping %s-group "%s" not allowed (%s:%d)`, tagBaseName, token, fileSource.Filename, currentLine)
-			}
+	return result, err
+}
 
-			currentGroup = &CurrentGroup{
-				Hasher:          sha1.New(),
-				Token:           token,
-				StartLineNumber: currentLine,
-			}
+// openCache opens the inventory cache in the Git directory. Without one, or if the cache can't be
+// read, every file is inventoried.
+func openCache(config Config) *codemap.InventoryCache {
+	filename, err := codemap.DefaultCacheFilename()
+	if err != nil {
+		if config.Verbose {
+			fmt.Fprintf(out, "not using the inventory cache: %v\n", err)
 		}
-
-		currentLine++
+		return nil
 	}
 
-	if currentGroup != nil {
-		return fmt.Errorf("unclosed %s-group in %s", tagBaseName, fileSource.Filename)
+	cache, err := codemap.OpenInventoryCache(filename)
+	if err != nil {
+		fmt.Fprintf(out, "WARNING: not using the inventory cache: %v\n", err)
+		return nil
 	}
 
-	return nil
+	return cache
 }
 
-func ackTokenGroups(config Config, fileInventory *FileInventory) error {
-	groupInfosByFile := map[string][]TokenGroupInfo{}
-
-	for _, groupInfos := range fileInventory.GroupsByToken {
-		for _, groupInfo := range groupInfos {
-			if groupInfo.ActualHash != groupInfo.ExpectedHash {
-				groupInfosByFile[groupInfo.FileSource.Filename] = append(groupInfosByFile[groupInfo.FileSource.Filename], groupInfo)
-			}
-		}
+func clearCache() error {
+	filename, err := codemap.DefaultCacheFilename()
+	if err != nil {
+		return err
 	}
 
-	for _, groupInfos := range groupInfosByFile {
-		err := ackTokenGroupsForFile(config, groupInfos)
-		if err != nil {
-			return err
-		}
+	err = codemap.ClearInventoryCache(filename)
+	if err != nil {
+		return err
 	}
 
+	fmt.Fprintf(out, "Deleted %s\n", filename)
 	return nil
 }
 
-func ackTokenGroupsForFile(config Config, groupInfos []TokenGroupInfo) (err error) {
-	fileSource := groupInfos[0].FileSource
+// libraryOptions completes config.Options for a run.
+func libraryOptions(config Config) (codemap.Options, error) {
+	opts := config.Options
 
-	fileBytes, err := readFile(config, fileSource)
+	err := opts.LinkStyle.ResolveFromGit()
 	if err != nil {
-		return err
+		return opts, err
 	}
 
-	file, err := os.OpenFile(fileSource.Filename, os.O_TRUNC|os.O_WRONLY, 0)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		closeErr := file.Close()
-		if err == nil {
-			err = closeErr
-		}
-	}()
-
-	scn := bufio.NewScanner(bytes.NewReader(fileBytes))
-	scn.Split(scanLinesWithNewlines)
-	currentLine := 0
-	for scn.Scan() {
-		currentLine++
-		lineBytes := scn.Bytes()
-		for _, groupInfo := range groupInfos {
-			if groupInfo.EndLineNumber == currentLine {
-				lineBytes = tokenGroupEndRegexp.ReplaceAll(
-					lineBytes,
-					[]byte(fmt.Sprintf(
-						"[end-%s-group:%s:%s]", tagBaseName,
-						groupInfo.Token,
-						groupInfo.ActualHash,
-					)))
-			}
-		}
-
-		_, err := file.Write(lineBytes)
+	// A revision's submodules aren't checked out.
+	if config.Submodules && config.FilenameSource != FilenameSourceGitRevision {
+		submodules, err := codemap.Submodules()
 		if err != nil {
-			return err
+			return opts, err
 		}
-	}
 
-	return nil
-}
+		opts.Repositories = append(opts.Repositories, submodules...)
+	}
 
-func checkTokenGroups(fileInventory *FileInventory) error {
-	showAckMessage := false
+	opts.Repositories = append([]codemap.Repository{}, opts.Repositories...)
+	for i := range opts.Repositories {
+		repo := &opts.Repositories[i]
 
-	for groupName, groupInfos := range fileInventory.GroupsByToken {
-		showGroup := false
+		// Links are relative to the working directory.
+		if filepath.IsAbs(repo.Path) {
+			wd, err := os.Getwd()
+			if err != nil {
+				return opts, err
+			}
 
-		for _, groupInfo := range groupInfos {
-			if groupInfo.ActualHash != groupInfo.ExpectedHash {
-				showGroup = true
-				break
+			repo.Path, err = filepath.Rel(wd, repo.Path)
+			if err != nil {
+				return opts, err
 			}
 		}
 
-		if showGroup {
-			showAckMessage = true
-			sort.Slice(groupInfos, func(i, j int) bool {
-				return groupInfos[i].FileSource.Filename < groupInfos[j].FileSource.Filename
-			})
-			fmt.Printf("group \"%s\" has changes (indicated with *):\n", groupName)
-			for _, groupInfo := range groupInfos {
-				indicator := " "
-				if groupInfo.ActualHash != groupInfo.ExpectedHash {
-					indicator = "*"
-				}
-
-				fmt.Printf("  %s  %s:%d (lines %d-%d)\n",
-					indicator,
-					groupInfo.FileSource.Filename,
-					groupInfo.StartLineNumber,
-					groupInfo.StartLineNumber+1,
-					groupInfo.EndLineNumber-1,
-				)
-			}
+		err := repo.ResolveFromGit(opts.LinkStyle)
+		if err != nil {
+			return opts, fmt.Errorf("repository %s: %w", repo.Path, err)
 		}
 	}
 
-	if showAckMessage {
-		return errors.New(`edit groups as needed, then re-run with the "ack" argument`)
+	if config.Verbose {
+		opts.Logf = func(format string, args ...interface{}) {
+			fmt.Fprintf(out, format, args...)
+		}
 	}
 
-	return nil
+	return opts, nil
 }
 
-func shouldIncludeFile(filename string) (bool, error) {
-	stat, err := os.Lstat(filename)
+// readFilenamesFromGit lists the files in the working directory with Git, and those of the submodules
+// in opts.Repositories.
+func readFilenamesFromGit(opts codemap.Options) ([]codemap.FileSource, error) {
+	fileSources, err := codemap.ReadFilenamesFromGit()
 	if err != nil {
-		return false, fmt.Errorf(`failed to stat "%s": %w`, filename, err)
-	}
-
-	if stat.Mode().IsRegular() && stat.Size() < 10*1024*1024 {
-		return true, nil
+		return nil, err
 	}
 
-	return false, nil
+	return appendSubmoduleFilenames(fileSources, opts)
 }
 
-func readFilenamesFromStdin(nulDelimiter bool) ([]FileSource, error) {
-	if isatty.IsTerminal(os.Stdin.Fd()) {
-		fmt.Println("WARNING: reading filenames from stdin. Did you forget to pipe in a list of filenames?")
-	}
-
-	var fileSources []FileSource
-
-	scn := bufio.NewScanner(os.Stdin)
-	if nulDelimiter {
-		scn.Split(scanNullDelimited)
-	}
-	for scn.Scan() {
-		filename := strings.TrimPrefix(scn.Text(), "./")
+func appendSubmoduleFilenames(fileSources []codemap.FileSource, opts codemap.Options) ([]codemap.FileSource, error) {
+	for _, repo := range opts.Repositories {
+		// External repositories are listed by the run.
+		if repo.Name != "" {
+			continue
+		}
 
-		shouldInclude, err := shouldIncludeFile(filename)
+		repoFileSources, err := repo.ReadFilenames()
 		if err != nil {
 			return nil, err
 		}
 
-		if shouldInclude {
-			fileSources = append(fileSources, FileSource{
-				Filename:     filename,
-				FromGitIndex: false,
-			})
-		}
-	}
-	if scn.Err() != nil {
-		return nil, fmt.Errorf("failed to read list of filenames from stdin: %w", scn.Err())
+		fileSources = append(fileSources, repoFileSources...)
 	}
 
 	return fileSources, nil
 }
 
-func readFilenamesFromGit() ([]FileSource, error) {
-	cmd := exec.Command("git", "diff-files", "--name-only", "--diff-filter=D", "-z")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("failed to run git diff-files: %s: %w", strings.TrimSpace(string(output)), err)
+// loadProjectConfig fills in the settings that weren't given on the command line
+// from the environment and the project configuration file.
+func loadProjectConfig(config *Config) error {
+	if config.Options.TagBase == "" {
+		config.Options.TagBase = os.Getenv("CODEMAP_TAG_BASE")
 	}
 
-	deletedFilenames := make(map[string]struct{})
+	// A revision is checked with its own configuration.
+	revisionFS, fromRevision := config.Options.FileSystem.(*codemap.GitRevisionFileSystem)
 
-	for _, filenameBytes := range bytes.Split(output, []byte{0}) {
-		deletedFilenames[string(filenameBytes)] = struct{}{}
-	}
+	var projectConfig *codemap.ProjectConfig
+	var err error
 
-	cmd = exec.Command("git", "ls-files", "--cached", "--others", "--exclude-standard", "-z")
-	output, err = cmd.CombinedOutput()
+	if fromRevision && config.ConfigFile == "" {
+		projectConfig, err = loadRevisionProjectConfig(revisionFS)
+	} else {
+		projectConfig, err = loadWorkingDirProjectConfig(config.ConfigFile)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to run git ls-files: %s: %w", strings.TrimSpace(string(output)), err)
+		return err
 	}
 
-	var fileSources []FileSource
+	if projectConfig != nil {
+		projectConfig.ApplyTo(&config.Options)
 
-	for _, filenameBytes := range bytes.Split(output, []byte{0}) {
-		filename := string(filenameBytes)
-		if _, isDeleted := deletedFilenames[filename]; isDeleted {
-			continue
-		}
-
-		shouldInclude, err := shouldIncludeFile(filename)
-		if err != nil {
-			return nil, err
+		if projectConfig.NoUnused {
+			config.NoUnused = true
 		}
 
-		if shouldInclude {
-			fileSources = append(fileSources, FileSource{
-				Filename:     filename,
-				FromGitIndex: false,
-			})
+		if projectConfig.Submodules {
+			config.Submodules = true
 		}
 	}
 
-	return fileSources, nil
-}
+	var ignoreFilename string
+	var ignorePatterns []string
 
-var spacesRegexp = regexp.MustCompile(`\s+`)
+	if fromRevision {
+		ignoreFilename = revisionFS.Revision + ":" + codemap.IgnoreFilename
 
-func readFilenamesFromGitIndex() ([]FileSource, error) {
-	// Determine which files are modified+staged and must be read from the Git index vs. the working dir
-	cmd := exec.Command("git", "diff-index", "--name-only", "-z", "HEAD")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("failed to run git diff-index: %s: %w", strings.TrimSpace(string(output)), err)
+		data, readErr := revisionFS.ReadRootFile(codemap.IgnoreFilename)
+		if readErr == nil {
+			ignorePatterns, err = codemap.ParsePatterns(ignoreFilename, data)
+		} else if !errors.Is(readErr, os.ErrNotExist) {
+			err = readErr
+		}
+	} else {
+		ignoreFilename = filepath.Join(codemap.ProjectRoot(), codemap.IgnoreFilename)
+		ignorePatterns, err = codemap.ReadPatternFile(ignoreFilename)
 	}
-
-	stagedFilenames := make(map[string]struct{})
-
-	for _, filenameBytes := range bytes.Split(output, []byte{0}) {
-		stagedFilenames[string(filenameBytes)] = struct{}{}
+	if err != nil {
+		return err
 	}
 
-	// Get a list of all filenames in the Git index
-	cmd = exec.Command("git", "ls-files", "--stage", "-z")
-	output, err = cmd.CombinedOutput()
+	_, err = codemap.NewPatternList(ignorePatterns)
 	if err != nil {
-		return nil, fmt.Errorf("failed to run git ls-files: %s: %w", strings.TrimSpace(string(output)), err)
+		return fmt.Errorf("%s: %w", ignoreFilename, err)
 	}
 
-	var fileSources []FileSource
-
-	for _, lineBytes := range bytes.Split(output, []byte{0}) {
-		line := string(lineBytes)
-
-		// filter out non-files
-		if !strings.HasPrefix(line, "100") {
-			continue
-		}
+	config.Options.Exclude = append(config.Options.Exclude, ignorePatterns...)
 
-		// Output looks like:
-		// 100644 b438169c25a6cf5649e09d8d51092998fa4e904e 0	Dockerfile
-		parts := spacesRegexp.Split(line, 4)
-		filename := parts[3]
-		_, isStaged := stagedFilenames[filename]
-		fileSources = append(fileSources, FileSource{
-			Filename:     filename,
-			FromGitIndex: isStaged,
-		})
-	}
-
-	return fileSources, nil
+	return nil
 }
 
-func readFile(config Config, fileSource FileSource) ([]byte, error) {
-	if fileSource.FromGitIndex {
-		if config.Verbose {
-			fmt.Printf("git index: reading \"%s\"\n", fileSource.Filename)
+// loadWorkingDirProjectConfig loads filename, or the configuration file in the project root if it's "".
+// It returns nil if there is no configuration file.
+func loadWorkingDirProjectConfig(filename string) (*codemap.ProjectConfig, error) {
+	if filename == "" {
+		var err error
+		filename, err = codemap.FindProjectConfig()
+		if err != nil {
+			return nil, err
 		}
-		return readFileFromGitIndex(fileSource.Filename)
 	}
 
-	if config.Verbose {
-		fmt.Printf("working dir: reading \"%s\"\n", fileSource.Filename)
+	if filename == "" {
+		return nil, nil
 	}
-	return os.ReadFile(fileSource.Filename)
-}
 
-func readFileFromGitIndex(filename string) ([]byte, error) {
-	cmd := exec.Command("git", "show", ":"+filename)
-	output, err := cmd.CombinedOutput()
+	projectConfig, err := codemap.LoadProjectConfig(filename)
 	if err != nil {
-		return nil, fmt.Errorf("git show :%s failed: %w", filename, err)
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	return output, err
+	return projectConfig, nil
 }
 
-type MarkdownContext struct {
-	Changed       bool
-	CheckOny      bool
-	FileBytes     []byte
-	FileInventory *FileInventory
-	Filename      string
-	FilenameDir   string
-	Problems      []string
-	UnusedTokens  map[string]struct{}
-}
+// loadRevisionProjectConfig loads the configuration file at the root of a Git revision.
+// It returns nil if there is no configuration file.
+func loadRevisionProjectConfig(revisionFS *codemap.GitRevisionFileSystem) (*codemap.ProjectConfig, error) {
+	for _, name := range codemap.ConfigFilenames {
+		data, err := revisionFS.ReadRootFile(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
 
-func processMarkdownFile(config Config, mdFileSource FileSource, fileInventory *FileInventory, unusedTokens map[string]struct{}) ([]string, error) {
-	fileBytes, err := readFile(config, mdFileSource)
-	if err != nil {
-		return nil, fmt.Errorf(`failed to read "%s": %w`, mdFileSource.Filename, err)
+		projectConfig, err := codemap.ParseProjectConfig(revisionFS.Revision+":"+name, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+
+		return projectConfig, nil
 	}
 
-	mdContext := &MarkdownContext{
-		CheckOny:      config.CheckOnly,
-		FileBytes:     fileBytes,
-		FileInventory: fileInventory,
-		Filename:      mdFileSource.Filename,
-		FilenameDir:   filepath.Dir(mdFileSource.Filename),
-		UnusedTokens:  unusedTokens,
+	return nil, nil
+}
+
+func printResult(config Config, result *codemap.Result) {
+	for _, change := range result.Changes {
+		fmt.Println(change.Message)
 	}
 
-	err = processTokenRefs(mdContext)
-	if err != nil {
-		return nil, err
+	for _, problem := range result.Problems {
+		fmt.Println(problem.Message)
 	}
 
-	err = processGroupTemplates(mdContext)
-	if err != nil {
-		return nil, err
+	for _, unused := range result.UnusedTokens {
+		fmt.Printf("unused token \"%s\" at %s:%d\n", unused.Token, unused.Filename, unused.LineNum)
 	}
 
-	if !config.CheckOnly && mdContext.Changed {
-		err := os.WriteFile(mdFileSource.Filename, mdContext.FileBytes, 0)
-		if err != nil {
-			return nil, fmt.Errorf(`failed to write "%s": %w`, mdFileSource.Filename, err)
+	for _, group := range result.ChangedGroups {
+		printGroupStatus(group)
+
+		if config.ShowDiff {
+			printGroupDiffs(config.Options, group)
 		}
 	}
-
-	return mdContext.Problems, nil
 }
 
-func processTokenRefs(mdContext *MarkdownContext) error {
-	var resultBuf bytes.Buffer
-
-	fileBytes := mdContext.FileBytes
-
-	lastLine := false
-	for lineNum := 1; !lastLine; lineNum++ {
-		var lineBytes []byte
-		newLineIndex := bytes.IndexByte(fileBytes, '\n')
-		if newLineIndex == -1 {
-			lineBytes = fileBytes
-			lastLine = true
-		} else {
-			lineBytes = fileBytes[:newLineIndex+1]
-			fileBytes = fileBytes[newLineIndex+1:]
+func printGroupStatus(group codemap.GroupStatus) {
+	fmt.Printf("group \"%s\" has changes (indicated with *):\n", group.Token)
+	for _, groupInfo := range group.Blocks {
+		indicator := " "
+		if groupInfo.Changed() {
+			indicator = "*"
 		}
 
-		lineBytes = tokenRefRegexp.ReplaceAllFunc(lineBytes, func(m []byte) []byte {
-			tokenIndex := bytes.IndexByte(m, ':') + 1
-			tokenEndIndex := tokenIndex + bytes.IndexByte(m[tokenIndex:], '-')
-			token := string(m[tokenIndex:tokenEndIndex])
-
-			tokenLocs := mdContext.FileInventory.SinglesByToken[token]
-			if len(tokenLocs) == 0 {
-				mdContext.Problems = append(mdContext.Problems, fmt.Sprintf(`token "%s" at "%s:%d" was not found`, token, mdContext.Filename, lineNum))
-			} else {
-				delete(mdContext.UnusedTokens, token)
-
-				loc := tokenLocs[0]
-				locRelPath, err := filepath.Rel(mdContext.FilenameDir, loc.Filename)
-				if err != nil {
-					panic(err)
-				} else {
-					original := string(m)
-					var mdTarget string
-					var outputTarget string
-					if loc.LinkToFile {
-						mdTarget = locRelPath
-						outputTarget = locRelPath
-					} else {
-						mdTarget = fmt.Sprintf("%s#L%d", locRelPath, loc.LineNum)
-						outputTarget = fmt.Sprintf("%s:%d", locRelPath, loc.LineNum)
-					}
-					replacement := fmt.Sprintf("<!--%s:%s-->](%s)", tagBaseName, token, mdTarget)
-					if original != replacement {
-						if mdContext.CheckOny {
-							mdContext.Problems = append(mdContext.Problems, fmt.Sprintf(`incorrect link at "%s:%d" token "%s"`, mdContext.Filename, lineNum, token))
-						} else {
-							mdContext.Changed = true
-							fmt.Printf("updated link at \"%s:%d\" token \"%s\" -> \"%s\"\n", mdContext.Filename, lineNum, token, outputTarget)
-							return []byte(replacement)
-						}
-					}
-				}
-			}
-
-			return m
-		})
-
-		_, err := resultBuf.Write(lineBytes)
-		if err != nil {
-			return err
+		var primary string
+		if groupInfo.Primary {
+			primary = " primary"
 		}
-	}
-
-	mdContext.FileBytes = resultBuf.Bytes()
 
-	return nil
+		fmt.Printf("  %s  %s:%d (lines %d-%d)%s\n",
+			indicator,
+			groupInfo.FileSource.Filename,
+			groupInfo.StartLineNumber,
+			groupInfo.StartLineNumber+1,
+			groupInfo.EndLineNumber-1,
+			primary,
+		)
+	}
 }
 
-func processGroupTemplates(mdContext *MarkdownContext) error {
-	var resultBuf bytes.Buffer
-
-	remainingIndex := 0
-
-	matches := tokenGroupRefRegexp.FindAllSubmatchIndex(mdContext.FileBytes, -1)
-	for _, match := range matches {
-		_, err := resultBuf.Write(mdContext.FileBytes[remainingIndex:match[0]])
-		if err != nil {
-			return err
+// printGroupDiffs prints how each changed block of group differs from its content when it was last acked.
+func printGroupDiffs(opts codemap.Options, group codemap.GroupStatus) {
+	var primary *codemap.TokenGroupInfo
+	for i := range group.Blocks {
+		if group.Blocks[i].Primary {
+			primary = &group.Blocks[i]
 		}
+	}
 
-		remainingIndex = match[1]
-		lineNum := bytes.Count(mdContext.FileBytes[:match[0]], []byte("\n")) + 1
-		startTag := mdContext.FileBytes[match[2]:match[3]]
-		token := string(mdContext.FileBytes[match[4]:match[5]])
-		templateText := string(mdContext.FileBytes[match[6]:match[7]])
-		existingContent := mdContext.FileBytes[match[8]:match[9]]
-		endTag := mdContext.FileBytes[match[10]:match[11]]
-
-		groupInfos := mdContext.FileInventory.GroupsByToken[token]
-
-		if len(groupInfos) == 0 {
-			mdContext.Problems = append(mdContext.Problems, fmt.Sprintf(`group token "%s" at "%s:%d" was not found`, token, mdContext.Filename, lineNum))
-			_, err := resultBuf.Write(mdContext.FileBytes[match[0]:match[1]])
-			if err != nil {
-				return err
-			}
+	for _, groupInfo := range group.Blocks {
+		if !groupInfo.Changed() {
 			continue
 		}
 
-		tpl, err := template.New("").Parse(templateText)
-		if err != nil {
-			return err
-		}
+		location := fmt.Sprintf("%s:%d", groupInfo.FileSource.Filename, groupInfo.StartLineNumber)
 
-		type GroupTemplateData struct {
-			File              string
-			Line              int
-			FileLine          string
-			RangeHref         string
-			MarkdownRangeLink string
+		if groupInfo.ExpectedHash == "" {
+			fmt.Printf("  %s has never been acked\n", location)
+			continue
 		}
 
-		templateData := make([]GroupTemplateData, len(groupInfos))
-		for i, groupInfo := range groupInfos {
-			fileLine := fmt.Sprintf("%s:%d", groupInfo.FileSource.Filename, groupInfo.StartLineNumber)
-
-			locRelPath, err := filepath.Rel(mdContext.FilenameDir, groupInfo.FileSource.Filename)
-			if err != nil {
-				return err
-			}
-
-			rangeHref := fmt.Sprintf(
-				"%s#L%d-L%d",
-				locRelPath,
-				groupInfo.StartLineNumber+1,
-				groupInfo.EndLineNumber-1,
-			)
-
-			markdownRangeLink := fmt.Sprintf("[%s](%s)", fileLine, rangeHref)
-
-			templateData[i] = GroupTemplateData{
-				File:              groupInfo.FileSource.Filename,
-				Line:              groupInfo.StartLineNumber,
-				FileLine:          fileLine,
-				RangeHref:         rangeHref,
-				MarkdownRangeLink: markdownRangeLink,
-			}
+		blockPrimary := primary
+		if groupInfo.Primary {
+			blockPrimary = nil
 		}
 
-		_, err = resultBuf.Write(startTag)
+		acked, err := codemap.FindAckedBlock(opts, groupInfo, blockPrimary)
 		if err != nil {
-			return err
+			fmt.Printf("  %s: failed to find the acked content: %v\n", location, err)
+			continue
 		}
-		err = resultBuf.WriteByte('\n')
-		if err != nil {
-			return err
+		if acked == nil {
+			fmt.Printf("  %s: the acked content isn't in the Git history\n", location)
+			continue
 		}
 
-		var templateOutputBuf bytes.Buffer
-		err = tpl.Execute(&templateOutputBuf, templateData)
+		content, err := codemap.ReadBlock(opts, groupInfo)
 		if err != nil {
-			return err
+			fmt.Printf("  %s: %v\n", location, err)
+			continue
 		}
 
-		if !bytes.Equal(templateOutputBuf.Bytes(), existingContent) {
-			mdContext.Changed = true
-
-			if mdContext.CheckOny {
-				mdContext.Problems = append(mdContext.Problems, fmt.Sprintf(`incorrect group "%s" template content at "%s:%d"`, token, mdContext.Filename, lineNum))
-			} else {
-				fmt.Printf(`updating group "%s" template content at "%s:%d"`+"\n", token, mdContext.Filename, lineNum)
-			}
+		revision := "index"
+		if acked.Revision != "" {
+			revision = shortRevision(acked.Revision)
 		}
 
-		_, err = resultBuf.Write(templateOutputBuf.Bytes())
-		if err != nil {
-			return err
-		}
+		fmt.Print(codemap.UnifiedDiff(
+			fmt.Sprintf("%s:%d (acked, %s)", acked.Filename, acked.LineNumber, revision),
+			location,
+			acked.Content,
+			content,
+		))
+	}
+}
 
-		_, err = resultBuf.Write(endTag)
-		if err != nil {
-			return err
-		}
+func shortRevision(revision string) string {
+	if len(revision) > 12 {
+		return revision[:12]
 	}
 
-	_, err := resultBuf.Write(mdContext.FileBytes[remainingIndex:])
-	if err != nil {
-		return err
+	return revision
+}
+
+// resultError decides whether the problems in result should fail the run.
+func resultError(config Config, result *codemap.Result) error {
+	if len(result.ChangedGroups) > 0 {
+		return errors.New(`edit groups as needed, then re-run with the "ack" argument`)
+	}
+
+	if config.NoUnused && len(result.UnusedTokens) > 0 || len(result.Problems) > 0 {
+		return ErrMarkdownInvalid
 	}
 
-	mdContext.FileBytes = resultBuf.Bytes()
 	return nil
 }
 
-func generateToken() string {
-	buf := make([]byte, 8)
-	_, err := rand.Read(buf)
+func readFilenamesFromStdin(nulDelimiter bool) ([]codemap.FileSource, error) {
+	if isatty.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprintln(out, "WARNING: reading filenames from stdin. Did you forget to pipe in a list of filenames?")
+	}
+
+	fileSources, err := codemap.ReadFilenames(os.Stdin, nulDelimiter)
 	if err != nil {
-		panic(fmt.Errorf("failed to read random bytes: %w", err))
+		return nil, fmt.Errorf("failed to read list of filenames from stdin: %w", err)
 	}
 
-	return base58.Encode(buf)
+	return fileSources, nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+)
+
+// jsonReportVersion must be incremented whenever the report structure changes incompatibly.
+const jsonReportVersion = 1
+
+type jsonReport struct {
+	Version      int           `json:"version"`
+	Mode         string        `json:"mode"`
+	Success      bool          `json:"success"`
+	Error        string        `json:"error,omitempty"`
+	Problems     []jsonProblem `json:"problems"`
+	Changes      []jsonChange  `json:"changes"`
+	FilesWritten []string      `json:"filesWritten"`
+}
+
+type jsonLocation struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+type jsonProblem struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	jsonLocation
+	EndLine int            `json:"endLine,omitempty"`
+	Token   string         `json:"token"`
+	Message string         `json:"message"`
+	Related []jsonLocation `json:"related,omitempty"`
+}
+
+type jsonChange struct {
+	Code string `json:"code"`
+	jsonLocation
+	Token   string `json:"token"`
+	Message string `json:"message"`
+}
+
+// writeJSONReport writes a single JSON document describing the run. runErr is
+// the error that stopped the run, if any; result may be nil when runErr is set.
+func writeJSONReport(w io.Writer, config Config, result *codemap.Result, runErr error) error {
+	report := jsonReport{
+		Version:      jsonReportVersion,
+		Mode:         config.Mode().String(),
+		Problems:     []jsonProblem{},
+		Changes:      []jsonChange{},
+		FilesWritten: []string{},
+	}
+
+	if runErr != nil {
+		report.Error = runErr.Error()
+	} else {
+		report.Success = resultError(config, result) == nil
+		report.Problems = jsonProblems(config, result)
+
+		for _, change := range result.Changes {
+			report.Changes = append(report.Changes, jsonChange{
+				Code:         string(change.Kind),
+				jsonLocation: jsonLocation{File: change.Filename, Line: change.Line, Column: change.Column},
+				Token:        change.Token,
+				Message:      change.Message,
+			})
+		}
+
+		seen := map[string]struct{}{}
+		for _, filename := range result.FilesWritten {
+			if _, ok := seen[filename]; !ok {
+				seen[filename] = struct{}{}
+				report.FilesWritten = append(report.FilesWritten, filename)
+			}
+		}
+		sort.Strings(report.FilesWritten)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func jsonProblems(config Config, result *codemap.Result) []jsonProblem {
+	problems := []jsonProblem{}
+
+	for _, problem := range result.Problems {
+		p := jsonProblem{
+			Code:         string(problem.Kind),
+			Severity:     "error",
+			jsonLocation: jsonLocation{File: problem.Filename, Line: problem.Line, Column: problem.Column},
+			Token:        problem.Token,
+			Message:      problem.Message,
+		}
+		for _, loc := range problem.Related {
+			p.Related = append(p.Related, jsonLocation{File: loc.Filename, Line: loc.Line, Column: loc.Column})
+		}
+		problems = append(problems, p)
+	}
+
+	unusedSeverity := "warning"
+	if config.NoUnused {
+		unusedSeverity = "error"
+	}
+
+	for _, unused := range result.UnusedTokens {
+		problems = append(problems, jsonProblem{
+			Code:         string(codemap.ProblemUnusedToken),
+			Severity:     unusedSeverity,
+			jsonLocation: jsonLocation{File: unused.Filename, Line: unused.LineNum, Column: unused.Column},
+			Token:        unused.Token,
+			Message:      `unused token "` + unused.Token + `"`,
+		})
+	}
+
+	for _, group := range result.ChangedGroups {
+		for i, block := range group.Blocks {
+			if !block.Changed() {
+				continue
+			}
+
+			p := jsonProblem{
+				Code:     string(codemap.ProblemGroupChanged),
+				Severity: "error",
+				jsonLocation: jsonLocation{
+					File:   block.FileSource.Filename,
+					Line:   block.StartLineNumber,
+					Column: block.StartColumn,
+				},
+				EndLine: block.EndLineNumber,
+				Token:   group.Token,
+				Message: `group "` + group.Token + `" block has changed since it was last acknowledged`,
+			}
+			for j, sibling := range group.Blocks {
+				if j != i {
+					p.Related = append(p.Related, jsonLocation{
+						File:   sibling.FileSource.Filename,
+						Line:   sibling.StartLineNumber,
+						Column: sibling.StartColumn,
+					})
+				}
+			}
+			problems = append(problems, p)
+		}
+	}
+
+	return problems
+}
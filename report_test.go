@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+)
+
+// jsonReportOf writes the JSON report of a run and reads it back.
+func jsonReportOf(t *testing.T, config Config, result *codemap.Result, runErr error) jsonReport {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := writeJSONReport(&buf, config, result, runErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report jsonReport
+	err = json.Unmarshal(buf.Bytes(), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return report
+}
+
+func TestJSONReport(t *testing.T) {
+	inGitRepo(t, map[string]string{
+		"a.go":   "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n\n// [" + tagBase + ":tokB]\nvar b = 1\n",
+		"doc.md": "See [a<!--" + tagBase + ":tokA-->]() and [c<!--" + tagBase + ":tokC-->]().\n",
+	})
+	fileSources := []codemap.FileSource{{Filename: "a.go"}, {Filename: "doc.md"}}
+
+	result, err := codemap.Update(codemap.Options{}, fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := jsonReportOf(t, Config{}, result, nil)
+
+	if report.Version != jsonReportVersion || report.Mode != "update" || report.Success {
+		t.Errorf("got %+v, want an unsuccessful update", report)
+	}
+	if !reflect.DeepEqual(report.FilesWritten, []string{"doc.md"}) {
+		t.Errorf("got files written %v, want doc.md", report.FilesWritten)
+	}
+	if len(report.Changes) != 1 || report.Changes[0].Token != "tokA" || report.Changes[0].File != "doc.md" || report.Changes[0].Line != 1 {
+		t.Errorf("got changes %+v, want the link to tokA", report.Changes)
+	}
+
+	codes := map[string]string{}
+	for _, problem := range report.Problems {
+		codes[problem.Token] = problem.Code + " " + problem.Severity
+	}
+	want := map[string]string{
+		"tokC": string(codemap.ProblemTokenNotFound) + " error",
+		"tokB": string(codemap.ProblemUnusedToken) + " warning",
+	}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("got problems %+v, want %v", report.Problems, want)
+	}
+
+	// Unused tokens are errors with --no-unused.
+	report = jsonReportOf(t, Config{NoUnused: true, CheckOnly: true}, result, nil)
+	for _, problem := range report.Problems {
+		if problem.Severity != "error" {
+			t.Errorf("--no-unused: got %+v, want an error", problem)
+		}
+	}
+	if report.Mode != "check" {
+		t.Errorf("got mode %q, want check", report.Mode)
+	}
+}
+
+func TestJSONReportError(t *testing.T) {
+	report := jsonReportOf(t, Config{}, nil, errors.New("failed"))
+
+	if report.Success || report.Error != "failed" {
+		t.Errorf("got %+v, want the error", report)
+	}
+	// The lists are empty rather than null, so that consumers don't need to check.
+	if report.Problems == nil || report.Changes == nil || report.FilesWritten == nil {
+		t.Errorf("got %+v, want empty lists", report)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"path/filepath"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+)
+
+type sarifRule struct {
+	Kind        codemap.ProblemKind
+	Description string
+}
+
+// sarifRules is every rule that may appear in a SARIF log. Rule IDs are the problem codes, which are stable.
+var sarifRules = []sarifRule{
+	{codemap.ProblemDuplicateToken, "The same token is used at more than one location."},
+	{codemap.ProblemTokenNotFound, "A Markdown link refers to a token that doesn't exist."},
+	{codemap.ProblemGroupNotFound, "A Markdown group template refers to a group that doesn't exist."},
+	{codemap.ProblemIncorrectLink, "A Markdown link doesn't point at the current location of its token."},
+	{codemap.ProblemMalformedReference, "A token in Markdown isn't in a link that can be kept up to date."},
+	{codemap.ProblemIncorrectGroupContent, "A Markdown group template's content is out of date."},
+	{codemap.ProblemGroupPolicy, "A group's blocks don't follow its policy."},
+	{codemap.ProblemUnusedToken, "A token isn't linked to from any Markdown file."},
+	{codemap.ProblemGroupChanged, "A group block has changed since it was last acknowledged."},
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations"`
+	Results     []sarifResult     `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string               `json:"name"`
+	Version        string               `json:"version"`
+	InformationURI string               `json:"informationUri"`
+	Rules          []sarifReportingRule `json:"rules"`
+}
+
+type sarifReportingRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level   string       `json:"level"`
+	Message sarifMessage `json:"message"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId"`
+	RuleIndex        int             `json:"ruleIndex"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndLine     int `json:"endLine,omitempty"`
+}
+
+// newSARIFLocation converts a location in the working directory, whose path from the root of the
+// repo is prefix. URIs are relative to the root, which is where code scanning resolves them.
+func newSARIFLocation(loc jsonLocation, endLine int, prefix string) sarifLocation {
+	sarifLoc := sarifLocation{
+		PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: path.Join(prefix, filepath.ToSlash(loc.File))},
+		},
+	}
+
+	if loc.Line > 0 {
+		sarifLoc.PhysicalLocation.Region = &sarifRegion{
+			StartLine:   loc.Line,
+			StartColumn: loc.Column,
+			EndLine:     endLine,
+		}
+	}
+
+	return sarifLoc
+}
+
+// writeSARIFReport writes the problems found by the run as a SARIF 2.1.0 log, suitable
+// for uploading to GitHub code scanning. runErr and result are as for writeJSONReport.
+func writeSARIFReport(w io.Writer, config Config, result *codemap.Result, runErr error) error {
+	driver := sarifDriver{
+		Name:           "eyecue-codemap",
+		Version:        Version,
+		InformationURI: "https://github.com/eyecuelab/eyecue-codemap",
+	}
+
+	ruleIndexes := map[string]int{}
+	for i, rule := range sarifRules {
+		ruleIndexes[string(rule.Kind)] = i
+		driver.Rules = append(driver.Rules, sarifReportingRule{
+			ID:               string(rule.Kind),
+			ShortDescription: sarifMessage{Text: rule.Description},
+		})
+	}
+
+	run := sarifRun{
+		Tool:    sarifTool{Driver: driver},
+		Results: []sarifResult{},
+	}
+
+	invocation := sarifInvocation{ExecutionSuccessful: runErr == nil}
+	if runErr != nil {
+		invocation.ToolExecutionNotifications = []sarifNotification{{
+			Level:   "error",
+			Message: sarifMessage{Text: runErr.Error()},
+		}}
+	} else {
+		prefix := codemap.ProjectPrefix()
+		for _, problem := range jsonProblems(config, result) {
+			sarifRes := sarifResult{
+				RuleID:    problem.Code,
+				RuleIndex: ruleIndexes[problem.Code],
+				Level:     problem.Severity,
+				Message:   sarifMessage{Text: problem.Message},
+				Locations: []sarifLocation{newSARIFLocation(problem.jsonLocation, problem.EndLine, prefix)},
+			}
+			for _, related := range problem.Related {
+				sarifRes.RelatedLocations = append(sarifRes.RelatedLocations, newSARIFLocation(related, 0, prefix))
+			}
+			run.Results = append(run.Results, sarifRes)
+		}
+	}
+	run.Invocations = []sarifInvocation{invocation}
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
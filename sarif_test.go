@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+)
+
+func TestSARIFReportURIs(t *testing.T) {
+	inGitRepo(t, map[string]string{"sub/doc.md": "", "a.go": ""})
+
+	err := os.Chdir("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := &codemap.Result{
+		Problems: []codemap.Problem{{
+			Kind:     codemap.ProblemDuplicateToken,
+			Filename: "doc.md",
+			Line:     1,
+			Token:    "tokA",
+			Message:  "duplicate",
+			Related:  []codemap.Location{{Filename: filepath.FromSlash("../a.go"), Line: 3}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	err = writeSARIFReport(&buf, Config{}, result, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log sarifLog
+	err = json.Unmarshal(buf.Bytes(), &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// URIs are from the root of the repo, not the working directory.
+	results := log.Runs[0].Results
+	if len(results) != 1 || len(results[0].RelatedLocations) != 1 {
+		t.Fatalf("got results %+v, want one with a related location", results)
+	}
+	if got := results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI; got != "sub/doc.md" {
+		t.Errorf("got %q, want sub/doc.md", got)
+	}
+	if got := results[0].RelatedLocations[0].PhysicalLocation.ArtifactLocation.URI; got != "a.go" {
+		t.Errorf("got related %q, want a.go", got)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait after the last change before updating, so that a burst
+// of saves (or a checkout) is handled in one go.
+const watchDebounce = 300 * time.Millisecond
+
+// watchState is what watch remembers between updates.
+type watchState struct {
+	opts    codemap.Options
+	session *codemap.Session
+	watcher *fsnotify.Watcher
+	// debounce is how long to wait after the last change before updating; see watchDebounce.
+	debounce time.Duration
+	// watched are the directories being watched.
+	watched map[string]struct{}
+	// known are the files listed by Git at the last update.
+	known map[string]struct{}
+	// reportedGroups are the changed groups that have been printed, with a description of their changed blocks.
+	reportedGroups map[string]string
+	// reportedUnused are the unused tokens that have been printed.
+	reportedUnused map[string]struct{}
+}
+
+// watch does an update, then watches the directories of the files listed by Git,
+// and updates again after files change until interrupted.
+func watch(config Config) error {
+	fmt.Fprintf(out, "eyecue-codemap %s watching (filenames from Git) ...\n", Version)
+
+	opts, err := libraryOptions(config)
+	if err != nil {
+		return err
+	}
+
+	session, err := codemap.NewSession(opts, codemap.ModeUpdate)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watching: %w", err)
+	}
+	defer watcher.Close()
+
+	w := &watchState{
+		opts:           opts,
+		session:        session,
+		watcher:        watcher,
+		debounce:       watchDebounce,
+		watched:        map[string]struct{}{},
+		reportedGroups: map[string]string{},
+		reportedUnused: map[string]struct{}{},
+	}
+
+	fileSources, err := readFilenamesFromGit(opts)
+	if err != nil {
+		return err
+	}
+
+	// Start watching before the first update, so that no changes are missed.
+	for _, fileSource := range fileSources {
+		err := w.watchDirs(filepath.Dir(fileSource.Filename))
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := session.Load(fileSources)
+	if err != nil {
+		return err
+	}
+	w.known = filenameSet(fileSources)
+	w.printResult(result)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	return w.run(watcher.Events, watcher.Errors, interrupt)
+}
+
+// run updates after files change, as reported by events, until stop receives.
+func (w *watchState) run(events <-chan fsnotify.Event, errs <-chan error, stop <-chan os.Signal) error {
+	pending := map[string]struct{}{}
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			fmt.Fprintln(out, "eyecue-codemap stopped watching")
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			filename := filepath.Clean(event.Name)
+			if event.Op&fsnotify.Create != 0 {
+				if stat, err := os.Lstat(filename); err == nil && stat.IsDir() {
+					err := w.watchTree(filename)
+					if err != nil {
+						fmt.Fprintf(out, "WARNING: %v\n", err)
+					}
+				}
+			}
+
+			pending[filename] = struct{}{}
+			timer.Reset(w.debounce)
+		case err, ok := <-errs:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(out, "WARNING: %v\n", err)
+		case <-timer.C:
+			// On failure, the pending files are kept so that they're tried again after the next change.
+			err := w.update(pending)
+			if err != nil {
+				fmt.Fprintf(out, "ERROR: %v\n", err)
+				continue
+			}
+			pending = map[string]struct{}{}
+		}
+	}
+}
+
+// update lists the files with Git again, and refreshes the ones that are pending,
+// new or no longer listed.
+func (w *watchState) update(pending map[string]struct{}) error {
+	fileSources, err := readFilenamesFromGit(w.opts)
+	if err != nil {
+		return err
+	}
+
+	var changed []codemap.FileSource
+	for _, fileSource := range fileSources {
+		_, isPending := pending[fileSource.Filename]
+		_, isKnown := w.known[fileSource.Filename]
+		if isPending || !isKnown {
+			changed = append(changed, fileSource)
+		}
+	}
+
+	current := filenameSet(fileSources)
+
+	var removed []string
+	for filename := range w.known {
+		if _, ok := current[filename]; !ok {
+			removed = append(removed, filename)
+		}
+	}
+	sort.Strings(removed)
+
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	result, err := w.session.Refresh(changed, removed)
+	if err != nil {
+		return err
+	}
+	w.known = current
+	w.printResult(result)
+
+	return nil
+}
+
+// printResult prints the changes and problems, and the changed groups and unused tokens
+// that are new since the last update.
+func (w *watchState) printResult(result *codemap.Result) {
+	for _, change := range result.Changes {
+		fmt.Println(change.Message)
+	}
+
+	for _, problem := range result.Problems {
+		fmt.Println(problem.Message)
+	}
+
+	// Unused tokens and groups aren't processed while there are duplicate tokens.
+	for _, problem := range result.Problems {
+		if problem.Kind == codemap.ProblemDuplicateToken {
+			return
+		}
+	}
+
+	unused := map[string]struct{}{}
+	for _, unusedToken := range result.UnusedTokens {
+		unused[unusedToken.Token] = struct{}{}
+		if _, ok := w.reportedUnused[unusedToken.Token]; !ok {
+			fmt.Printf("unused token \"%s\" at %s:%d\n", unusedToken.Token, unusedToken.Filename, unusedToken.LineNum)
+		}
+	}
+	w.reportedUnused = unused
+
+	groups := map[string]string{}
+	for _, group := range result.ChangedGroups {
+		var changedBlocks []string
+		for _, groupInfo := range group.Blocks {
+			if groupInfo.Changed() {
+				changedBlocks = append(changedBlocks, fmt.Sprintf("%s:%d", groupInfo.FileSource.Filename, groupInfo.StartLineNumber))
+			}
+		}
+
+		groups[group.Token] = strings.Join(changedBlocks, " ")
+		if w.reportedGroups[group.Token] != groups[group.Token] {
+			printGroupStatus(group)
+		}
+	}
+
+	for token := range w.reportedGroups {
+		if _, ok := groups[token]; !ok {
+			fmt.Printf("group \"%s\" no longer has changes\n", token)
+		}
+	}
+	w.reportedGroups = groups
+}
+
+// watchDirs watches dir and its parents, up to the working directory.
+func (w *watchState) watchDirs(dir string) error {
+	for {
+		if _, ok := w.watched[dir]; ok {
+			return nil
+		}
+
+		err := w.watchDir(dir)
+		if err != nil {
+			return err
+		}
+
+		if dir == "." {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (w *watchState) watchDir(dir string) error {
+	err := w.watcher.Add(dir)
+	if err != nil {
+		return fmt.Errorf(`failed to watch "%s": %w`, dir, err)
+	}
+	w.watched[dir] = struct{}{}
+
+	return nil
+}
+
+// watchTree watches a new directory and the directories in it, except those ignored by Git.
+func (w *watchState) watchTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if info.Name() == ".git" || isIgnoredByGit(path) {
+			return filepath.SkipDir
+		}
+
+		return w.watchDir(path)
+	})
+}
+
+func isIgnoredByGit(path string) bool {
+	// git check-ignore exits with 0 when the path is ignored
+	return exec.Command("git", "check-ignore", "-q", path).Run() == nil
+}
+
+func filenameSet(fileSources []codemap.FileSource) map[string]struct{} {
+	filenames := make(map[string]struct{}, len(fileSources))
+	for _, fileSource := range fileSources {
+		filenames[fileSource.Filename] = struct{}{}
+	}
+
+	return filenames
+}
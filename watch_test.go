@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"eyecuelab.com/eyecue-codemap/codemap"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFiles are two tagged files, and a Markdown file that links to them.
+var watchFiles = map[string]string{
+	"a.go":   "package a\n\n// [" + tagBase + ":tokA]\nvar a = 1\n",
+	"b.go":   "package b\n\n// [" + tagBase + ":tokB]\nvar b = 1\n",
+	"doc.md": "See [a<!--" + tagBase + ":tokA-->](a.go#L4), [b<!--" + tagBase + ":tokB-->](b.go#L4) and [c<!--" + tagBase + ":tokC-->]().\n",
+}
+
+// newTestWatchState does the first update of watch.
+func newTestWatchState(t *testing.T) *watchState {
+	t.Helper()
+
+	session, err := codemap.NewSession(codemap.Options{}, codemap.ModeUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &watchState{
+		session:        session,
+		debounce:       watchDebounce,
+		watched:        map[string]struct{}{},
+		reportedGroups: map[string]string{},
+		reportedUnused: map[string]struct{}{},
+	}
+
+	fileSources, err := readFilenamesFromGit(w.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = session.Load(fileSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.known = filenameSet(fileSources)
+
+	return w
+}
+
+func TestWatchUpdate(t *testing.T) {
+	inGitRepo(t, watchFiles)
+	w := newTestWatchState(t)
+
+	// Only the pending files are read again, besides new ones.
+	replaceInFile(t, "a.go", "package a\n", "package a\n\nconst a0 = 0\n")
+	replaceInFile(t, "b.go", "package b\n", "package b\n\nconst b0 = 0\n")
+	writeFiles(t, map[string]string{"c.go": "package c\n\n// [" + tagBase + ":tokC]\nvar c = 1\n"})
+
+	err := w.update(map[string]struct{}{"a.go": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "See [a<!--" + tagBase + ":tokA-->](a.go#L6), [b<!--" + tagBase + ":tokB-->](b.go#L4) and [c<!--" + tagBase + ":tokC-->](c.go#L4).\n"
+	if got := readFile(t, "doc.md"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Removed files are forgotten.
+	err = os.Remove("b.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.update(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if locs := w.session.Inventory().SinglesByToken["tokB"]; len(locs) != 0 {
+		t.Errorf("got locations %+v of a removed file's token", locs)
+	}
+	if _, ok := w.known["b.go"]; ok {
+		t.Error("the removed file is still known")
+	}
+}
+
+func TestWatchDebounce(t *testing.T) {
+	inGitRepo(t, watchFiles)
+	w := newTestWatchState(t)
+	w.debounce = 500 * time.Millisecond
+
+	events := make(chan fsnotify.Event)
+	errs := make(chan error)
+	stop := make(chan os.Signal)
+	done := make(chan error)
+	go func() { done <- w.run(events, errs, stop) }()
+
+	replaceInFile(t, "a.go", "package a\n", "package a\n\nconst a0 = 0\n")
+	events <- fsnotify.Event{Name: "a.go", Op: fsnotify.Write}
+	replaceInFile(t, "b.go", "package b\n", "package b\n\nconst b0 = 0\n")
+	events <- fsnotify.Event{Name: "./b.go", Op: fsnotify.Write}
+	events <- fsnotify.Event{Name: "a.go", Op: fsnotify.Chmod}
+
+	// Nothing is updated until there have been no changes for a while.
+	original := watchFiles["doc.md"]
+	if got := readFile(t, "doc.md"); got != original {
+		t.Fatalf("updated before the debounce: %q", got)
+	}
+
+	// Then both changes are handled in one go.
+	want := "See [a<!--" + tagBase + ":tokA-->](a.go#L6), [b<!--" + tagBase + ":tokB-->](b.go#L6) and [c<!--" + tagBase + ":tokC-->]().\n"
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := readFile(t, "doc.md")
+		if got == want {
+			break
+		}
+		if got != original && !strings.Contains(got, "b.go#L6") {
+			t.Fatalf("b.go wasn't updated with a.go: %q", got)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop <- os.Interrupt
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}